@@ -0,0 +1,154 @@
+package function
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// PhraseHint is a word or phrase the recognizer should favour, such as a
+// product name. A phrase can refer to a custom class as ${id}. A Boost of 0
+// uses the boost of the list.
+type PhraseHint struct {
+	Value string  `json:"value"`
+	Boost float32 `json:"boost"`
+}
+
+// CustomClassConfig is a list of interchangeable items, such as catalog
+// terms, that phrases refer to as ${id}
+type CustomClassConfig struct {
+	Id    string   `json:"id"`
+	Items []string `json:"items"`
+}
+
+// AdaptationConfig holds a tenant's speech adaptation. PhraseFile is a
+// gs:// URI or local path listing one phrase per line, optionally followed
+// by a tab or comma and its boost; its phrases are added to Phrases when
+// the tenant is loaded. PhraseSets are the resource names of phrase sets
+// kept in the Speech service.
+type AdaptationConfig struct {
+	Phrases       []PhraseHint        `json:"phrases"`
+	PhraseFile    string              `json:"phraseFile"`
+	Boost         float32             `json:"boost"`
+	CustomClasses []CustomClassConfig `json:"customClasses"`
+	PhraseSets    []string            `json:"phraseSets"`
+}
+
+// Boost of a phrase list that does not set one. The service skips lists
+// with a boost of 0.
+const defaultPhraseBoost = 10
+
+func (a AdaptationConfig) empty() bool {
+	return len(a.Phrases) == 0 && len(a.CustomClasses) == 0 && len(a.PhraseSets) == 0
+}
+
+func (a AdaptationConfig) boost() float32 {
+	if a.Boost > 0 {
+		return a.Boost
+	}
+	return defaultPhraseBoost
+}
+
+// Parses a phrase list, skipping blank lines and lines starting with #.
+// Text after the last tab or comma is the boost only when it is a number,
+// so phrases such as "Smith, John" are kept whole.
+func parse_phrase_list(data []byte) ([]PhraseHint, error) {
+	var phrases []PhraseHint
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		phrase := PhraseHint{Value: line}
+		if i := strings.LastIndexAny(line, "\t,"); i >= 0 {
+			if boost, err := strconv.ParseFloat(strings.TrimSpace(line[i+1:]), 32); err == nil {
+				phrase = PhraseHint{Value: strings.TrimSpace(line[:i]), Boost: float32(boost)}
+			}
+		}
+		phrases = append(phrases, phrase)
+	}
+	return phrases, scanner.Err()
+}
+
+// Adds the phrases of the tenant's phrase file to its phrase list
+func load_phrase_file(ctx context.Context, a *AdaptationConfig) error {
+	if a.PhraseFile == "" {
+		return nil
+	}
+	data, err := read_location(ctx, a.PhraseFile)
+	if err != nil {
+		return err
+	}
+	phrases, err := parse_phrase_list(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.PhraseFile, err)
+	}
+	a.Phrases = append(a.Phrases, phrases...)
+	a.PhraseFile = ""
+	return nil
+}
+
+// Builds the v1 adaptation for a recognition request, nil when there is
+// none. Phrases go into one inline phrase set, and custom classes are
+// defined inline under their ids.
+func speech_adaptation(a AdaptationConfig) *speechpb.SpeechAdaptation {
+	if a.empty() {
+		return nil
+	}
+	adaptation := &speechpb.SpeechAdaptation{PhraseSetReferences: a.PhraseSets}
+	if len(a.Phrases) > 0 {
+		set := &speechpb.PhraseSet{Boost: a.boost()}
+		for _, p := range a.Phrases {
+			set.Phrases = append(set.Phrases, &speechpb.PhraseSet_Phrase{Value: p.Value, Boost: p.Boost})
+		}
+		adaptation.PhraseSets = []*speechpb.PhraseSet{set}
+	}
+	for _, c := range a.CustomClasses {
+		class := &speechpb.CustomClass{CustomClassId: c.Id}
+		for _, item := range c.Items {
+			class.Items = append(class.Items, &speechpb.CustomClass_ClassItem{Value: item})
+		}
+		adaptation.CustomClasses = append(adaptation.CustomClasses, class)
+	}
+	return adaptation
+}
+
+// Builds the v2 adaptation in its JSON form, nil when there is none
+func speech_adaptation_v2(a AdaptationConfig) map[string]interface{} {
+	if a.empty() {
+		return nil
+	}
+	var sets, classes []map[string]interface{}
+	if len(a.Phrases) > 0 {
+		var phrases []map[string]interface{}
+		for _, p := range a.Phrases {
+			phrase := map[string]interface{}{"value": p.Value}
+			if p.Boost != 0 {
+				phrase["boost"] = p.Boost
+			}
+			phrases = append(phrases, phrase)
+		}
+		sets = append(sets, map[string]interface{}{"inlinePhraseSet": map[string]interface{}{"phrases": phrases, "boost": a.boost()}})
+	}
+	for _, name := range a.PhraseSets {
+		sets = append(sets, map[string]interface{}{"phraseSet": name})
+	}
+	for _, c := range a.CustomClasses {
+		var items []map[string]string
+		for _, item := range c.Items {
+			items = append(items, map[string]string{"value": item})
+		}
+		classes = append(classes, map[string]interface{}{"name": c.Id, "items": items})
+	}
+	adaptation := map[string]interface{}{"phraseSets": sets}
+	if len(classes) > 0 {
+		adaptation["customClasses"] = classes
+	}
+	return adaptation
+}
@@ -0,0 +1,98 @@
+package function
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePhraseList(t *testing.T) {
+	list := "# florist catalog\nRoses Deluxe\t15\n\nPeace Lily, 5\nsame-day delivery\n"
+	phrases, err := parse_phrase_list([]byte(list))
+	if err != nil {
+		t.Fatalf("parse_phrase_list: %v", err)
+	}
+	want := []PhraseHint{{"Roses Deluxe", 15}, {"Peace Lily", 5}, {"same-day delivery", 0}}
+	if len(phrases) != len(want) {
+		t.Fatalf("got %v", phrases)
+	}
+	for i := range want {
+		if phrases[i] != want[i] {
+			t.Errorf("phrase %d = %+v, want %+v", i, phrases[i], want[i])
+		}
+	}
+	phrases, err = parse_phrase_list([]byte("Smith, John\nSmith, John, 12\nOrchid,lots\n"))
+	if err != nil || len(phrases) != 3 || phrases[0] != (PhraseHint{"Smith, John", 0}) || phrases[1] != (PhraseHint{"Smith, John", 12}) || phrases[2] != (PhraseHint{"Orchid,lots", 0}) {
+		t.Errorf("got %+v, %v", phrases, err)
+	}
+}
+
+func TestSpeechAdaptation(t *testing.T) {
+	if speech_adaptation(AdaptationConfig{}) != nil || speech_adaptation_v2(AdaptationConfig{}) != nil {
+		t.Errorf("expected no adaptation without phrases, classes or phrase sets")
+	}
+	config := AdaptationConfig{
+		Phrases:       []PhraseHint{{Value: "Chromecast", Boost: 18}, {Value: "a bouquet of ${flowers}"}},
+		CustomClasses: []CustomClassConfig{{Id: "flowers", Items: []string{"tulips", "peonies"}}},
+		PhraseSets:    []string{"projects/p/locations/global/phraseSets/catalog"},
+	}
+	adaptation := speech_adaptation(config)
+	if len(adaptation.PhraseSets) != 1 || adaptation.PhraseSets[0].Boost != defaultPhraseBoost || len(adaptation.PhraseSets[0].Phrases) != 2 {
+		t.Fatalf("phrase sets = %v", adaptation.PhraseSets)
+	}
+	if p := adaptation.PhraseSets[0].Phrases[0]; p.Value != "Chromecast" || p.Boost != 18 {
+		t.Errorf("first phrase = %v", p)
+	}
+	if len(adaptation.CustomClasses) != 1 || adaptation.CustomClasses[0].CustomClassId != "flowers" || len(adaptation.CustomClasses[0].Items) != 2 {
+		t.Errorf("custom classes = %v", adaptation.CustomClasses)
+	}
+	if len(adaptation.PhraseSetReferences) != 1 {
+		t.Errorf("phrase set references = %v", adaptation.PhraseSetReferences)
+	}
+	if config := recognition_config(8000, 2, adaptation); config.Adaptation != adaptation {
+		t.Errorf("adaptation not attached to the recognition config")
+	}
+
+	v2 := speech_adaptation_v2(config)
+	sets := v2["phraseSets"].([]map[string]interface{})
+	if len(sets) != 2 || sets[0]["inlinePhraseSet"] == nil || sets[1]["phraseSet"] != config.PhraseSets[0] {
+		t.Errorf("v2 phrase sets = %v", sets)
+	}
+	if classes := v2["customClasses"].([]map[string]interface{}); len(classes) != 1 || classes[0]["name"] != "flowers" {
+		t.Errorf("v2 custom classes = %v", classes)
+	}
+}
+
+func TestTenantPhraseFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TENANT_CONFIG_DIR", dir)
+	phrases := filepath.Join(dir, "catalog.txt")
+	if err := ioutil.WriteFile(phrases, []byte("Roses Deluxe\t15\nPeace Lily\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"adaptation": {"boost": 8, "phrases": [{"value": "Chromecast"}], "phraseFile": "` + phrases + `"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "florist.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := load_tenant_config(context.Background(), "florist")
+	if err != nil {
+		t.Fatalf("load_tenant_config: %v", err)
+	}
+	if len(cfg.Adaptation.Phrases) != 3 || cfg.Adaptation.Phrases[1].Value != "Roses Deluxe" || cfg.Adaptation.boost() != 8 {
+		t.Errorf("phrases = %v", cfg.Adaptation.Phrases)
+	}
+
+	t.Setenv("TRANSCRIBER", "")
+	t.Setenv("PREPROCESS_RATE", "")
+	t.Setenv("PREPROCESS_CHANNELS", "")
+	record := TranscriptRecord{metadata: map[string]string{"phrase_set": "projects/p/locations/global/phraseSets/spring, "}}
+	transcriber, err := select_transcriber(&record, cfg)
+	if err != nil {
+		t.Fatalf("select_transcriber: %v", err)
+	}
+	adaptation := transcriber.(*googleTranscriber).adaptation
+	if len(adaptation.PhraseSetReferences) != 1 || len(adaptation.PhraseSets[0].Phrases) != 3 || len(cfg.Adaptation.PhraseSets) != 0 {
+		t.Errorf("adaptation = %v", adaptation)
+	}
+}
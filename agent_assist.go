@@ -0,0 +1,511 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	language "cloud.google.com/go/language/apiv1"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// AssistConfig holds the agent-assist rules of a tenant, evaluated on live
+// calls. Rules with Channel 0 apply to every channel, each on its own;
+// for silence rules Channel 0 means dead air, when no channel has speech.
+type AssistConfig struct {
+	Keywords  []KeywordRule   `json:"keywords"`
+	Sentiment []SentimentRule `json:"sentiment"`
+	Silence   []SilenceRule   `json:"silence"`
+	//Alerts are also posted here; defaults to ASSIST_WEBHOOK
+	Webhook string `json:"webhook"`
+}
+
+// KeywordRule alerts when a speaker says one of the phrases. Phrases are
+// matched as whole words, ignoring case and punctuation.
+type KeywordRule struct {
+	Name     string   `json:"name"`
+	Phrases  []string `json:"phrases"`
+	Channel  int      `json:"channel"`
+	Severity string   `json:"severity"`
+}
+
+// SentimentRule alerts when the sentiment of a speaker's last WindowSecs
+// of speech drops below Threshold
+type SentimentRule struct {
+	Name       string  `json:"name"`
+	Channel    int     `json:"channel"`
+	WindowSecs float64 `json:"windowSecs"`
+	Threshold  float32 `json:"threshold"`
+	Severity   string  `json:"severity"`
+}
+
+// SilenceRule alerts when a channel, or the whole call, has had no speech
+// for Secs
+type SilenceRule struct {
+	Name     string  `json:"name"`
+	Channel  int     `json:"channel"`
+	Secs     float64 `json:"secs"`
+	Severity string  `json:"severity"`
+}
+
+// AssistAlert is raised by a rule during a live call. AtSecs is the time
+// from the start of the call; Value is the rolling sentiment or the
+// seconds of silence.
+type AssistAlert struct {
+	Rule       string  `json:"rule"`
+	Kind       string  `json:"kind"`
+	Severity   string  `json:"severity"`
+	SpeakerTag int     `json:"speakertag,omitempty"`
+	AtSecs     float64 `json:"atSecs"`
+	Text       string  `json:"text,omitempty"`
+	Value      float64 `json:"value,omitempty"`
+}
+
+const (
+	assistKeyword   = "keyword"
+	assistSentiment = "sentiment"
+	assistSilence   = "silence"
+)
+
+// Rules used for tenants that have none
+var defaultAssistConfig = AssistConfig{
+	Keywords: []KeywordRule{
+		{Name: "cancellation", Phrases: []string{"cancel", "cancellation", "close my account", "terminate"}},
+		{Name: "escalation", Phrases: []string{"supervisor", "manager", "complaint", "lawyer", "unacceptable"}},
+	},
+	Sentiment: []SentimentRule{{Name: "negative sentiment", WindowSecs: 30, Threshold: -0.4}},
+	Silence:   []SilenceRule{{Name: "dead air", Secs: 15}},
+}
+
+// A keyword rule does not alert again for the same speaker within this
+// many seconds of call time
+const assistKeywordCooldownSecs = 30
+
+// Utterances waiting for a sentiment score; more are dropped rather than
+// holding up recognition
+const assistQueue = 64
+
+// Scores the sentiment of an utterance from -1 to 1
+type sentimentScorer func(ctx context.Context, text string) (float32, error)
+
+// Scores utterances with the Natural Language API, connecting on first use
+type nlpSentiment struct {
+	client *language.Client
+}
+
+func (n *nlpSentiment) score(ctx context.Context, text string) (float32, error) {
+	if n.client == nil {
+		client, err := language.NewClient(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n.client = client
+	}
+	r, err := n.client.AnalyzeSentiment(ctx, &languagepb.AnalyzeSentimentRequest{
+		Document: &languagepb.Document{
+			Source: &languagepb.Document_Content{Content: text},
+			Type:   languagepb.Document_PLAIN_TEXT,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return r.DocumentSentiment.Score, nil
+}
+
+func (n *nlpSentiment) close() {
+	if n.client != nil {
+		n.client.Close()
+	}
+}
+
+// Returns the tenant's rules, or the defaults when it has none. ASSIST=off
+// turns agent assist off.
+func assist_config(tenant *TenantConfig) (AssistConfig, bool) {
+	if strings.EqualFold(os.Getenv("ASSIST"), "off") {
+		return AssistConfig{}, false
+	}
+	cfg := tenant.Assist
+	if len(cfg.Keywords) == 0 && len(cfg.Sentiment) == 0 && len(cfg.Silence) == 0 {
+		webhook := cfg.Webhook
+		cfg = defaultAssistConfig
+		cfg.Webhook = webhook
+	}
+	if cfg.Webhook == "" {
+		cfg.Webhook = os.Getenv("ASSIST_WEBHOOK")
+	}
+	return cfg, true
+}
+
+type scoredUtterance struct {
+	start, end float64
+	score      float32
+}
+
+type assistUtterance struct {
+	channel    int
+	text       string
+	start, end float64
+}
+
+// assistEngine evaluates the rules on the final results and audio of one
+// live call and raises alerts through publish and the webhook
+type assistEngine struct {
+	ctx     context.Context
+	callid  string
+	config  AssistConfig
+	publish func(StreamEvent)
+	score   sentimentScorer
+	report  func(error)
+	phrases [][][]string
+	//Masks PII in alert text and in the utterances sent for scoring
+	dlp bool
+
+	mu         sync.Mutex
+	utterances map[int][]scoredUtterance
+	position   map[int]float64
+	lastVoice  map[int]float64
+	active     map[string]bool
+	lastAlert  map[string]float64
+
+	queue    chan assistUtterance
+	scored   chan struct{}
+	webhooks sync.WaitGroup
+}
+
+// report receives the errors of sentiment scoring and webhook delivery
+func new_assist_engine(ctx context.Context, callid string, config AssistConfig, publish func(StreamEvent), score sentimentScorer, report func(error)) *assistEngine {
+	a := &assistEngine{
+		ctx:        ctx,
+		callid:     callid,
+		config:     config,
+		publish:    publish,
+		score:      score,
+		report:     report,
+		utterances: map[int][]scoredUtterance{},
+		position:   map[int]float64{},
+		lastVoice:  map[int]float64{},
+		active:     map[string]bool{},
+		lastAlert:  map[string]float64{},
+		queue:      make(chan assistUtterance, assistQueue),
+		scored:     make(chan struct{}),
+	}
+	for _, rule := range config.Keywords {
+		var phrases [][]string
+		for _, phrase := range rule.Phrases {
+			var words []string
+			for _, w := range strings.Fields(phrase) {
+				if n := normalize_word(w); n != "" {
+					words = append(words, n)
+				}
+			}
+			if len(words) > 0 {
+				phrases = append(phrases, words)
+			}
+		}
+		a.phrases = append(a.phrases, phrases)
+	}
+	go a.score_utterances()
+	return a
+}
+
+func rule_applies(ruleChannel, channel int) bool {
+	return ruleChannel == 0 || ruleChannel == channel
+}
+
+func assist_key(rule string, channel int) string {
+	return fmt.Sprintf("%s|%d", rule, channel)
+}
+
+func (a *assistEngine) raise(alert AssistAlert) {
+	if alert.Severity == "" {
+		alert.Severity = "warning"
+	}
+	if a.dlp && alert.Text != "" {
+		alert.Text = redact_live_text(alert.Text)
+	}
+	event := StreamEvent{Type: streamAlert, Callid: a.callid, SpeakerTag: alert.SpeakerTag, Alert: &alert}
+	a.publish(event)
+	if a.config.Webhook == "" {
+		return
+	}
+	a.webhooks.Add(1)
+	go func() {
+		defer a.webhooks.Done()
+		if err := post_alert(a.ctx, a.config.Webhook, event); err != nil {
+			a.fail(err)
+		}
+	}()
+}
+
+func (a *assistEngine) fail(err error) {
+	if a.report != nil {
+		a.report(err)
+	}
+}
+
+// Posts the alert event as JSON
+func post_alert(ctx context.Context, url string, event StreamEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Checks a final result of a channel against the keyword rules and queues
+// it for sentiment scoring
+func (a *assistEngine) final(channel int, result *speechpb.SpeechRecognitionResult) {
+	if len(result.Alternatives) == 0 {
+		return
+	}
+	alt := result.Alternatives[0]
+	end := get_seconds_from_duration(result.ResultEndTime)
+	start := end
+	if len(alt.Words) > 0 {
+		start = get_seconds_from_duration(alt.Words[0].StartTime)
+	}
+	var tokens []string
+	var times []float64
+	if len(alt.Words) > 0 {
+		for _, w := range alt.Words {
+			tokens = append(tokens, normalize_word(w.Word))
+			times = append(times, get_seconds_from_duration(w.StartTime))
+		}
+	} else {
+		for _, w := range strings.Fields(alt.Transcript) {
+			tokens = append(tokens, normalize_word(w))
+			times = append(times, end)
+		}
+	}
+	for r, rule := range a.config.Keywords {
+		if !rule_applies(rule.Channel, channel) {
+			continue
+		}
+		if at, phrase, ok := match_phrases(tokens, times, a.phrases[r]); ok {
+			key := assist_key(rule.Name, channel)
+			a.mu.Lock()
+			last, alerted := a.lastAlert[key]
+			if alerted && at-last < assistKeywordCooldownSecs {
+				a.mu.Unlock()
+				continue
+			}
+			a.lastAlert[key] = at
+			a.mu.Unlock()
+			a.raise(AssistAlert{Rule: rule.Name, Kind: assistKeyword, Severity: rule.Severity, SpeakerTag: channel, AtSecs: at, Text: phrase})
+		}
+	}
+	if len(a.config.Sentiment) == 0 || a.score == nil {
+		return
+	}
+	text := strings.TrimSpace(alt.Transcript)
+	if a.dlp {
+		text = redact_live_text(text)
+	}
+	select {
+	case a.queue <- assistUtterance{channel: channel, text: text, start: start, end: end}:
+	default:
+	}
+}
+
+// Returns the time and text of the first phrase found in the tokens
+func match_phrases(tokens []string, times []float64, phrases [][]string) (float64, string, bool) {
+	for i := range tokens {
+		for _, phrase := range phrases {
+			if i+len(phrase) > len(tokens) {
+				continue
+			}
+			matched := true
+			for j, w := range phrase {
+				if tokens[i+j] != w {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				return times[i], strings.Join(phrase, " "), true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+func (a *assistEngine) score_utterances() {
+	defer close(a.scored)
+	for u := range a.queue {
+		if u.text == "" {
+			continue
+		}
+		score, err := a.score(a.ctx, u.text)
+		if err != nil {
+			a.fail(err)
+			continue
+		}
+		a.sentiment(u, score)
+	}
+}
+
+// Adds a scored utterance and checks the rolling sentiment of its channel
+func (a *assistEngine) sentiment(u assistUtterance, score float32) {
+	a.mu.Lock()
+	a.utterances[u.channel] = append(a.utterances[u.channel], scoredUtterance{u.start, u.end, score})
+	history := a.utterances[u.channel]
+	var alerts []AssistAlert
+	for _, rule := range a.config.Sentiment {
+		if !rule_applies(rule.Channel, u.channel) {
+			continue
+		}
+		rolling := rolling_sentiment(history, u.end-rule.WindowSecs)
+		key := assist_key(rule.Name, u.channel)
+		if rolling >= float64(rule.Threshold) {
+			a.active[key] = false
+			continue
+		}
+		if !a.active[key] {
+			a.active[key] = true
+			alerts = append(alerts, AssistAlert{Rule: rule.Name, Kind: assistSentiment, Severity: rule.Severity, SpeakerTag: u.channel, AtSecs: u.end, Text: u.text, Value: rolling})
+		}
+	}
+	a.mu.Unlock()
+	for _, alert := range alerts {
+		a.raise(alert)
+	}
+}
+
+// Mean score of the utterances ending after since, weighted by duration
+func rolling_sentiment(utterances []scoredUtterance, since float64) float64 {
+	var sum, weight float64
+	for _, u := range utterances {
+		if u.end <= since {
+			continue
+		}
+		w := math.Max(u.end-math.Max(u.start, since), 0.5)
+		sum += w * float64(u.score)
+		weight += w
+	}
+	if weight == 0 {
+		return 0
+	}
+	return sum / weight
+}
+
+// Tracks speech on a channel from its audio and checks the silence rules
+func (a *assistEngine) audio(channel int, samples []float32, rate int) {
+	if len(samples) == 0 || rate <= 0 {
+		return
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	a.mu.Lock()
+	a.position[channel] += float64(len(samples)) / float64(rate)
+	if math.Sqrt(sum/float64(len(samples))) >= streamPauseLevel {
+		a.lastVoice[channel] = a.position[channel]
+	}
+	var now, voice float64
+	for c, at := range a.position {
+		now = math.Max(now, at)
+		voice = math.Max(voice, a.lastVoice[c])
+	}
+	var alerts []AssistAlert
+	for _, rule := range a.config.Silence {
+		quiet, at, speaker := now-voice, now, 0
+		if rule.Channel != 0 {
+			if rule.Channel != channel {
+				continue
+			}
+			quiet, at, speaker = a.position[channel]-a.lastVoice[channel], a.position[channel], channel
+		}
+		key := assist_key(rule.Name, speaker)
+		if quiet < rule.Secs {
+			a.active[key] = false
+			continue
+		}
+		if !a.active[key] {
+			a.active[key] = true
+			alerts = append(alerts, AssistAlert{Rule: rule.Name, Kind: assistSilence, Severity: rule.Severity, SpeakerTag: speaker, AtSecs: at, Value: quiet})
+		}
+	}
+	a.mu.Unlock()
+	for _, alert := range alerts {
+		a.raise(alert)
+	}
+}
+
+// Waits for the queued utterances to be scored and the alerts delivered
+func (a *assistEngine) close() {
+	close(a.queue)
+	<-a.scored
+	a.webhooks.Wait()
+}
+
+// Stream_alerts serves the alerts of live calls as server-sent events:
+// all calls, or one with ?callid=<callid>. Like a subscription to a
+// stream it needs a token for the call, or for every call without callid.
+func Stream_alerts(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if err := check_stream_origin(nil, r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	callid := r.URL.Query().Get("callid")
+	if callid == "" {
+		callid = streamAllCalls
+	}
+	if err := check_stream_token(r, callid, true); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	events, cancel := streams.subscribe(callid)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if event.Type != streamAlert {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: alert\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package function
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// Collects the alerts an engine raises
+type alertLog struct {
+	mu     sync.Mutex
+	alerts []AssistAlert
+}
+
+func (l *alertLog) publish(e StreamEvent) {
+	if e.Alert != nil {
+		l.mu.Lock()
+		l.alerts = append(l.alerts, *e.Alert)
+		l.mu.Unlock()
+	}
+}
+
+// A final result with one word per second starting at start
+func assist_result(text string, start float64) *speechpb.SpeechRecognitionResult {
+	alt := &speechpb.SpeechRecognitionAlternative{Transcript: text}
+	at := start
+	for _, w := range strings.Fields(text) {
+		alt.Words = append(alt.Words, &speechpb.WordInfo{Word: w, StartTime: seconds_to_duration(at), EndTime: seconds_to_duration(at + 1)})
+		at++
+	}
+	return &speechpb.SpeechRecognitionResult{Alternatives: []*speechpb.SpeechRecognitionAlternative{alt}, ResultEndTime: seconds_to_duration(at)}
+}
+
+func TestAssistKeywords(t *testing.T) {
+	log := &alertLog{}
+	config := AssistConfig{Keywords: []KeywordRule{
+		{Name: "cancellation", Phrases: []string{"cancel", "close my account"}, Severity: "critical"},
+		{Name: "supervisor", Phrases: []string{"supervisor"}, Channel: 2},
+	}}
+	a := new_assist_engine(context.Background(), "call", config, log.publish, nil, nil)
+	a.final(2, assist_result("I want to close my account.", 10))
+	a.final(2, assist_result("Just cancel it", 20))
+	a.final(1, assist_result("Let me get my supervisor", 25))
+	a.final(2, assist_result("Cancel!", 45))
+	a.final(2, assist_result("Get me a supervisor", 50))
+	a.close()
+	if len(log.alerts) != 3 {
+		t.Fatalf("alerts = %+v", log.alerts)
+	}
+	first := log.alerts[0]
+	if first.Rule != "cancellation" || first.Kind != assistKeyword || first.Severity != "critical" || first.SpeakerTag != 2 || first.AtSecs != 13 || first.Text != "close my account" {
+		t.Errorf("first alert = %+v", first)
+	}
+	if log.alerts[1].AtSecs != 45 || log.alerts[2].Rule != "supervisor" || log.alerts[2].Severity != "warning" {
+		t.Errorf("alerts = %+v", log.alerts)
+	}
+}
+
+func TestAssistSentiment(t *testing.T) {
+	log := &alertLog{}
+	scores := map[string]float32{"fine": 0.2, "this is terrible": -0.8, "awful": -0.9, "thanks so much": 0.9}
+	score := func(ctx context.Context, text string) (float32, error) { return scores[text], nil }
+	config := AssistConfig{Sentiment: []SentimentRule{{Name: "negative", Channel: 2, WindowSecs: 20, Threshold: -0.4}}}
+	a := new_assist_engine(context.Background(), "call", config, log.publish, score, nil)
+	a.final(2, assist_result("fine", 0))
+	a.final(1, assist_result("awful", 2))
+	a.final(2, assist_result("this is terrible", 5))
+	a.final(2, assist_result("awful", 9))
+	a.final(2, assist_result("thanks so much", 30))
+	a.final(2, assist_result("this is terrible", 60))
+	a.close()
+	if len(log.alerts) != 2 {
+		t.Fatalf("alerts = %+v", log.alerts)
+	}
+	//fine (1s at 0.2) and this is terrible (3s at -0.8)
+	if alert := log.alerts[0]; alert.Kind != assistSentiment || alert.AtSecs != 8 || alert.SpeakerTag != 2 || alert.Value > -0.54 || alert.Value < -0.56 {
+		t.Errorf("first alert = %+v", alert)
+	}
+	if log.alerts[1].AtSecs != 63 {
+		t.Errorf("sentiment did not re-arm: %+v", log.alerts[1])
+	}
+}
+
+func TestAssistDlp(t *testing.T) {
+	log := &alertLog{}
+	var scored []string
+	score := func(ctx context.Context, text string) (float32, error) {
+		scored = append(scored, text)
+		return -0.9, nil
+	}
+	config := AssistConfig{Sentiment: []SentimentRule{{Name: "negative", WindowSecs: 20, Threshold: -0.4}}}
+	a := new_assist_engine(context.Background(), "call", config, log.publish, score, nil)
+	a.dlp = true
+	a.final(2, assist_result("my card is 4111 1111 1111 1111 and you charged it twice", 0))
+	a.close()
+	if len(log.alerts) != 1 || strings.Contains(log.alerts[0].Text, "1111") || !strings.Contains(log.alerts[0].Text, "charged it twice") {
+		t.Errorf("alerts = %+v", log.alerts)
+	}
+	if len(scored) != 1 || strings.Contains(scored[0], "1111") {
+		t.Errorf("scored %q", scored)
+	}
+}
+
+func TestAssistSilence(t *testing.T) {
+	log := &alertLog{}
+	config := AssistConfig{Silence: []SilenceRule{{Name: "dead air", Secs: 5}, {Name: "agent quiet", Channel: 1, Secs: 3}}}
+	a := new_assist_engine(context.Background(), "call", config, log.publish, nil, nil)
+	quiet, loud := make([]float32, 8000), make([]float32, 8000)
+	for i := range loud {
+		loud[i] = 0.2
+	}
+	for i := 0; i < 6; i++ {
+		a.audio(1, quiet, 8000)
+		if i < 4 {
+			a.audio(2, loud, 8000)
+		} else {
+			a.audio(2, quiet, 8000)
+		}
+	}
+	a.audio(1, loud, 8000)
+	for i := 0; i < 6; i++ {
+		a.audio(1, quiet, 8000)
+	}
+	a.close()
+	if len(log.alerts) != 3 {
+		t.Fatalf("alerts = %+v", log.alerts)
+	}
+	if alert := log.alerts[0]; alert.Rule != "agent quiet" || alert.AtSecs != 3 || alert.SpeakerTag != 1 {
+		t.Errorf("first alert = %+v", alert)
+	}
+	if alert := log.alerts[1]; alert.Rule != "agent quiet" || alert.AtSecs != 10 {
+		t.Errorf("silence did not re-arm: %+v", alert)
+	}
+	//Channel 2 stopped at 4s and channel 1 at 7s
+	if alert := log.alerts[2]; alert.Rule != "dead air" || alert.AtSecs != 12 || alert.Value != 5 || alert.SpeakerTag != 0 {
+		t.Errorf("dead air alert = %+v", alert)
+	}
+}
+
+func TestAssistWebhook(t *testing.T) {
+	received := make(chan StreamEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event StreamEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+	config := AssistConfig{Keywords: []KeywordRule{{Name: "cancellation", Phrases: []string{"cancel"}}}, Webhook: server.URL}
+	var failures []error
+	a := new_assist_engine(context.Background(), "call-9", config, func(StreamEvent) {}, nil, func(err error) { failures = append(failures, err) })
+	a.final(1, assist_result("please cancel", 0))
+	a.close()
+	event := <-received
+	if event.Type != streamAlert || event.Callid != "call-9" || event.Alert == nil || event.Alert.Rule != "cancellation" || len(failures) != 0 {
+		t.Errorf("webhook got %+v, failures %v", event, failures)
+	}
+}
+
+func TestAssistConfig(t *testing.T) {
+	t.Setenv("ASSIST_WEBHOOK", "https://hooks.example.com/alerts")
+	cfg, ok := assist_config(&TenantConfig{})
+	if !ok || len(cfg.Keywords) != len(defaultAssistConfig.Keywords) || cfg.Webhook != "https://hooks.example.com/alerts" {
+		t.Errorf("default config = %+v", cfg)
+	}
+	tenant := &TenantConfig{Assist: AssistConfig{Silence: []SilenceRule{{Name: "quiet", Secs: 10}}, Webhook: "https://tenant.example.com"}}
+	if cfg, _ := assist_config(tenant); len(cfg.Keywords) != 0 || cfg.Webhook != "https://tenant.example.com" {
+		t.Errorf("tenant config = %+v", cfg)
+	}
+	t.Setenv("ASSIST", "off")
+	if _, ok := assist_config(tenant); ok {
+		t.Errorf("ASSIST=off did not turn agent assist off")
+	}
+}
+
+func TestStreamAlerts(t *testing.T) {
+	t.Setenv("STREAM_TOKEN_SECRET", "s3cret")
+	server := httptest.NewServer(http.HandlerFunc(Stream_alerts))
+	defer server.Close()
+	token, _ := Stream_token("call-3", time.Now().Add(time.Minute))
+	//A token for one call does not open the alerts of every call
+	resp, err := http.Get(server.URL + "?token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("all calls with a call token: %s", resp.Status)
+	}
+	resp, err = http.Get(server.URL + "?callid=call-3&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("content type %q", resp.Header.Get("Content-Type"))
+	}
+	for i := 0; i < 100; i++ {
+		streams.mu.Lock()
+		n := len(streams.subscribers["call-3"])
+		streams.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	streams.publish(StreamEvent{Type: streamFinal, Callid: "call-3", Transcript: "not an alert"})
+	streams.publish(StreamEvent{Type: streamAlert, Callid: "call-3", Alert: &AssistAlert{Rule: "escalation"}})
+	reader := bufio.NewReader(resp.Body)
+	line, _ := reader.ReadString('\n')
+	data, _ := reader.ReadString('\n')
+	if line != "event: alert\n" || !strings.Contains(data, `"rule":"escalation"`) {
+		t.Errorf("got %q %q", line, data)
+	}
+}
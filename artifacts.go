@@ -0,0 +1,218 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Prefix for objects the pipeline writes back to the upload bucket. Uploads
+// under it are ignored so generated files do not trigger processing again.
+const artifactPrefix = "processed/"
+
+// Reports whether an uploaded object was written by the pipeline itself
+func is_artifact(name string) bool {
+	return strings.HasPrefix(name, artifactPrefix)
+}
+
+// Returns the bucket and object name for a file derived from an upload, e.g.
+// artifact_location("audio", "calls/a.wav", ".redacted.wav"). Artifacts go to
+// OUTPUT_BUCKET when set, otherwise under artifactPrefix in the upload bucket.
+func artifact_location(bucket, name, suffix string) (string, string) {
+	base := strings.TrimSuffix(name, path.Ext(name)) + suffix
+	if out := os.Getenv("OUTPUT_BUCKET"); out != "" {
+		return out, base
+	}
+	return bucket, artifactPrefix + base
+}
+
+func read_gcs_object(ctx context.Context, bucket, name string) ([]byte, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	rc, err := client.Bucket(bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func write_gcs_object(ctx context.Context, bucket, name string, data []byte, contentType string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	w := client.Bucket(bucket).Object(name).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Bytes read to find the format and sample data of a WAV recording
+const wavHeaderBytes = 64 << 10
+
+// Recordings whose samples would take more memory than this decoded are not
+// decoded, unless DECODE_MAX_MB says otherwise
+const defaultDecodeMaxMB = 256
+
+// Largest recording decoded whole, in bytes of samples, from DECODE_MAX_MB
+func decode_max_bytes() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("DECODE_MAX_MB"), 10, 64); err == nil && v > 0 {
+		return v << 20
+	}
+	return defaultDecodeMaxMB << 20
+}
+
+// gcsWav is a WAV recording in a bucket, decoded a window at a time with
+// range reads
+type gcsWav struct {
+	ctx    context.Context
+	client *storage.Client
+	object *storage.ObjectHandle
+	format wavFormat
+}
+
+// Reads the header of a WAV recording in a bucket. The caller closes it.
+func open_gcs_wav(ctx context.Context, bucket, name string) (*gcsWav, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wav := &gcsWav{ctx: ctx, client: client, object: client.Bucket(bucket).Object(name)}
+	rc, err := wav.object.NewRangeReader(ctx, 0, wavHeaderBytes)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	defer rc.Close()
+	head, err := ioutil.ReadAll(rc)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	wav.format, err = wav_header(head, rc.Attrs.Size)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return wav, nil
+}
+
+func (w *gcsWav) close() {
+	w.client.Close()
+}
+
+func (w *gcsWav) Duration() float64 {
+	return w.format.Duration()
+}
+
+// Reads and decodes the samples between two times
+func (w *gcsWav) window(startSecs, endSecs float64) (*WavAudio, error) {
+	clamp := func(secs float64) int64 {
+		i := int64(math.Round(secs * float64(w.format.SampleRate)))
+		if i < 0 {
+			return 0
+		}
+		if i > w.format.frames() {
+			return w.format.frames()
+		}
+		return i
+	}
+	start, end := clamp(startSecs), clamp(endSecs)
+	if end < start {
+		end = start
+	}
+	width := int64(w.format.frame_width())
+	rc, err := w.object.NewRangeReader(w.ctx, w.format.DataOffset+start*width, (end-start)*width)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return decode_frames(w.format, rc, int(end-start))
+}
+
+// Downloads and decodes a WAV recording. Recordings that would take more
+// than DECODE_MAX_MB decoded are refused, so a long call cannot exhaust the
+// function's memory.
+func read_gcs_wav(ctx context.Context, bucket, name string) (*WavAudio, error) {
+	wav, err := open_gcs_wav(ctx, bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	defer wav.close()
+	if need, limit := wav.format.decoded_bytes(), decode_max_bytes(); need > limit {
+		return nil, fmt.Errorf("%.0f minutes of audio need %d MB decoded, over the %d MB limit", wav.Duration()/60, need>>20, limit>>20)
+	}
+	return wav.window(0, wav.Duration())
+}
+
+// Reads a file from a gs:// URI or a local path
+func read_location(ctx context.Context, location string) ([]byte, error) {
+	if strings.HasPrefix(location, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid GCS location %q", location)
+		}
+		return read_gcs_object(ctx, parts[0], parts[1])
+	}
+	return ioutil.ReadFile(location)
+}
+
+// Lists the files directly in a gs://bucket/prefix or local directory, as
+// locations read_location accepts
+func list_location(ctx context.Context, dir string) ([]string, error) {
+	if !strings.HasPrefix(dir, "gs://") {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+		return files, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(dir, "gs://"), "/", 2)
+	prefix := ""
+	if len(parts) == 2 && parts[1] != "" {
+		prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	var files []string
+	it := client.Bucket(parts[0]).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Name != "" {
+			files = append(files, fmt.Sprintf("gs://%s/%s", parts[0], attrs.Name))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,103 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// AudioSegment is a time range within a recording.
+type AudioSegment struct {
+	StartSecs float64 `json:"startSecs"`
+	EndSecs   float64 `json:"endSecs"`
+}
+
+// Padding added around each redacted span, since word timings from Speech
+// are only accurate to about a tenth of a second.
+const audioRedactionPadSecs = 0.25
+
+// Frequency and level of the bleep written over redacted audio
+const (
+	bleepHz        = 1000
+	bleepAmplitude = 0.25
+)
+
+// Pads the segments and merges any that overlap, sorted by start time
+func merge_segments(segments []AudioSegment, pad float64) []AudioSegment {
+	var padded []AudioSegment
+	for _, s := range segments {
+		//Findings outside the word list have no timing
+		if s.StartSecs == 0 && s.EndSecs == 0 {
+			continue
+		}
+		padded = append(padded, AudioSegment{StartSecs: math.Max(0, s.StartSecs-pad), EndSecs: s.EndSecs + pad})
+	}
+	sort.Slice(padded, func(i, j int) bool { return padded[i].StartSecs < padded[j].StartSecs })
+	var merged []AudioSegment
+	for _, s := range padded {
+		if n := len(merged); n > 0 && s.StartSecs <= merged[n-1].EndSecs {
+			merged[n-1].EndSecs = math.Max(merged[n-1].EndSecs, s.EndSecs)
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// Time ranges of the redacted spans that carry word timings
+func redaction_segments(spans []RedactedSpan) []AudioSegment {
+	var segments []AudioSegment
+	for _, span := range spans {
+		segments = append(segments, AudioSegment{StartSecs: span.StartSecs, EndSecs: span.EndSecs})
+	}
+	return merge_segments(segments, audioRedactionPadSecs)
+}
+
+// Replaces the segments on every channel with silence or a tone. All
+// channels are masked because each party is usually audible on the other's
+// channel too.
+func mask_audio(audio *WavAudio, segments []AudioSegment, mode string) {
+	for _, seg := range segments {
+		start, end := audio.sample_index(seg.StartSecs), audio.sample_index(seg.EndSecs)
+		for _, samples := range audio.Channels {
+			for i := start; i < end; i++ {
+				if mode == "tone" {
+					samples[i] = float32(bleepAmplitude * math.Sin(2*math.Pi*bleepHz*float64(i)/float64(audio.SampleRate)))
+				} else {
+					samples[i] = 0
+				}
+			}
+		}
+	}
+}
+
+// Writes a copy of the recording with the redacted spans and any keypad
+// tones masked, using the AUDIO_REDACTION mode: "silence" (default), "tone"
+// or "off". The decoded audio passed in is left untouched.
+func redact_audio(ctx context.Context, audio *WavAudio, bucket, name string, record *TranscriptRecord) error {
+	mode := os.Getenv("AUDIO_REDACTION")
+	if mode == "" {
+		mode = "silence"
+	}
+	if mode == "off" {
+		return nil
+	}
+	if mode != "silence" && mode != "tone" {
+		return fmt.Errorf("unknown AUDIO_REDACTION mode %q", mode)
+	}
+	if audio == nil {
+		return fmt.Errorf("audio not decoded")
+	}
+	segments := append(redaction_segments(record.redactedSpans), dtmf_segments(record.Keypresses)...)
+	redacted := clone_audio(audio)
+	mask_audio(redacted, merge_segments(segments, 0), mode)
+	outBucket, outName := artifact_location(bucket, name, ".redacted.wav")
+	err := write_gcs_object(ctx, outBucket, outName, encode_wav(redacted), "audio/wav")
+	if err != nil {
+		return err
+	}
+	record.Redactedaudio = fmt.Sprintf("gs://%s/%s", outBucket, outName)
+	return nil
+}
@@ -0,0 +1,35 @@
+package function
+
+import "testing"
+
+func TestMergeSegments(t *testing.T) {
+	got := merge_segments([]AudioSegment{{3, 4}, {0, 0}, {1, 2}, {4.2, 5}}, 0.25)
+	want := []AudioSegment{{0.75, 2.25}, {2.75, 5.25}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got[i], want[i])
+		}
+	}
+}
+
+func TestMaskAudio(t *testing.T) {
+	audio := make_test_tone(8000, 2, 2, 440, 0.5)
+	mask_audio(audio, []AudioSegment{{0.5, 1}}, "silence")
+	for c, samples := range audio.Channels {
+		for i := 4000; i < 8000; i++ {
+			if samples[i] != 0 {
+				t.Fatalf("channel %d sample %d not silenced", c, i)
+			}
+		}
+		if samples[3999] == 0 && samples[3998] == 0 {
+			t.Errorf("channel %d silenced before the segment", c)
+		}
+	}
+	mask_audio(audio, []AudioSegment{{0.5, 1}}, "tone")
+	if audio.Channels[0][4002] == 0 {
+		t.Errorf("tone not written")
+	}
+}
@@ -0,0 +1,148 @@
+package function
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Where the start time of a call was found, stored in Starttimesource
+const (
+	startMetadata   = "metadata"
+	startSidecar    = "sidecar"
+	startFilename   = "filename"
+	startStream     = "stream"
+	startUpload     = "upload"
+	startProcessing = "processing"
+)
+
+// Timestamps recorders put in file names, e.g. 20240305_143000,
+// 2024-03-05T14-30-00 or 2024-03-05 14.30.00
+var filenameTimePattern = regexp.MustCompile(`(20\d\d)[-_]?(\d\d)[-_]?(\d\d)[T_\- ]?(\d\d)[-_:.]?(\d\d)[-_:.]?(\d\d)`)
+
+// Unix times outside this range are rejected rather than read as a call in
+// e.g. 1970 or the year 2500
+var (
+	epochMin = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	epochMax = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Parses a call start time: RFC 3339, or "2006-01-02 15:04:05",
+// 20060102150405, 20060102 and similar in loc, or Unix seconds or
+// milliseconds
+func parse_call_time(value string, loc *time.Location) (time.Time, error) {
+	//Compact dates are all digits, so they are tried before Unix times
+	for _, layout := range []string{"20060102150405", "20060102"} {
+		if len(value) != len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		t := time.Unix(n, 0).UTC()
+		if n > 1e11 {
+			t = time.UnixMilli(n).UTC()
+		}
+		if t.Before(epochMin) || !t.Before(epochMax) {
+			return time.Time{}, fmt.Errorf("Unix time %q is outside %d-%d", value, epochMin.Year(), epochMax.Year()-1)
+		}
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.UTC(), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
+
+// Finds a timestamp in a file name, in the site's local time.
+// FILENAME_TIME_LAYOUT is a Go time layout to look for instead of the
+// common recorder patterns, e.g. "060102-1504".
+func filename_call_time(name string, loc *time.Location) (time.Time, bool) {
+	base := path.Base(name)
+	if layout := os.Getenv("FILENAME_TIME_LAYOUT"); layout != "" {
+		for i := 0; i+len(layout) <= len(base); i++ {
+			if t, err := time.ParseInLocation(layout, base[i:i+len(layout)], loc); err == nil {
+				return t.UTC(), true
+			}
+		}
+		return time.Time{}, false
+	}
+	m := filenameTimePattern.FindStringSubmatch(base)
+	if m == nil {
+		return time.Time{}, false
+	}
+	var n [6]int
+	for i := range n {
+		n[i], _ = strconv.Atoi(m[i+1])
+	}
+	t := time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], 0, loc)
+	//Reject impossible dates that time.Date would normalize
+	if t.Month() != time.Month(n[1]) || t.Day() != n[2] || t.Hour() != n[3] || t.Minute() != n[4] || t.Second() != n[5] {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+// Returns the site's timezone: the call's "timezone" metadata, then the
+// tenant's, then SITE_TIMEZONE, then UTC
+func site_location(record *TranscriptRecord, tenant *TenantConfig) (*time.Location, error) {
+	for _, name := range []string{record.metadata["timezone"], tenant.Timezone, os.Getenv("SITE_TIMEZONE")} {
+		if name == "" {
+			continue
+		}
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return time.UTC, fmt.Errorf("unknown timezone %q", name)
+		}
+		return loc, nil
+	}
+	return time.UTC, nil
+}
+
+// Sets when the call started: Date in UTC, and Year, Month, Day and
+// Starttime in the site's timezone. The start comes from the metadata or
+// sidecar, then a timestamp in the file name, then when the recording was
+// uploaded, and as a last resort when it was processed.
+func set_call_time(record *TranscriptRecord, tenant *TenantConfig, name string, uploaded, processed time.Time) error {
+	loc, err := site_location(record, tenant)
+	record.Processedat = processed.UTC()
+	var start time.Time
+	if record.callStart != "" {
+		if t, perr := parse_call_time(record.callStart, loc); perr == nil {
+			start, record.Starttimesource = t, record.callStartSource
+		}
+	}
+	if start.IsZero() && name != "" {
+		if t, ok := filename_call_time(name, loc); ok {
+			start, record.Starttimesource = t, startFilename
+		}
+	}
+	if start.IsZero() && !uploaded.IsZero() {
+		start, record.Starttimesource = uploaded.UTC(), startUpload
+	}
+	if start.IsZero() {
+		start, record.Starttimesource = processed.UTC(), startProcessing
+	}
+	record.Date = start
+	record.Timezone = loc.String()
+	local := start.In(loc)
+	record.Year, record.Month, record.Day = local.Year(), int(local.Month()), local.Day()
+	record.Starttime = local.Format("15:04:05")
+	return err
+}
+
+// Returns the wall-clock time of a point in the call, e.g. a word's
+// StartSecs
+func absolute_time(record *TranscriptRecord, secs float64) time.Time {
+	return record.Date.Add(time.Duration(secs * float64(time.Second)))
+}
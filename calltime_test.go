@@ -0,0 +1,91 @@
+package function
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCallTime(t *testing.T) {
+	want := time.Date(2024, 3, 5, 19, 30, 0, 0, time.UTC)
+	chicago, _ := time.LoadLocation("America/Chicago")
+	for _, value := range []string{"2024-03-05T14:30:00-05:00", "2024-03-05 13:30:00", "20240305133000", "1709667000", "1709667000000"} {
+		if got, err := parse_call_time(value, chicago); err != nil || !got.Equal(want) {
+			t.Errorf("%s: got %v, %v", value, got, err)
+		}
+	}
+	if got, err := parse_call_time("20240305", chicago); err != nil || !got.Equal(time.Date(2024, 3, 5, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("date only: got %v, %v", got, err)
+	}
+	for _, value := range []string{"yesterday", "12345", "0", "99999999999999", "20241345"} {
+		if got, err := parse_call_time(value, time.UTC); err == nil {
+			t.Errorf("%s: expected an error, got %v", value, got)
+		}
+	}
+}
+
+func TestFilenameCallTime(t *testing.T) {
+	want := time.Date(2024, 3, 5, 14, 30, 15, 0, time.UTC)
+	for _, name := range []string{"calls/agent7_20240305_143015.wav", "2024-03-05T14-30-15_c1.wav", "rec 2024-03-05 14.30.15.wav"} {
+		if got, ok := filename_call_time(name, time.UTC); !ok || !got.Equal(want) {
+			t.Errorf("%s: got %v, %v", name, got, ok)
+		}
+	}
+	for _, name := range []string{"calls/c-1001.wav", "calls/20241345_250000.wav"} {
+		if got, ok := filename_call_time(name, time.UTC); ok {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+	t.Setenv("FILENAME_TIME_LAYOUT", "060102-1504")
+	if got, ok := filename_call_time("calls/x240305-1430y.wav", time.UTC); !ok || !got.Equal(want.Add(-15*time.Second)) {
+		t.Errorf("layout: got %v, %v", got, ok)
+	}
+}
+
+func TestSetCallTime(t *testing.T) {
+	processed := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	uploaded := time.Date(2024, 3, 6, 2, 0, 0, 0, time.UTC)
+
+	//A local start time from the sidecar, in the tenant's timezone
+	record := &TranscriptRecord{callStart: "2024-03-05 21:30:00", callStartSource: startSidecar}
+	tenant := &TenantConfig{Timezone: "America/Los_Angeles"}
+	if err := set_call_time(record, tenant, "calls/20240101_000000.wav", uploaded, processed); err != nil {
+		t.Fatal(err)
+	}
+	if !record.Date.Equal(time.Date(2024, 3, 6, 5, 30, 0, 0, time.UTC)) || record.Starttimesource != startSidecar || record.Timezone != "America/Los_Angeles" {
+		t.Errorf("record = %v %s %s", record.Date, record.Starttimesource, record.Timezone)
+	}
+	if record.Year != 2024 || record.Month != 3 || record.Day != 5 || record.Starttime != "21:30:00" || !record.Processedat.Equal(processed) {
+		t.Errorf("local start = %d-%d-%d %s, processed %v", record.Year, record.Month, record.Day, record.Starttime, record.Processedat)
+	}
+
+	//The file name, read in SITE_TIMEZONE
+	t.Setenv("SITE_TIMEZONE", "Europe/Berlin")
+	record = &TranscriptRecord{}
+	set_call_time(record, &TenantConfig{}, "calls/20240305_143000.wav", uploaded, processed)
+	if !record.Date.Equal(time.Date(2024, 3, 5, 13, 30, 0, 0, time.UTC)) || record.Starttimesource != startFilename || record.Starttime != "14:30:00" {
+		t.Errorf("filename start = %v %s %s", record.Date, record.Starttimesource, record.Starttime)
+	}
+
+	//The upload time, and an unknown timezone falling back to UTC
+	record = &TranscriptRecord{metadata: map[string]string{"timezone": "Nowhere/Special"}}
+	if err := set_call_time(record, &TenantConfig{}, "calls/c-1.wav", uploaded, processed); err == nil {
+		t.Errorf("expected an error for an unknown timezone")
+	}
+	if !record.Date.Equal(uploaded) || record.Starttimesource != startUpload || record.Timezone != "UTC" || record.Day != 6 {
+		t.Errorf("upload start = %v %s %s", record.Date, record.Starttimesource, record.Timezone)
+	}
+
+	record = &TranscriptRecord{}
+	set_call_time(record, &TenantConfig{}, "", time.Time{}, processed)
+	if !record.Date.Equal(processed) || record.Starttimesource != startProcessing {
+		t.Errorf("processing start = %v %s", record.Date, record.Starttimesource)
+	}
+}
+
+func TestAbsoluteTime(t *testing.T) {
+	record := &TranscriptRecord{Date: time.Date(2024, 3, 5, 19, 30, 0, 0, time.UTC)}
+	add_test_word(record, "hello", 62.5, 63, 1)
+	if got := absolute_time(record, record.Words[0].StartSecs); !got.Equal(time.Date(2024, 3, 5, 19, 31, 2, 500000000, time.UTC)) {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,244 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	speech "cloud.google.com/go/speech/apiv1"
+	"cloud.google.com/go/storage"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	//Recordings longer than this are split unless CHUNK_MAX_SECS says otherwise
+	defaultChunkMaxSecs = 300.0
+	//Audio shared by neighbouring chunks on either side of a cut
+	chunkOverlapSecs = 2.0
+	//How far before the ideal cut point to look for a pause
+	chunkSearchSecs = 30.0
+	//Chunks transcribed at the same time
+	chunkParallelism = 4
+)
+
+// Longest recording sent to Speech in one request, from CHUNK_MAX_SECS
+func chunk_max_secs() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("CHUNK_MAX_SECS"), 64); err == nil && v > 4*chunkOverlapSecs {
+		return v
+	}
+	return defaultChunkMaxSecs
+}
+
+// audioWindows is a recording that can be decoded a stretch at a time, so
+// that long calls are never held in memory whole
+type audioWindows interface {
+	Duration() float64
+	window(startSecs, endSecs float64) (*WavAudio, error)
+}
+
+// Returns a copy of the samples between two times
+func (a *WavAudio) window(startSecs, endSecs float64) (*WavAudio, error) {
+	return slice_audio(a, startSecs, endSecs), nil
+}
+
+// Chooses cut points so that every chunk, overlap included, is at most
+// maxSecs long. Each cut is placed in the middle of the longest pause on all
+// channels shortly before the latest allowed point. Only the stretches
+// searched for a pause are decoded.
+func chunk_cuts(src audioWindows, maxSecs float64) ([]float64, error) {
+	duration := src.Duration()
+	var cuts []float64
+	prev := 0.0
+	for duration-prev > maxSecs-chunkOverlapSecs {
+		target := prev + maxSecs - 2*chunkOverlapSecs
+		from := math.Floor(math.Max(prev+chunkOverlapSecs, target-chunkSearchSecs)/vadFrameSecs) * vadFrameSecs
+		search, err := src.window(from, target)
+		if err != nil {
+			return nil, err
+		}
+		var channels [][]bool
+		for _, samples := range search.Channels {
+			channels = append(channels, speech_frames(samples, search.SampleRate))
+		}
+		silent := func(f int) bool {
+			for _, flags := range channels {
+				if f < len(flags) && flags[f] {
+					return false
+				}
+			}
+			return true
+		}
+		to := int((target - from) / vadFrameSecs)
+		cut := target
+		best := 0
+		for f := 0; f < to; {
+			if !silent(f) {
+				f++
+				continue
+			}
+			g := f
+			for g < to && silent(g) {
+				g++
+			}
+			if g-f > best {
+				best = g - f
+				cut = from + float64(f+g)/2*vadFrameSecs
+			}
+			f = g
+		}
+		cuts = append(cuts, cut)
+		prev = cut
+	}
+	return cuts, nil
+}
+
+// Returns a copy of the samples between two times
+func slice_audio(audio *WavAudio, startSecs, endSecs float64) *WavAudio {
+	start, end := audio.sample_index(startSecs), audio.sample_index(endSecs)
+	part := &WavAudio{SampleRate: audio.SampleRate, BitsPerSample: audio.BitsPerSample}
+	for _, samples := range audio.Channels {
+		part.Channels = append(part.Channels, append([]float32(nil), samples[start:end]...))
+	}
+	return part
+}
+
+func seconds_to_duration(secs float64) *durationpb.Duration {
+	whole := math.Floor(secs)
+	return &durationpb.Duration{Seconds: int64(whole), Nanos: int32(math.Round((secs - whole) * 1e9))}
+}
+
+// Moves every timestamp in a chunk's response to the position of the chunk
+// in the full recording and keeps only the words spoken between lo and hi,
+// so words in the overlap are taken from one chunk only. Runner-up
+// hypotheses are kept, except for results that straddle lo or hi, whose
+// runner-ups cannot be cut at the same word.
+func stitch_chunk(resp *speechpb.LongRunningRecognizeResponse, offset, lo, hi float64) []*speechpb.SpeechRecognitionResult {
+	var results []*speechpb.SpeechRecognitionResult
+	for _, result := range resp.GetResults() {
+		if len(result.Alternatives) == 0 {
+			continue
+		}
+		alt := result.Alternatives[0]
+		var words []*speechpb.WordInfo
+		for _, w := range alt.Words {
+			start := get_seconds_from_duration(w.StartTime) + offset
+			if start < lo || start >= hi {
+				continue
+			}
+			words = append(words, w)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) < len(alt.Words) {
+			text := make([]string, len(words))
+			for i, w := range words {
+				text[i] = w.Word
+			}
+			alt.Transcript = strings.Join(text, " ")
+			alt.Words = words
+			result.Alternatives = result.Alternatives[:1]
+		}
+		for _, a := range result.Alternatives {
+			for _, w := range a.Words {
+				w.StartTime = seconds_to_duration(get_seconds_from_duration(w.StartTime) + offset)
+				w.EndTime = seconds_to_duration(get_seconds_from_duration(w.EndTime) + offset)
+			}
+		}
+		result.ResultEndTime = seconds_to_duration(get_seconds_from_duration(result.ResultEndTime) + offset)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Splits a long recording at pauses, transcribes the chunks in parallel from
+// a scratch location and stitches the results into one response. Each chunk
+// is decoded only while it is uploaded. Chunks that fail are left out and
+// reported in the error, so one failure does not lose the whole call.
+func get_chunked_transcript(ctx context.Context, src audioWindows, bucket, name string, adaptation *speechpb.SpeechAdaptation) (error, *speechpb.LongRunningRecognizeResponse) {
+	cuts, err := chunk_cuts(src, chunk_max_secs())
+	if err != nil {
+		return err, nil
+	}
+	bounds := append(append([]float64{0}, cuts...), src.Duration())
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		return err, nil
+	}
+	defer client.Close()
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return err, nil
+	}
+	defer storageClient.Close()
+	parts := make([][]*speechpb.SpeechRecognitionResult, len(bounds)-1)
+	errs := make([]error, len(parts))
+	sem := make(chan struct{}, chunkParallelism)
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			start := math.Max(0, bounds[i]-chunkOverlapSecs)
+			chunk, err := src.window(start, bounds[i+1]+chunkOverlapSecs)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			//LINEAR16 recognition needs 16-bit samples
+			chunk.BitsPerSample = 16
+			chunkBucket, chunkName := artifact_location(bucket, name, fmt.Sprintf(".chunks/%03d.wav", i))
+			object := storageClient.Bucket(chunkBucket).Object(chunkName)
+			w := object.NewWriter(ctx)
+			w.ContentType = "audio/wav"
+			if _, err := w.Write(encode_wav(chunk)); err != nil {
+				w.Close()
+				errs[i] = err
+				return
+			}
+			if err := w.Close(); err != nil {
+				errs[i] = err
+				return
+			}
+			defer object.Delete(ctx)
+			req := &speechpb.LongRunningRecognizeRequest{
+				Config: recognition_config(int32(chunk.SampleRate), int32(len(chunk.Channels)), adaptation),
+				Audio: &speechpb.RecognitionAudio{
+					AudioSource: &speechpb.RecognitionAudio_Uri{Uri: fmt.Sprintf("gs://%s/%s", chunkBucket, chunkName)},
+				},
+			}
+			op, err := client.LongRunningRecognize(ctx, req)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp, err := op.Wait(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			parts[i] = stitch_chunk(resp, start, bounds[i], bounds[i+1])
+		}(i)
+	}
+	wg.Wait()
+	stitched := &speechpb.LongRunningRecognizeResponse{}
+	var failed []string
+	for i, results := range parts {
+		if errs[i] != nil {
+			failed = append(failed, fmt.Sprintf("chunk %d (%.0f-%.0fs): %v", i, bounds[i], bounds[i+1], errs[i]))
+			continue
+		}
+		stitched.Results = append(stitched.Results, results...)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d chunks failed: %s", len(failed), len(parts), strings.Join(failed, "; ")), stitched
+	}
+	return nil, stitched
+}
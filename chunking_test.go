@@ -0,0 +1,135 @@
+package function
+
+import (
+	"math"
+	"testing"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+func TestChunkCuts(t *testing.T) {
+	//Speech everywhere except for a few pauses
+	audio := make_talk_audio(25, AudioSegment{0, 25})
+	for _, pause := range []AudioSegment{{4.5, 5.5}, {10, 10.8}, {11.2, 11.4}, {15, 16}, {19, 20}} {
+		for i := audio.sample_index(pause.StartSecs); i < audio.sample_index(pause.EndSecs); i++ {
+			audio.Channels[0][i] = 0
+		}
+	}
+	cuts, err := chunk_cuts(audio, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{5, 10.4, 15.5, 19.5}
+	if len(cuts) != len(want) {
+		t.Fatalf("got cuts %v, want %v", cuts, want)
+	}
+	prev := 0.0
+	for i := range want {
+		if math.Abs(cuts[i]-want[i]) > 0.1 {
+			t.Errorf("got cut %.2f, want %.2f", cuts[i], want[i])
+		}
+		if cuts[i]-prev+2*chunkOverlapSecs > 10 {
+			t.Errorf("chunk ending at %.2f is longer than 10s", cuts[i])
+		}
+		prev = cuts[i]
+	}
+}
+
+// Counts the seconds of audio decoded through it
+type countingWindows struct {
+	audio   *WavAudio
+	decoded float64
+}
+
+func (c *countingWindows) Duration() float64 {
+	return c.audio.Duration()
+}
+
+func (c *countingWindows) window(startSecs, endSecs float64) (*WavAudio, error) {
+	c.decoded += endSecs - startSecs
+	return c.audio.window(startSecs, endSecs)
+}
+
+func TestChunkCutsDecodesSearchWindows(t *testing.T) {
+	src := &countingWindows{audio: make_talk_audio(400, AudioSegment{0, 400})}
+	cuts, err := chunk_cuts(src, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cuts) == 0 {
+		t.Fatalf("got no cuts for a long recording")
+	}
+	//Only the stretch before each cut that is searched for a pause is decoded
+	if max := float64(len(cuts)) * (chunkSearchSecs + vadFrameSecs); src.decoded > max {
+		t.Errorf("decoded %.1fs to place %d cuts, want at most %.1fs", src.decoded, len(cuts), max)
+	}
+	if src.decoded >= src.audio.Duration() {
+		t.Errorf("decoded %.1fs of a %.1fs recording, want less", src.decoded, src.audio.Duration())
+	}
+}
+
+func TestChunkCutsShortAudio(t *testing.T) {
+	if cuts, _ := chunk_cuts(make_talk_audio(5, AudioSegment{0, 5}), 10); len(cuts) != 0 {
+		t.Errorf("got cuts %v for a short recording, want none", cuts)
+	}
+}
+
+func make_chunk_response(words ...string) *speechpb.LongRunningRecognizeResponse {
+	alt := &speechpb.SpeechRecognitionAlternative{}
+	for i, w := range words {
+		alt.Words = append(alt.Words, &speechpb.WordInfo{
+			Word:      w,
+			StartTime: seconds_to_duration(float64(i)),
+			EndTime:   seconds_to_duration(float64(i) + 0.5),
+		})
+		alt.Transcript += w + " "
+	}
+	return &speechpb.LongRunningRecognizeResponse{Results: []*speechpb.SpeechRecognitionResult{{
+		Alternatives:  []*speechpb.SpeechRecognitionAlternative{alt},
+		ChannelTag:    1,
+		ResultEndTime: seconds_to_duration(float64(len(words))),
+	}}}
+}
+
+func TestStitchChunks(t *testing.T) {
+	//Chunk 0 covers 0-6s with a cut at 4s; chunk 1 starts at 2s
+	first := stitch_chunk(make_chunk_response("a", "b", "c", "d", "e", "f"), 0, 0, 4)
+	second := stitch_chunk(make_chunk_response("c", "d", "e", "f", "g"), 2, 4, math.Inf(1))
+	resp := &speechpb.LongRunningRecognizeResponse{Results: append(first, second...)}
+	record := TranscriptRecord{}
+	if err := parse_transcript(resp, &record); err != nil {
+		t.Fatal(err)
+	}
+	got := ""
+	for _, w := range record.Words {
+		got += w.Word
+	}
+	if got != "abcdefg" {
+		t.Errorf("got words %q, want %q", got, "abcdefg")
+	}
+	if record.Words[4].StartSecs != 4 || record.Duration != 7 {
+		t.Errorf("got word e at %.1f and duration %.1f, want 4 and 7", record.Words[4].StartSecs, record.Duration)
+	}
+	if record.Transcript != "a b c d"+"e f g" {
+		t.Errorf("got transcript %q", record.Transcript)
+	}
+}
+
+func TestStitchChunkAlternatives(t *testing.T) {
+	inside := make_chunk_response("a", "b").Results[0]
+	runnerUp := make_chunk_response("a", "be").Results[0].Alternatives[0]
+	inside.Alternatives = append(inside.Alternatives, runnerUp)
+	straddling := make_chunk_response("c", "d", "e", "f").Results[0]
+	straddling.Alternatives = append(straddling.Alternatives, &speechpb.SpeechRecognitionAlternative{Transcript: "see the e f"})
+	resp := &speechpb.LongRunningRecognizeResponse{Results: []*speechpb.SpeechRecognitionResult{inside, straddling}}
+	results := stitch_chunk(resp, 10, 10, 12)
+	if len(results) != 2 || len(results[0].Alternatives) != 2 || len(results[1].Alternatives) != 1 {
+		t.Fatalf("results = %+v", results)
+	}
+	if got := get_seconds_from_duration(results[0].Alternatives[1].Words[1].StartTime); got != 11 {
+		t.Errorf("runner-up word at %.1f, want 11", got)
+	}
+	if got := results[1].Alternatives[0].Transcript; got != "c d" {
+		t.Errorf("straddling transcript %q", got)
+	}
+}
@@ -0,0 +1,165 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ClipOptions selects the part of a call to export: either a time range, or
+// the given occurrence (1-based, default first) of a phrase in the words,
+// widened by PadSecs on each side. With Redacted the clip is cut from the
+// record's redacted audio instead of the original.
+type ClipOptions struct {
+	StartSecs  float64
+	EndSecs    float64
+	Phrase     string
+	Occurrence int
+	PadSecs    float64
+	Redacted   bool
+}
+
+// Cuts the audio between two times out of a WAV file. The fmt chunk is
+// copied unchanged, so the clip keeps the encoding, rate and channels of the
+// source. Times are clamped to the recording.
+func cut_wav(data []byte, startSecs, endSecs float64) ([]byte, error) {
+	fmtChunk, samples, err := wav_chunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(fmtChunk) < 16 {
+		return nil, fmt.Errorf("fmt chunk too short")
+	}
+	rate := float64(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+	align := int(binary.LittleEndian.Uint16(fmtChunk[12:14]))
+	if rate == 0 || align == 0 {
+		return nil, fmt.Errorf("invalid fmt chunk")
+	}
+	frames := len(samples) / align
+	frame := func(secs float64) int {
+		return int(math.Max(0, math.Min(float64(frames), math.Round(secs*rate))))
+	}
+	start, end := frame(startSecs), frame(endSecs)
+	if end <= start {
+		return nil, fmt.Errorf("empty clip: %.2f-%.2fs of a %.2fs recording", startSecs, endSecs, float64(frames)/rate)
+	}
+	clip := samples[start*align : end*align]
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(4+8+len(fmtChunk)+len(fmtChunk)%2+8+len(clip)+len(clip)%2))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(fmtChunk)))
+	buf.Write(fmtChunk)
+	if len(fmtChunk)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(clip)))
+	buf.Write(clip)
+	if len(clip)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
+
+// Lower-cases a word and drops the punctuation Speech attaches to it
+func normalize_word(word string) string {
+	return strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}))
+}
+
+// Finds every place a speaker says the phrase, in time order. Each
+// speaker's words are searched separately since the channels are
+// interleaved in the word list.
+func find_phrase(record *TranscriptRecord, phrase string) []AudioSegment {
+	var target []string
+	for _, w := range strings.Fields(phrase) {
+		if n := normalize_word(w); n != "" {
+			target = append(target, n)
+		}
+	}
+	if len(target) == 0 {
+		return nil
+	}
+	speakers := map[int][]int{}
+	for i, w := range record.Words {
+		speakers[w.SpeakerTag] = append(speakers[w.SpeakerTag], i)
+	}
+	var matches []AudioSegment
+	for _, words := range speakers {
+		sort.SliceStable(words, func(a, b int) bool { return record.Words[words[a]].StartSecs < record.Words[words[b]].StartSecs })
+		for i := 0; i+len(target) <= len(words); i++ {
+			found := true
+			for j, t := range target {
+				if normalize_word(record.Words[words[i+j]].Word) != t {
+					found = false
+					break
+				}
+			}
+			if found {
+				first, last := record.Words[words[i]], record.Words[words[i+len(target)-1]]
+				matches = append(matches, AudioSegment{StartSecs: first.StartSecs, EndSecs: last.EndSecs})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].StartSecs < matches[j].StartSecs })
+	return matches
+}
+
+// Works out the time range a set of options refers to
+func clip_range(record *TranscriptRecord, opts ClipOptions) (AudioSegment, error) {
+	if opts.Phrase == "" {
+		if opts.EndSecs <= opts.StartSecs {
+			return AudioSegment{}, fmt.Errorf("clip end %.2fs is not after its start %.2fs", opts.EndSecs, opts.StartSecs)
+		}
+		return AudioSegment{StartSecs: opts.StartSecs, EndSecs: opts.EndSecs}, nil
+	}
+	if record == nil {
+		return AudioSegment{}, fmt.Errorf("a transcript record is needed to search for a phrase")
+	}
+	occurrence := opts.Occurrence
+	if occurrence <= 0 {
+		occurrence = 1
+	}
+	matches := find_phrase(record, opts.Phrase)
+	if len(matches) < occurrence {
+		return AudioSegment{}, fmt.Errorf("%q occurs %d times in the transcript", opts.Phrase, len(matches))
+	}
+	m := matches[occurrence-1]
+	return AudioSegment{StartSecs: math.Max(0, m.StartSecs-opts.PadSecs), EndSecs: m.EndSecs + opts.PadSecs}, nil
+}
+
+// Export_clip cuts part of a call's audio as a WAV file and returns it with
+// the time range it covers. source is a gs:// URI or local path; when empty
+// the record's uploaded file is used. With opts.Redacted the record's
+// redacted audio is used and the export fails if the call has none.
+func Export_clip(ctx context.Context, record *TranscriptRecord, source string, opts ClipOptions) ([]byte, AudioSegment, error) {
+	segment, err := clip_range(record, opts)
+	if err != nil {
+		return nil, segment, err
+	}
+	if opts.Redacted {
+		if record == nil || record.Redactedaudio == "" {
+			return nil, segment, fmt.Errorf("no redacted audio for this call")
+		}
+		source = record.Redactedaudio
+	}
+	if source == "" {
+		if record == nil || record.Filename == "" {
+			return nil, segment, fmt.Errorf("no audio source given")
+		}
+		source = "gs://" + record.Filename
+	}
+	data, err := read_location(ctx, source)
+	if err != nil {
+		return nil, segment, err
+	}
+	clip, err := cut_wav(data, segment.StartSecs, segment.EndSecs)
+	return clip, segment, err
+}
@@ -0,0 +1,107 @@
+package function
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCutWav(t *testing.T) {
+	audio := make_test_tone(8000, 2, 3, 440, 0.5)
+	audio.BitsPerSample = 24
+	source := encode_wav(audio)
+	clip, err := cut_wav(source, 1, 1.5)
+	if err != nil {
+		t.Fatalf("cut_wav: %v", err)
+	}
+	sourceFmt, _, _ := wav_chunks(source)
+	clipFmt, _, _ := wav_chunks(clip)
+	if string(sourceFmt) != string(clipFmt) {
+		t.Errorf("fmt chunk changed")
+	}
+	decoded, err := parse_wav(clip)
+	if err != nil {
+		t.Fatalf("parse_wav: %v", err)
+	}
+	if decoded.BitsPerSample != 24 || decoded.SampleRate != 8000 || len(decoded.Channels) != 2 || len(decoded.Channels[0]) != 4000 {
+		t.Fatalf("got %d bits, %d Hz, %d channels of %d samples", decoded.BitsPerSample, decoded.SampleRate, len(decoded.Channels), len(decoded.Channels[0]))
+	}
+	original, _ := parse_wav(source)
+	for i, x := range decoded.Channels[1] {
+		if x != original.Channels[1][8000+i] {
+			t.Fatalf("sample %d = %v, want %v", i, x, original.Channels[1][8000+i])
+		}
+	}
+	//Ranges past the end are clamped
+	clip, err = cut_wav(source, 2.5, 10)
+	if err != nil {
+		t.Fatalf("cut_wav past end: %v", err)
+	}
+	if decoded, _ := parse_wav(clip); len(decoded.Channels[0]) != 4000 {
+		t.Errorf("clamped clip has %d samples, want 4000", len(decoded.Channels[0]))
+	}
+	if _, err := cut_wav(source, 5, 6); err == nil {
+		t.Errorf("expected an error for a clip after the end")
+	}
+}
+
+func TestFindPhrase(t *testing.T) {
+	record := TranscriptRecord{}
+	add_test_word(&record, "I", 1, 1.2, 1)
+	add_test_word(&record, "want", 1.2, 1.5, 1)
+	add_test_word(&record, "to", 1.5, 1.6, 1)
+	add_test_word(&record, "cancel.", 1.6, 2.1, 1)
+	//The agent's channel is interleaved in the word list
+	add_test_word(&record, "Cancel", 1.3, 1.7, 2)
+	add_test_word(&record, "what?", 1.7, 2, 2)
+	add_test_word(&record, "Want", 5, 5.3, 1)
+	add_test_word(&record, "to", 5.3, 5.4, 1)
+	add_test_word(&record, "CANCEL!", 5.4, 6, 1)
+
+	matches := find_phrase(&record, "want to cancel")
+	if len(matches) != 2 || matches[0] != (AudioSegment{StartSecs: 1.2, EndSecs: 2.1}) || matches[1] != (AudioSegment{StartSecs: 5, EndSecs: 6}) {
+		t.Errorf("got %+v", matches)
+	}
+	if matches := find_phrase(&record, "cancel"); len(matches) != 3 || matches[1].StartSecs != 1.6 {
+		t.Errorf("single word: got %+v", matches)
+	}
+
+	segment, err := clip_range(&record, ClipOptions{Phrase: "want to cancel", Occurrence: 2, PadSecs: 1})
+	if err != nil || segment != (AudioSegment{StartSecs: 4, EndSecs: 7}) {
+		t.Errorf("second occurrence: got %+v, %v", segment, err)
+	}
+	segment, err = clip_range(&record, ClipOptions{Phrase: "I want", PadSecs: 2})
+	if err != nil || segment.StartSecs != 0 {
+		t.Errorf("padding before the start: got %+v, %v", segment, err)
+	}
+	if _, err := clip_range(&record, ClipOptions{Phrase: "refund"}); err == nil {
+		t.Errorf("expected an error for a phrase that is not said")
+	}
+}
+
+func TestExportClip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "call.wav")
+	if err := ioutil.WriteFile(path, encode_wav(make_test_tone(8000, 2, 10, 440, 0.5)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	record := &TranscriptRecord{}
+	add_test_word(record, "refund", 4, 4.5, 1)
+	data, segment, err := Export_clip(context.Background(), record, path, ClipOptions{Phrase: "refund", PadSecs: 1})
+	if err != nil {
+		t.Fatalf("Export_clip: %v", err)
+	}
+	if segment != (AudioSegment{StartSecs: 3, EndSecs: 5.5}) {
+		t.Errorf("segment = %+v", segment)
+	}
+	if clip, _ := parse_wav(data); len(clip.Channels[0]) != 20000 {
+		t.Errorf("clip has %d samples, want 20000", len(clip.Channels[0]))
+	}
+	if _, _, err := Export_clip(context.Background(), record, path, ClipOptions{StartSecs: 1, EndSecs: 2, Redacted: true}); err == nil {
+		t.Errorf("expected an error when the call has no redacted audio")
+	}
+	record.Redactedaudio = path
+	if _, _, err := Export_clip(context.Background(), record, "", ClipOptions{StartSecs: 1, EndSecs: 2, Redacted: true}); err != nil {
+		t.Errorf("redacted export: %v", err)
+	}
+}
@@ -4,6 +4,11 @@ import (
 	"log"
 	"os"
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
 
 	// Blank-import the function package so the init() runs
 	spch "example.com/speech_analysis"
@@ -11,6 +16,25 @@ import (
 )
 
 func main() {
+	//Subcommands run locally and exit; otherwise serve the function
+	if len(os.Args) > 1 && os.Args[1] == "clip" {
+		if err := clip(os.Args[2:]); err != nil {
+			log.Fatalf("clip: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "evaluate" {
+		if err := evaluate(os.Args[2:]); err != nil {
+			log.Fatalf("evaluate: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := token(os.Args[2:]); err != nil {
+			log.Fatalf("token: %v\n", err)
+		}
+		return
+	}
 	// Use PORT environment variable, or default to 8080.
 	port := "8080"
 	if envPort := os.Getenv("PORT"); envPort != "" {
@@ -18,8 +42,106 @@ func main() {
 	}
 	
 	funcframework.RegisterEventFunctionContext(context.Background(), "/", spch.Process_transcript) 
+	funcframework.RegisterHTTPFunctionContext(context.Background(), "/stream", spch.Stream_transcript)
+	funcframework.RegisterHTTPFunctionContext(context.Background(), "/alerts", spch.Stream_alerts)
 	
 	if err := funcframework.Start(port); err != nil {
 		log.Fatalf("funcframework.Start: %v\n", err)
 	}
 }
+
+//Exports part of a call as a WAV file, by time range or by phrase
+func clip(args []string) error {
+	fs := flag.NewFlagSet("clip", flag.ExitOnError)
+	recordFile := fs.String("record", "", "transcript record JSON, needed for -phrase and -redacted")
+	audio := fs.String("audio", "", "source audio, gs:// URI or local path (default: the record's file)")
+	start := fs.Float64("start", 0, "clip start in seconds")
+	end := fs.Float64("end", 0, "clip end in seconds")
+	phrase := fs.String("phrase", "", "cut around this phrase instead of a time range")
+	match := fs.Int("match", 1, "which occurrence of the phrase to cut")
+	pad := fs.Float64("pad", 2, "seconds added on each side of the phrase")
+	redacted := fs.Bool("redacted", false, "cut from the record's redacted audio")
+	out := fs.String("out", "clip.wav", "output WAV file")
+	fs.Parse(args)
+
+	var record *spch.TranscriptRecord
+	if *recordFile != "" {
+		data, err := ioutil.ReadFile(*recordFile)
+		if err != nil {
+			return err
+		}
+		record = &spch.TranscriptRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return fmt.Errorf("%s: %v", *recordFile, err)
+		}
+	}
+	opts := spch.ClipOptions{
+		StartSecs:  *start,
+		EndSecs:    *end,
+		Phrase:     *phrase,
+		Occurrence: *match,
+		PadSecs:    *pad,
+		Redacted:   *redacted,
+	}
+	data, segment, err := spch.Export_clip(context.Background(), record, *audio, opts)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %.2f-%.2fs to %s\n", segment.StartSecs, segment.EndSecs, *out)
+	return nil
+}
+
+//Measures the word error rate of a transcriber on a corpus of reference transcripts
+func evaluate(args []string) error {
+	fs := flag.NewFlagSet("evaluate", flag.ExitOnError)
+	dir := fs.String("dir", "", "corpus directory or gs://bucket/prefix holding <name>.txt references with <name>.wav or <name>.json")
+	transcriber := fs.String("transcriber", "", "transcriber to evaluate, or saved to use the <name>.json responses (default: TRANSCRIBER)")
+	tenant := fs.String("tenant", "", "apply this tenant's configuration")
+	out := fs.String("json", "", "also write the report as JSON to this file")
+	fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+
+	report, err := spch.Evaluate_corpus(context.Background(), *dir, spch.EvaluationOptions{Transcriber: *transcriber, Tenant: *tenant})
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Print(spch.Format_evaluation_table(report))
+	for _, f := range report.Files {
+		if f.Error != "" {
+			fmt.Printf("%s: %s\n", f.File, f.Error)
+		}
+	}
+	return nil
+}
+
+//Issues a token for streaming or following a live call, signed with STREAM_TOKEN_SECRET
+func token(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	callid := fs.String("callid", "", "call the token is for, or * to follow every call")
+	valid := fs.Duration("valid", 12*time.Hour, "how long the token is valid")
+	fs.Parse(args)
+	if *callid == "" {
+		return fmt.Errorf("-callid is required")
+	}
+
+	t, err := spch.Stream_token(*callid, time.Now().Add(*valid))
+	if err != nil {
+		return err
+	}
+	fmt.Println(t)
+	return nil
+}
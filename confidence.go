@@ -0,0 +1,156 @@
+package function
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// NbestAlternative is a runner-up hypothesis for one recognition result.
+// Rank 1 is the hypothesis in the transcript and is not stored, so ranks
+// start at 2. Result is the index of the result in the response.
+type NbestAlternative struct {
+	Result     int     `json:"result"`
+	Rank       int     `json:"rank"`
+	SpeakerTag int     `json:"speakertag"`
+	StartSecs  float64 `json:"startSecs"`
+	EndSecs    float64 `json:"endSecs"`
+	Transcript string  `json:"transcript"`
+	Confidence float64 `json:"confidence"`
+}
+
+// LowConfidenceWord is a word the recognizer was unsure of
+type LowConfidenceWord struct {
+	Word       string  `json:"word"`
+	StartSecs  float64 `json:"startSecs"`
+	EndSecs    float64 `json:"endSecs"`
+	SpeakerTag int     `json:"speakertag"`
+	Confidence float64 `json:"confidence"`
+}
+
+// SpeakerConfidence is the average word confidence of one speaker
+type SpeakerConfidence struct {
+	SpeakerTag int     `json:"speakertag"`
+	Words      int     `json:"words"`
+	Confidence float64 `json:"confidence"`
+}
+
+// The Speech API returns at most 30 alternatives per result
+const maxAlternativesLimit = 30
+
+// Defaults for LOW_CONFIDENCE and REVIEW_QUALITY
+const (
+	defaultLowConfidence = 0.6
+	defaultReviewQuality = 0.75
+)
+
+// Number of hypotheses to request per result from MAX_ALTERNATIVES. 0 and 1
+// both keep only the best one.
+func max_alternatives() int32 {
+	n, err := strconv.Atoi(os.Getenv("MAX_ALTERNATIVES"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	if n > maxAlternativesLimit {
+		return maxAlternativesLimit
+	}
+	return int32(n)
+}
+
+// Reads a threshold between 0 and 1 from the environment
+func confidence_threshold(name string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || v < 0 || v > 1 {
+		return def
+	}
+	return v
+}
+
+// Collects the runner-up hypotheses of every result
+func nbest_alternatives(transcript *speechpb.LongRunningRecognizeResponse) []NbestAlternative {
+	var alternatives []NbestAlternative
+	start := 0.0
+	for i, result := range transcript.GetResults() {
+		end := get_seconds_from_duration(result.ResultEndTime)
+		//A result starts at its first word, or where the previous one ended
+		if len(result.Alternatives) > 0 && len(result.Alternatives[0].Words) > 0 {
+			start = get_seconds_from_duration(result.Alternatives[0].Words[0].StartTime)
+		}
+		for rank := 1; rank < len(result.Alternatives); rank++ {
+			alt := result.Alternatives[rank]
+			alternatives = append(alternatives, NbestAlternative{
+				Result:     i,
+				Rank:       rank + 1,
+				SpeakerTag: int(result.ChannelTag),
+				StartSecs:  start,
+				EndSecs:    end,
+				Transcript: alt.Transcript,
+				Confidence: float64(alt.Confidence),
+			})
+		}
+		start = end
+	}
+	return alternatives
+}
+
+// Lists the words below LOW_CONFIDENCE, averages the confidence of each
+// speaker and scores the transcript. The score is the mean word confidence,
+// weighted by word length in time, reduced by the share of low-confidence
+// words; calls scoring below REVIEW_QUALITY are marked for human review.
+// Words without a confidence are left out, and a transcript without any
+// scores 0 but is not marked. Run after redaction so the list holds the
+// redacted words.
+func analyze_confidence(record *TranscriptRecord) {
+	low := confidence_threshold("LOW_CONFIDENCE", defaultLowConfidence)
+	record.Lowconfidence = nil
+	record.Speakerconfidence = nil
+	record.Transcriptquality = 0
+	record.Needsreview = false
+	var weighted, weights float64
+	scored, lowCount := 0, 0
+	speakers := map[int]int{}
+	for _, word := range record.Words {
+		if word.Confidence <= 0 {
+			continue
+		}
+		scored++
+		if word.Confidence < low {
+			lowCount++
+			record.Lowconfidence = append(record.Lowconfidence, LowConfidenceWord{
+				Word:       word.Word,
+				StartSecs:  word.StartSecs,
+				EndSecs:    word.EndSecs,
+				SpeakerTag: word.SpeakerTag,
+				Confidence: word.Confidence,
+			})
+		}
+		weight := word.EndSecs - word.StartSecs
+		if weight <= 0 {
+			//Words without timings count as a tenth of a second
+			weight = 0.1
+		}
+		weighted += word.Confidence * weight
+		weights += weight
+		i, ok := speakers[word.SpeakerTag]
+		if !ok {
+			i = len(record.Speakerconfidence)
+			speakers[word.SpeakerTag] = i
+			record.Speakerconfidence = append(record.Speakerconfidence, SpeakerConfidence{SpeakerTag: word.SpeakerTag})
+		}
+		record.Speakerconfidence[i].Words++
+		record.Speakerconfidence[i].Confidence += word.Confidence
+	}
+	if scored == 0 {
+		return
+	}
+	for i := range record.Speakerconfidence {
+		record.Speakerconfidence[i].Confidence /= float64(record.Speakerconfidence[i].Words)
+	}
+	sort.Slice(record.Speakerconfidence, func(i, j int) bool {
+		return record.Speakerconfidence[i].SpeakerTag < record.Speakerconfidence[j].SpeakerTag
+	})
+	record.Transcriptquality = weighted / weights * (1 - float64(lowCount)/float64(scored))
+	record.Needsreview = record.Transcriptquality < confidence_threshold("REVIEW_QUALITY", defaultReviewQuality)
+}
@@ -0,0 +1,109 @@
+package function
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+func TestMaxAlternatives(t *testing.T) {
+	for value, want := range map[string]int32{"": 0, "3": 3, "-2": 0, "100": maxAlternativesLimit, "many": 0} {
+		t.Setenv("MAX_ALTERNATIVES", value)
+		if got := max_alternatives(); got != want {
+			t.Errorf("MAX_ALTERNATIVES=%q gave %d, want %d", value, got, want)
+		}
+	}
+	t.Setenv("MAX_ALTERNATIVES", "4")
+	if config := recognition_config(8000, 2, nil); config.MaxAlternatives != 4 {
+		t.Errorf("recognition config requests %d alternatives", config.MaxAlternatives)
+	}
+}
+
+func TestNbestAlternatives(t *testing.T) {
+	resp := &speechpb.LongRunningRecognizeResponse{Results: []*speechpb.SpeechRecognitionResult{
+		{ChannelTag: 1, ResultEndTime: seconds_to_duration(2), Alternatives: []*speechpb.SpeechRecognitionAlternative{
+			{Transcript: "I'd like roses", Confidence: 0.8, Words: []*speechpb.WordInfo{{Word: "I'd", StartTime: seconds_to_duration(0.5), EndTime: seconds_to_duration(0.8), Confidence: 0.8}}},
+			{Transcript: "I'd like Rose's", Confidence: 0.6},
+			{Transcript: "I like roses", Confidence: 0.5},
+		}},
+		{ChannelTag: 2, ResultEndTime: seconds_to_duration(4), Alternatives: []*speechpb.SpeechRecognitionAlternative{
+			{Transcript: " Sure.", Confidence: 0.95},
+		}},
+		{ChannelTag: 1, ResultEndTime: seconds_to_duration(6), Alternatives: []*speechpb.SpeechRecognitionAlternative{
+			{Transcript: " Thanks.", Confidence: 0.7},
+			{Transcript: " Banks.", Confidence: 0.2},
+		}},
+	}}
+	alternatives := nbest_alternatives(resp)
+	if len(alternatives) != 3 {
+		t.Fatalf("got %d alternatives, want 3", len(alternatives))
+	}
+	if a := alternatives[0]; a.Result != 0 || a.Rank != 2 || a.StartSecs != 0.5 || a.EndSecs != 2 || a.Transcript != "I'd like Rose's" || a.SpeakerTag != 1 {
+		t.Errorf("first alternative = %+v", a)
+	}
+	if a := alternatives[2]; a.Result != 2 || a.Rank != 2 || a.StartSecs != 4 || a.EndSecs != 6 {
+		t.Errorf("last alternative = %+v", a)
+	}
+
+	//Runner-up hypotheses are redacted along with the transcript
+	record := TranscriptRecord{Alternatives: []NbestAlternative{{Transcript: "my number is 409-866-5088"}}}
+	if err := redact_record(context.Background(), []Redactor{&localRedactor{}}, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Alternatives[0].Transcript != "my number is ************" {
+		t.Errorf("alternative not redacted: %q", record.Alternatives[0].Transcript)
+	}
+	//Including a number read out digit by digit
+	record = TranscriptRecord{Alternatives: []NbestAlternative{{Transcript: "call me on four zero nine eight six six five zero eight eight"}}}
+	if err := redact_record(context.Background(), []Redactor{&localRedactor{}}, &record); err != nil {
+		t.Fatal(err)
+	}
+	if alt := record.Alternatives[0].Transcript; !strings.HasPrefix(alt, "call me on ****") || strings.Contains(alt, "eight") {
+		t.Errorf("spoken number in alternative not redacted: %q", alt)
+	}
+	if len(record.Redactions) != 1 || record.Redactions[0].Infotype != "PHONE_NUMBER" {
+		t.Errorf("redactions = %+v", record.Redactions)
+	}
+}
+
+func TestAnalyzeConfidence(t *testing.T) {
+	t.Setenv("LOW_CONFIDENCE", "")
+	t.Setenv("REVIEW_QUALITY", "")
+	record := TranscriptRecord{}
+	for i, c := range []float64{0.9, 0.9, 0.3, 0.8} {
+		add_test_word(&record, "word", float64(i), float64(i)+1, 1+i%2)
+		record.Words[i].Confidence = c
+	}
+	//A word without a confidence is left out
+	add_test_word(&record, "unscored", 4, 5, 2)
+	record.Words[4].Confidence = 0
+	analyze_confidence(&record)
+	if len(record.Lowconfidence) != 1 || record.Lowconfidence[0].StartSecs != 2 || record.Lowconfidence[0].SpeakerTag != 1 {
+		t.Errorf("low confidence words = %+v", record.Lowconfidence)
+	}
+	if len(record.Speakerconfidence) != 2 || record.Speakerconfidence[0].SpeakerTag != 1 || record.Speakerconfidence[0].Words != 2 ||
+		math.Abs(record.Speakerconfidence[0].Confidence-0.6) > 1e-9 || math.Abs(record.Speakerconfidence[1].Confidence-0.85) > 1e-9 {
+		t.Errorf("speaker confidence = %+v", record.Speakerconfidence)
+	}
+	//Mean 0.725, with a quarter of the words below the threshold
+	if math.Abs(record.Transcriptquality-0.725*0.75) > 1e-9 || !record.Needsreview {
+		t.Errorf("quality = %v, review %v", record.Transcriptquality, record.Needsreview)
+	}
+
+	t.Setenv("REVIEW_QUALITY", "0.5")
+	analyze_confidence(&record)
+	if record.Needsreview {
+		t.Errorf("quality %v should pass a 0.5 threshold", record.Transcriptquality)
+	}
+
+	unscored := TranscriptRecord{}
+	add_test_word(&unscored, "hello", 0, 1, 1)
+	unscored.Words[0].Confidence = 0
+	analyze_confidence(&unscored)
+	if unscored.Transcriptquality != 0 || unscored.Needsreview || unscored.Speakerconfidence != nil {
+		t.Errorf("transcript without confidences = %v, review %v", unscored.Transcriptquality, unscored.Needsreview)
+	}
+}
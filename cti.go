@@ -0,0 +1,289 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// CallMetadata holds what the contact center platform (CTI) knows about a
+// call, from a sidecar file uploaded next to the recording or from the
+// upload's object metadata
+type CallMetadata struct {
+	Agentid       string `json:"agentid"`
+	Agentname     string `json:"agentname"`
+	Queue         string `json:"queue"`
+	Ani           string `json:"ani"`
+	Dnis          string `json:"dnis"`
+	Direction     string `json:"direction"`
+	Crmcustomerid string `json:"crmcustomerid"`
+	Crmcaseid     string `json:"crmcaseid"`
+	//Sidecar object the values came from, empty when only object metadata was used
+	Source string `json:"source"`
+}
+
+// Names CTI exports use for each field, lower case without separators
+var ctiAliases = map[string]string{
+	"callid": "callid", "uniqueid": "callid", "interactionid": "callid", "contactid": "callid",
+	"agentid": "agentid", "agent": "agentid", "agentlogin": "agentid", "userid": "agentid",
+	"agentname": "agentname",
+	"queue":     "queue", "queuename": "queue", "skill": "queue", "split": "queue", "huntgroup": "queue",
+	"ani": "ani", "callernumber": "ani", "callingnumber": "ani", "from": "ani", "callerid": "ani",
+	"dnis": "dnis", "callednumber": "dnis", "dialednumber": "dnis", "to": "dnis",
+	"direction": "direction", "calldirection": "direction",
+	"crmcustomerid": "crmcustomerid", "customerid": "crmcustomerid", "accountid": "crmcustomerid", "crmid": "crmcustomerid",
+	"crmcaseid": "crmcaseid", "caseid": "crmcaseid", "ticketid": "crmcaseid",
+	"starttime": "starttime", "callstart": "starttime", "startdate": "starttime", "callstarttime": "starttime",
+	"timezone": "timezone", "tz": "timezone", "sitetimezone": "timezone",
+	"tenant": "tenant", "dlp": "dlp", "transcriber": "transcriber",
+}
+
+// Returns the canonical name of a sidecar or metadata key, or "" when it
+// is not one the pipeline reads
+func cti_field(key string) string {
+	key = strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || r == ' ' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(key)))
+	return ctiAliases[key]
+}
+
+// Extensions tried for the sidecar of <name>.wav, in order
+func sidecar_suffixes() []string {
+	suffixes := os.Getenv("SIDECAR_SUFFIXES")
+	if suffixes == "" {
+		return []string{".json", ".csv"}
+	}
+	var list []string
+	for _, s := range strings.Split(suffixes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Reports whether an upload is a sidecar rather than a recording
+func is_sidecar(name string) bool {
+	for _, suffix := range sidecar_suffixes() {
+		if strings.HasSuffix(strings.ToLower(name), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// How long to wait for a sidecar that has not arrived yet. SIDECAR_WAIT is
+// in seconds; by default a missing sidecar is not waited for, so uploads
+// without one are not held up.
+func sidecar_wait() time.Duration {
+	secs, err := strconv.ParseFloat(os.Getenv("SIDECAR_WAIT"), 64)
+	if err != nil || secs < 0 {
+		secs = 0
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+func is_not_found(err error) bool {
+	return errors.Is(err, storage.ErrObjectNotExist) || os.IsNotExist(err)
+}
+
+// Looks for the sidecar of a recording with each suffix, polling every
+// interval until wait has passed. Returns "" when there is none.
+func find_sidecar(ctx context.Context, name string, read func(string) ([]byte, error), wait, interval time.Duration) (string, []byte, error) {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	deadline := time.Now().Add(wait)
+	for {
+		for _, suffix := range sidecar_suffixes() {
+			data, err := read(base + suffix)
+			if err == nil {
+				return base + suffix, data, nil
+			}
+			if !is_not_found(err) {
+				return base + suffix, nil, err
+			}
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			return "", nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Reads the values of a JSON or CSV sidecar. A JSON sidecar is one flat
+// object. A CSV sidecar has a header row and a row per call; with several
+// rows, the one for callid is used.
+func parse_sidecar(name string, data []byte, callid string) (map[string]string, error) {
+	values := map[string]string{}
+	if strings.EqualFold(path.Ext(name), ".csv") {
+		rows, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) < 2 {
+			return nil, fmt.Errorf("%s has no data rows", name)
+		}
+		row := rows[1]
+		if len(rows) > 2 {
+			row = nil
+			for _, r := range rows[1:] {
+				for i, key := range rows[0] {
+					if i < len(r) && cti_field(key) == "callid" && r[i] == callid && callid != "" {
+						row = r
+					}
+				}
+			}
+			if row == nil {
+				return nil, fmt.Errorf("%s has no row for callid %q", name, callid)
+			}
+		}
+		for i, key := range rows[0] {
+			if i < len(row) {
+				values[strings.TrimSpace(key)] = strings.TrimSpace(row[i])
+			}
+		}
+		return values, nil
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for key, v := range fields {
+		switch v := v.(type) {
+		case string:
+			values[key] = strings.TrimSpace(v)
+		case json.Number, bool:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+var phoneSeparators = regexp.MustCompile(`[\s().\-]`)
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{3,15}$`)
+
+// Strips separators from a phone number and checks it is E.164-like
+func clean_phone_number(number string) (string, bool) {
+	n := phoneSeparators.ReplaceAllString(strings.TrimPrefix(strings.ToLower(number), "tel:"), "")
+	return n, phonePattern.MatchString(n)
+}
+
+// Validates the values and fills in the record's CallMetadata and call id.
+// A start time is kept, with source naming where it came from, for
+// set_call_time. Recognized values are also added to the record's metadata
+// so that e.g. the tenant or dlp can come from the sidecar. Returns a
+// description of each value that was rejected.
+func apply_call_metadata(record *TranscriptRecord, values map[string]string, source string) []string {
+	var issues []string
+	if record.metadata == nil {
+		record.metadata = map[string]string{}
+	}
+	m := &record.Callmetadata
+	for key, value := range values {
+		field := cti_field(key)
+		if field == "" || value == "" {
+			continue
+		}
+		switch field {
+		case "callid":
+			if record.Callid == "" {
+				record.Callid = value
+			} else if record.Callid != value {
+				issues = append(issues, fmt.Sprintf("callid %q does not match the upload's %q", value, record.Callid))
+				continue
+			}
+		case "agentid":
+			m.Agentid = value
+		case "agentname":
+			m.Agentname = value
+		case "queue":
+			m.Queue = value
+		case "ani", "dnis":
+			number, ok := clean_phone_number(value)
+			if !ok {
+				issues = append(issues, fmt.Sprintf("%s %q is not a phone number", field, value))
+				continue
+			}
+			if field == "ani" {
+				m.Ani = number
+			} else {
+				m.Dnis = number
+			}
+		case "direction":
+			direction := strings.ToLower(value)
+			if direction != "inbound" && direction != "outbound" && direction != "internal" {
+				issues = append(issues, fmt.Sprintf("direction %q is not inbound, outbound or internal", value))
+				continue
+			}
+			m.Direction = direction
+		case "crmcustomerid":
+			m.Crmcustomerid = value
+		case "crmcaseid":
+			m.Crmcaseid = value
+		case "starttime":
+			if _, err := parse_call_time(value, time.UTC); err != nil {
+				issues = append(issues, err.Error())
+				continue
+			}
+			record.callStart, record.callStartSource = value, source
+		case "timezone":
+			if _, err := time.LoadLocation(value); err != nil {
+				issues = append(issues, fmt.Sprintf("unknown timezone %q", value))
+				continue
+			}
+		case "tenant":
+			record.Tenant = value
+		case "dlp":
+			record.Dlp = value
+		}
+		record.metadata[field] = value
+	}
+	return issues
+}
+
+// Fills in the call metadata of an upload, first from its object metadata
+// and then from the sidecar, which wins where both have a value. A missing
+// sidecar is waited for up to SIDECAR_WAIT seconds.
+func load_call_metadata(ctx context.Context, bucket, name string, record *TranscriptRecord) error {
+	objectMetadata := map[string]string{}
+	for k, v := range record.metadata {
+		objectMetadata[k] = v
+	}
+	record.Metadataissues = append(record.Metadataissues, apply_call_metadata(record, objectMetadata, startMetadata)...)
+	read := func(object string) ([]byte, error) {
+		return read_gcs_object(ctx, bucket, object)
+	}
+	sidecar, data, err := find_sidecar(ctx, name, read, sidecar_wait(), 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("reading sidecar %s: %v", sidecar, err)
+	}
+	if sidecar == "" {
+		return nil
+	}
+	values, err := parse_sidecar(sidecar, data, record.Callid)
+	if err != nil {
+		return err
+	}
+	record.Callmetadata.Source = fmt.Sprintf("%s/%s", bucket, sidecar)
+	record.Metadataissues = append(record.Metadataissues, apply_call_metadata(record, values, startSidecar)...)
+	return nil
+}
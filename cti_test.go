@@ -0,0 +1,92 @@
+package function
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSidecar(t *testing.T) {
+	values, err := parse_sidecar("calls/a.json", []byte(`{"agent_id": "A-17", "ANI": "+1 (409) 866-5088", "duration": 312, "tags": ["vip"]}`), "")
+	if err != nil || values["agent_id"] != "A-17" || values["ANI"] != "+1 (409) 866-5088" || values["duration"] != "312" || values["tags"] != "" {
+		t.Errorf("JSON sidecar gave %v, %v", values, err)
+	}
+	csv := "\xef\xbb\xbfCall ID,Agent,Queue\nc-1,A-17,billing\nc-2,A-20,sales\n"
+	values, err = parse_sidecar("calls/a.csv", []byte(csv), "c-2")
+	if err != nil || values["Agent"] != "A-20" || values["Queue"] != "sales" {
+		t.Errorf("CSV sidecar gave %v, %v", values, err)
+	}
+	if _, err := parse_sidecar("calls/a.csv", []byte(csv), "c-3"); err == nil {
+		t.Errorf("expected an error for a CSV without the call's row")
+	}
+	if _, err := parse_sidecar("calls/a.json", []byte(`[1, 2]`), ""); err == nil {
+		t.Errorf("expected an error for a JSON sidecar that is not an object")
+	}
+}
+
+func TestApplyCallMetadata(t *testing.T) {
+	record := &TranscriptRecord{Callid: "c-1"}
+	issues := apply_call_metadata(record, map[string]string{
+		"call_id":       "c-1",
+		"AgentID":       "A-17",
+		"agent name":    "Dana",
+		"skill":         "billing",
+		"callingNumber": "+1 (409) 866-5088",
+		"dnis":          "ext. 12",
+		"direction":     "Inbound",
+		"customer_id":   "CUST-9",
+		"caseId":        "CASE-3",
+		"start_time":    "2024-03-05T14:30:00-05:00",
+		"tz":            "Mars/Olympus",
+		"tenant":        "florist",
+		"wrapup":        "sale",
+	}, startSidecar)
+	m := record.Callmetadata
+	if m.Agentid != "A-17" || m.Agentname != "Dana" || m.Queue != "billing" || m.Ani != "+14098665088" || m.Direction != "inbound" || m.Crmcustomerid != "CUST-9" || m.Crmcaseid != "CASE-3" {
+		t.Errorf("call metadata = %+v", m)
+	}
+	if record.callStart != "2024-03-05T14:30:00-05:00" || record.callStartSource != startSidecar {
+		t.Errorf("start = %q from %q", record.callStart, record.callStartSource)
+	}
+	if record.Tenant != "florist" || record.metadata["tenant"] != "florist" {
+		t.Errorf("tenant not taken from the sidecar")
+	}
+	if len(issues) != 2 || m.Dnis != "" || record.metadata["timezone"] != "" {
+		t.Errorf("issues = %v", issues)
+	}
+	issues = apply_call_metadata(record, map[string]string{"callid": "c-2", "direction": "sideways", "call_start": "soon"}, startMetadata)
+	if len(issues) != 3 || record.Callid != "c-1" {
+		t.Errorf("issues = %v", issues)
+	}
+}
+
+func TestFindSidecar(t *testing.T) {
+	reads := 0
+	read := func(name string) ([]byte, error) {
+		reads++
+		//The CSV arrives on the third poll
+		if name == "calls/a.csv" && reads > 4 {
+			return []byte("agent\nA-17\n"), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	name, data, err := find_sidecar(context.Background(), "calls/a.wav", read, time.Second, time.Millisecond)
+	if err != nil || name != "calls/a.csv" || string(data) != "agent\nA-17\n" {
+		t.Errorf("got %q, %q, %v", name, data, err)
+	}
+	name, _, err = find_sidecar(context.Background(), "calls/b.wav", func(string) ([]byte, error) { return nil, os.ErrNotExist }, 0, time.Millisecond)
+	if err != nil || name != "" {
+		t.Errorf("missing sidecar gave %q, %v", name, err)
+	}
+	if sidecar_wait() != 0 {
+		t.Errorf("sidecar_wait() = %v without SIDECAR_WAIT, want 0", sidecar_wait())
+	}
+	t.Setenv("SIDECAR_WAIT", "2.5")
+	if sidecar_wait() != 2500*time.Millisecond {
+		t.Errorf("sidecar_wait() = %v, want 2.5s", sidecar_wait())
+	}
+	if !is_sidecar("calls/a.JSON") || is_sidecar("calls/a.wav") {
+		t.Errorf("is_sidecar")
+	}
+}
@@ -0,0 +1,154 @@
+package function
+
+import (
+	"math"
+	"os"
+)
+
+// DtmfEvent is a keypad press detected in the audio. Digit is left empty in
+// PCI mode so card numbers keyed by the caller are never stored.
+type DtmfEvent struct {
+	StartSecs float64 `json:"startSecs"`
+	EndSecs   float64 `json:"endSecs"`
+	Channel   int     `json:"channel"`
+	Digit     string  `json:"digit"`
+}
+
+var dtmfLowHz = []float64{697, 770, 852, 941}
+var dtmfHighHz = []float64{1209, 1336, 1477, 1633}
+
+var dtmfKeys = [4][4]string{
+	{"1", "2", "3", "A"},
+	{"4", "5", "6", "B"},
+	{"7", "8", "9", "C"},
+	{"*", "0", "#", "D"},
+}
+
+const (
+	//Analysis block length, long enough to tell 697 Hz from 770 Hz
+	dtmfBlockSecs = 0.02
+	//Blocks start every hop, so they overlap by half. ITU Q.24 tones last
+	//at least 40ms, so wherever a press starts it covers two full blocks.
+	dtmfHopSecs = 0.01
+	//Consecutive blocks needed before a key counts as pressed
+	dtmfMinBlocks = 2
+	//Share of the block's energy that must sit in the two tones
+	dtmfMinToneRatio = 0.7
+	//The strongest tone in a group must exceed the others by this factor
+	dtmfMinPeakRatio = 4.0
+	//Allowed level difference between the low and high tone (about 8 dB)
+	dtmfMaxTwist = 6.3
+	//Blocks quieter than this RMS level are skipped
+	dtmfMinRMS = 0.005
+	//Padding added around keypresses when they are masked
+	dtmfPadSecs = 0.05
+)
+
+// Reports whether PCI_MODE is set, which keeps keyed digits out of records
+func pci_mode() bool {
+	return os.Getenv("PCI_MODE") == "true"
+}
+
+// Power of a single frequency over the block, using the Goertzel algorithm
+func goertzel_power(samples []float32, hz float64, rate int) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*hz/float64(rate))
+	var s1, s2 float64
+	for _, x := range samples {
+		s0 := float64(x) + coeff*s1 - s2
+		s2 = s1
+		s1 = s0
+	}
+	return s1*s1 + s2*s2 - coeff*s1*s2
+}
+
+// Returns the index of the strongest frequency in the group, or -1 if no
+// frequency stands out clearly from the others.
+func strongest_tone(samples []float32, freqs []float64, rate int) (int, float64) {
+	best, power := -1, 0.0
+	powers := make([]float64, len(freqs))
+	for i, hz := range freqs {
+		powers[i] = goertzel_power(samples, hz, rate)
+		if powers[i] > power {
+			best, power = i, powers[i]
+		}
+	}
+	for i, p := range powers {
+		if i != best && p*dtmfMinPeakRatio > power {
+			return -1, 0
+		}
+	}
+	return best, power
+}
+
+// Decodes the key pressed in one block, or "" if the block is not a DTMF tone
+func dtmf_block_digit(samples []float32, rate int) string {
+	energy := 0.0
+	for _, x := range samples {
+		energy += float64(x) * float64(x)
+	}
+	if math.Sqrt(energy/float64(len(samples))) < dtmfMinRMS {
+		return ""
+	}
+	low, lowPower := strongest_tone(samples, dtmfLowHz, rate)
+	high, highPower := strongest_tone(samples, dtmfHighHz, rate)
+	if low < 0 || high < 0 {
+		return ""
+	}
+	if highPower > lowPower*dtmfMaxTwist || lowPower > highPower*dtmfMaxTwist {
+		return ""
+	}
+	//A pure tone of amplitude A gives a Goertzel power of (A*N/2)^2 and an
+	//energy of A^2*N/2, so this ratio is close to 1 for a clean key press.
+	n := float64(len(samples))
+	if (lowPower+highPower)/(energy*n/2) < dtmfMinToneRatio {
+		return ""
+	}
+	return dtmfKeys[low][high]
+}
+
+// Scans every channel for keypad tones
+func detect_dtmf(audio *WavAudio, pci bool) []DtmfEvent {
+	var events []DtmfEvent
+	block := int(dtmfBlockSecs * float64(audio.SampleRate))
+	hop := int(dtmfHopSecs * float64(audio.SampleRate))
+	if block == 0 || hop == 0 {
+		return nil
+	}
+	for c, samples := range audio.Channels {
+		current, run, start, last := "", 0, 0, 0
+		flush := func() {
+			if current != "" && run >= dtmfMinBlocks {
+				event := DtmfEvent{
+					StartSecs: float64(start) / float64(audio.SampleRate),
+					EndSecs:   float64(last+block) / float64(audio.SampleRate),
+					Channel:   c + 1,
+				}
+				if !pci {
+					event.Digit = current
+				}
+				events = append(events, event)
+			}
+		}
+		for i := 0; i+block <= len(samples); i += hop {
+			digit := dtmf_block_digit(samples[i:i+block], audio.SampleRate)
+			if digit == current {
+				run++
+				last = i
+				continue
+			}
+			flush()
+			current, run, start, last = digit, 1, i, i
+		}
+		flush()
+	}
+	return events
+}
+
+// Time ranges of the keypresses, padded for masking
+func dtmf_segments(events []DtmfEvent) []AudioSegment {
+	var segments []AudioSegment
+	for _, e := range events {
+		segments = append(segments, AudioSegment{StartSecs: e.StartSecs, EndSecs: e.EndSecs})
+	}
+	return merge_segments(segments, dtmfPadSecs)
+}
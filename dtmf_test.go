@@ -0,0 +1,98 @@
+package function
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Builds one channel of 8 kHz audio keying the digits, 100ms per tone with
+// 100ms gaps of low noise between them.
+func make_dtmf_audio(digits string) *WavAudio {
+	rate := 8000
+	rng := rand.New(rand.NewSource(1))
+	var samples []float32
+	for _, d := range digits {
+		for i := 0; i < rate/10; i++ {
+			samples = append(samples, float32(rng.NormFloat64()*0.001))
+		}
+		low, high := 0.0, 0.0
+		for r, row := range dtmfKeys {
+			for c, key := range row {
+				if key == string(d) {
+					low, high = dtmfLowHz[r], dtmfHighHz[c]
+				}
+			}
+		}
+		for i := 0; i < rate/10; i++ {
+			t := float64(i) / float64(rate)
+			samples = append(samples, float32(0.3*math.Sin(2*math.Pi*low*t)+0.3*math.Sin(2*math.Pi*high*t)))
+		}
+	}
+	return &WavAudio{SampleRate: rate, BitsPerSample: 16, Channels: [][]float32{samples}}
+}
+
+func TestDetectDtmf(t *testing.T) {
+	events := detect_dtmf(make_dtmf_audio("4111#"), false)
+	got := ""
+	for _, e := range events {
+		got += e.Digit
+		if e.Channel != 1 {
+			t.Errorf("got channel %d, want 1", e.Channel)
+		}
+	}
+	if got != "4111#" {
+		t.Fatalf("got digits %q, want %q", got, "4111#")
+	}
+	if math.Abs(events[0].StartSecs-0.1) > 0.03 || math.Abs(events[0].EndSecs-0.2) > 0.03 {
+		t.Errorf("got first press %v-%v, want about 0.1-0.2", events[0].StartSecs, events[0].EndSecs)
+	}
+}
+
+func TestDetectDtmfShortTone(t *testing.T) {
+	//A 40ms press, the shortest ITU Q.24 allows, at offsets across a block
+	rate := 8000
+	for offset := 0; offset < 160; offset += 20 {
+		samples := make([]float32, 800)
+		for i := 0; i < rate/25; i++ {
+			t := float64(i) / float64(rate)
+			samples[200+offset+i] = float32(0.3*math.Sin(2*math.Pi*dtmfLowHz[1]*t) + 0.3*math.Sin(2*math.Pi*dtmfHighHz[1]*t))
+		}
+		events := detect_dtmf(&WavAudio{SampleRate: rate, BitsPerSample: 16, Channels: [][]float32{samples}}, false)
+		if len(events) != 1 || events[0].Digit != "5" {
+			t.Errorf("offset %d: got %+v, want one 5", offset, events)
+		}
+	}
+}
+
+func TestDetectDtmfPCIMode(t *testing.T) {
+	events := detect_dtmf(make_dtmf_audio("42"), true)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	for _, e := range events {
+		if e.Digit != "" {
+			t.Errorf("digit %q stored in PCI mode", e.Digit)
+		}
+	}
+}
+
+func TestDetectDtmfIgnoresSingleTones(t *testing.T) {
+	audio := make_test_tone(8000, 2, 1, 697, 0.5)
+	if events := detect_dtmf(audio, false); len(events) != 0 {
+		t.Errorf("got %d events from a single tone, want 0", len(events))
+	}
+	audio = make_test_tone(8000, 1, 1, 440, 0.5)
+	if events := detect_dtmf(audio, false); len(events) != 0 {
+		t.Errorf("got %d events from a dial tone, want 0", len(events))
+	}
+	rng := rand.New(rand.NewSource(2))
+	noise := make([]float32, 8000)
+	for i := range noise {
+		noise[i] = float32(rng.NormFloat64() * 0.2)
+	}
+	audio = &WavAudio{SampleRate: 8000, BitsPerSample: 16, Channels: [][]float32{noise}}
+	if events := detect_dtmf(audio, false); len(events) != 0 {
+		t.Errorf("got %d events from noise, want 0", len(events))
+	}
+}
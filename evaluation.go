@@ -0,0 +1,306 @@
+package function
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// ErrorCounts is the word error rate of a hypothesis against a reference:
+// (substitutions + deletions + insertions) / reference words
+type ErrorCounts struct {
+	Reference     int     `json:"reference"`
+	Substitutions int     `json:"substitutions"`
+	Deletions     int     `json:"deletions"`
+	Insertions    int     `json:"insertions"`
+	Wer           float64 `json:"wer"`
+}
+
+// SpeakerEvaluation is the word error rate of one speaker
+type SpeakerEvaluation struct {
+	SpeakerTag int `json:"speakertag"`
+	ErrorCounts
+}
+
+// FileEvaluation is the result for one recording of the corpus. Speakers
+// is only filled in when the reference labels its lines with speakers.
+type FileEvaluation struct {
+	File string `json:"file"`
+	ErrorCounts
+	Speakers []SpeakerEvaluation `json:"speakers,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// EvaluationReport sums the results of a corpus
+type EvaluationReport struct {
+	Transcriber string              `json:"transcriber"`
+	Files       []FileEvaluation    `json:"files"`
+	Total       ErrorCounts         `json:"total"`
+	Speakers    []SpeakerEvaluation `json:"speakers,omitempty"`
+}
+
+// EvaluationOptions selects the recognition to evaluate. Transcriber is a
+// backend as accepted by get_transcriber, or "saved" to read the saved
+// Speech response <name>.json of each reference instead. Tenant applies
+// that tenant's configuration.
+type EvaluationOptions struct {
+	Transcriber string
+	Tenant      string
+}
+
+// Speaker labels at the start of a reference line, e.g. "1:" or "Speaker 2:"
+var referenceSpeaker = regexp.MustCompile(`(?i)^\s*(?:speaker\s*)?(\d+)\s*:\s*`)
+
+type referenceWord struct {
+	word    string
+	speaker int
+}
+
+// Reads a reference transcript. Lines may start with the speaker's channel
+// number; unlabelled lines belong to speaker 0. Words are compared
+// lower-cased and without punctuation.
+func parse_reference(data []byte) []referenceWord {
+	var words []referenceWord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		speaker := 0
+		if m := referenceSpeaker.FindStringSubmatch(line); m != nil {
+			speaker, _ = strconv.Atoi(m[1])
+			line = line[len(m[0]):]
+		}
+		for _, w := range strings.Fields(line) {
+			if n := normalize_word(w); n != "" {
+				words = append(words, referenceWord{n, speaker})
+			}
+		}
+	}
+	return words
+}
+
+// Aligns a hypothesis with a reference by edit distance and counts the
+// errors. Substitutions are preferred over a deletion and insertion pair.
+func word_errors(reference, hypothesis []string) ErrorCounts {
+	n, m := len(reference), len(hypothesis)
+	cost := make([][]int, n+1)
+	for i := range cost {
+		cost[i] = make([]int, m+1)
+		cost[i][0] = i
+	}
+	for j := 0; j <= m; j++ {
+		cost[0][j] = j
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			sub := cost[i-1][j-1]
+			if reference[i-1] != hypothesis[j-1] {
+				sub++
+			}
+			cost[i][j] = sub
+			if c := cost[i-1][j] + 1; c < cost[i][j] {
+				cost[i][j] = c
+			}
+			if c := cost[i][j-1] + 1; c < cost[i][j] {
+				cost[i][j] = c
+			}
+		}
+	}
+	counts := ErrorCounts{Reference: n}
+	for i, j := n, m; i > 0 || j > 0; {
+		switch {
+		case i > 0 && j > 0 && cost[i][j] == cost[i-1][j-1] && reference[i-1] == hypothesis[j-1]:
+			i, j = i-1, j-1
+		case i > 0 && j > 0 && cost[i][j] == cost[i-1][j-1]+1:
+			counts.Substitutions++
+			i, j = i-1, j-1
+		case i > 0 && cost[i][j] == cost[i-1][j]+1:
+			counts.Deletions++
+			i--
+		default:
+			counts.Insertions++
+			j--
+		}
+	}
+	counts.rate()
+	return counts
+}
+
+func (c *ErrorCounts) rate() {
+	c.Wer = 0
+	if c.Reference > 0 {
+		c.Wer = float64(c.Substitutions+c.Deletions+c.Insertions) / float64(c.Reference)
+	}
+}
+
+func (c *ErrorCounts) add(o ErrorCounts) {
+	c.Reference += o.Reference
+	c.Substitutions += o.Substitutions
+	c.Deletions += o.Deletions
+	c.Insertions += o.Insertions
+	c.rate()
+}
+
+// Scores a transcript record against a reference, per speaker when the
+// reference is labelled
+func evaluate_record(reference []referenceWord, record *TranscriptRecord) FileEvaluation {
+	var ref, hyp []string
+	bySpeaker := map[int][]string{}
+	for _, w := range reference {
+		ref = append(ref, w.word)
+		if w.speaker > 0 {
+			bySpeaker[w.speaker] = append(bySpeaker[w.speaker], w.word)
+		}
+	}
+	hypBySpeaker := map[int][]string{}
+	for _, w := range record.Words {
+		if n := normalize_word(w.Word); n != "" {
+			hyp = append(hyp, n)
+			hypBySpeaker[w.SpeakerTag] = append(hypBySpeaker[w.SpeakerTag], n)
+		}
+	}
+	result := FileEvaluation{ErrorCounts: word_errors(ref, hyp)}
+	if len(bySpeaker) == 0 {
+		return result
+	}
+	for speaker := range hypBySpeaker {
+		if _, ok := bySpeaker[speaker]; !ok {
+			bySpeaker[speaker] = nil
+		}
+	}
+	for speaker, words := range bySpeaker {
+		result.Speakers = append(result.Speakers, SpeakerEvaluation{speaker, word_errors(words, hypBySpeaker[speaker])})
+	}
+	sort.Slice(result.Speakers, func(i, j int) bool { return result.Speakers[i].SpeakerTag < result.Speakers[j].SpeakerTag })
+	return result
+}
+
+// Recognizes one recording of the corpus, or loads its saved response
+func evaluation_response(ctx context.Context, transcriber Transcriber, base string) (*speechpb.LongRunningRecognizeResponse, error) {
+	if transcriber == nil {
+		data, err := read_location(ctx, base+".json")
+		if err != nil {
+			return nil, err
+		}
+		response := &speechpb.LongRunningRecognizeResponse{}
+		if err := json.Unmarshal(data, response); err != nil {
+			return nil, fmt.Errorf("%s.json: %v", base, err)
+		}
+		return response, nil
+	}
+	location := base + ".wav"
+	data, err := read_location(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := parse_wav(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", location, err)
+	}
+	job := TranscriptionJob{Audio: audio, Name: location, Record: &TranscriptRecord{}}
+	if strings.HasPrefix(location, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		job.Bucket, job.Name = parts[0], parts[1]
+	}
+	return transcriber.Transcribe(ctx, job)
+}
+
+// Evaluate_corpus measures recognition accuracy on a directory, local or
+// gs://bucket/prefix, of reference transcripts <name>.txt with their audio
+// <name>.wav or saved responses <name>.json. Recordings that cannot be
+// recognized are reported with their error and left out of the totals.
+func Evaluate_corpus(ctx context.Context, dir string, opts EvaluationOptions) (*EvaluationReport, error) {
+	report := &EvaluationReport{Transcriber: opts.Transcriber}
+	var transcriber Transcriber
+	if opts.Transcriber != "saved" {
+		tenant, err := load_tenant_config(ctx, opts.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		record := TranscriptRecord{metadata: map[string]string{"transcriber": opts.Transcriber}}
+		transcriber, err = select_transcriber(&record, tenant)
+		if err != nil {
+			return nil, err
+		}
+		report.Transcriber = record.Transcriber
+		if strings.HasPrefix(record.Transcriber, "google") && !strings.HasPrefix(dir, "gs://") {
+			return nil, fmt.Errorf("the %s transcriber reads audio from Cloud Storage; use a gs:// corpus or saved responses", record.Transcriber)
+		}
+	}
+	files, err := list_location(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	speakers := map[int]*SpeakerEvaluation{}
+	for _, file := range files {
+		if path.Ext(file) != ".txt" {
+			continue
+		}
+		base := strings.TrimSuffix(file, ".txt")
+		data, err := read_location(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		response, err := evaluation_response(ctx, transcriber, base)
+		record := TranscriptRecord{}
+		if err == nil {
+			err = parse_transcript(response, &record)
+		}
+		if err != nil {
+			report.Files = append(report.Files, FileEvaluation{File: path.Base(base), Error: err.Error()})
+			continue
+		}
+		result := evaluate_record(parse_reference(data), &record)
+		result.File = path.Base(base)
+		report.Files = append(report.Files, result)
+		report.Total.add(result.ErrorCounts)
+		for _, s := range result.Speakers {
+			if speakers[s.SpeakerTag] == nil {
+				speakers[s.SpeakerTag] = &SpeakerEvaluation{SpeakerTag: s.SpeakerTag}
+			}
+			speakers[s.SpeakerTag].add(s.ErrorCounts)
+		}
+	}
+	if len(report.Files) == 0 {
+		return nil, fmt.Errorf("no reference transcripts (.txt) in %s", dir)
+	}
+	for _, s := range speakers {
+		report.Speakers = append(report.Speakers, *s)
+	}
+	sort.Slice(report.Speakers, func(i, j int) bool { return report.Speakers[i].SpeakerTag < report.Speakers[j].SpeakerTag })
+	return report, nil
+}
+
+// Format_evaluation_table lays a report out as a table, one row per
+// recording followed by the totals and the per-speaker rows
+func Format_evaluation_table(report *EvaluationReport) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "file\twords\tsub\tdel\tins\tWER\t")
+	row := func(name string, c ErrorCounts) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.1f%%\t\n", name, c.Reference, c.Substitutions, c.Deletions, c.Insertions, c.Wer*100)
+	}
+	for _, f := range report.Files {
+		if f.Error != "" {
+			fmt.Fprintf(w, "%s\t\t\t\t\terror\t\n", f.File)
+			continue
+		}
+		row(f.File, f.ErrorCounts)
+	}
+	row("total", report.Total)
+	for _, s := range report.Speakers {
+		row(fmt.Sprintf("speaker %d", s.SpeakerTag), s.ErrorCounts)
+	}
+	w.Flush()
+	return b.String()
+}
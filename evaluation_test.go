@@ -0,0 +1,105 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+func TestWordErrors(t *testing.T) {
+	ref := strings.Fields("i would like to order a dozen roses")
+	hyp := strings.Fields("i would like order a dozen of rose")
+	got := word_errors(ref, hyp)
+	want := ErrorCounts{Reference: 8, Substitutions: 1, Deletions: 1, Insertions: 1, Wer: 3.0 / 8}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := word_errors(nil, []string{"hello"}); got.Insertions != 1 || got.Wer != 0 {
+		t.Errorf("empty reference gave %+v", got)
+	}
+	if got := word_errors(ref, nil); got.Deletions != 8 || got.Wer != 1 {
+		t.Errorf("empty hypothesis gave %+v", got)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	words := parse_reference([]byte("Speaker 1: Thank you for calling.\n2: Hi, I'd like roses!\nunlabelled\n"))
+	if len(words) != 9 || words[0] != (referenceWord{"thank", 1}) || words[4] != (referenceWord{"hi", 2}) || words[8].speaker != 0 {
+		t.Errorf("got %v", words)
+	}
+}
+
+// Builds a saved response with one result per speaker line
+func test_response(lines ...string) *speechpb.LongRunningRecognizeResponse {
+	resp := &speechpb.LongRunningRecognizeResponse{}
+	at := 0.0
+	for i, line := range lines {
+		alt := &speechpb.SpeechRecognitionAlternative{Transcript: line}
+		for _, w := range strings.Fields(line) {
+			alt.Words = append(alt.Words, &speechpb.WordInfo{Word: w, StartTime: seconds_to_duration(at), EndTime: seconds_to_duration(at + 0.3)})
+			at += 0.3
+		}
+		resp.Results = append(resp.Results, &speechpb.SpeechRecognitionResult{Alternatives: []*speechpb.SpeechRecognitionAlternative{alt}, ChannelTag: int32(i%2 + 1), ResultEndTime: seconds_to_duration(at)})
+	}
+	return resp
+}
+
+func write_test_file(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvaluateCorpusSaved(t *testing.T) {
+	dir := t.TempDir()
+	saved, _ := json.Marshal(test_response("Thank you for calling.", "I'd like a dozen rose."))
+	write_test_file(t, filepath.Join(dir, "call1.json"), saved)
+	write_test_file(t, filepath.Join(dir, "call1.txt"), []byte("1: Thank you for calling.\n2: I'd like a dozen roses.\n"))
+	write_test_file(t, filepath.Join(dir, "call2.txt"), []byte("No response was saved for this one."))
+	write_test_file(t, filepath.Join(dir, "notes.md"), []byte("not a reference"))
+
+	report, err := Evaluate_corpus(context.Background(), dir, EvaluationOptions{Transcriber: "saved"})
+	if err != nil {
+		t.Fatalf("Evaluate_corpus: %v", err)
+	}
+	if len(report.Files) != 2 || report.Files[0].File != "call1" || report.Files[1].Error == "" {
+		t.Fatalf("files = %+v", report.Files)
+	}
+	if report.Total != (ErrorCounts{Reference: 9, Substitutions: 1, Wer: 1.0 / 9}) {
+		t.Errorf("total = %+v", report.Total)
+	}
+	if len(report.Speakers) != 2 || report.Speakers[0].Wer != 0 || report.Speakers[1].Substitutions != 1 || report.Speakers[1].Reference != 5 {
+		t.Errorf("speakers = %+v", report.Speakers)
+	}
+	table := Format_evaluation_table(report)
+	for _, want := range []string{"call1", "11.1%", "error", "speaker 2", "20.0%"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("table is missing %q:\n%s", want, table)
+		}
+	}
+}
+
+func TestEvaluateCorpusTranscriber(t *testing.T) {
+	dir := t.TempDir()
+	write_test_file(t, filepath.Join(dir, "call.wav"), encode_wav(make_test_tone(8000, 2, 1, 440, 0.1)))
+	write_test_file(t, filepath.Join(dir, "call.txt"), []byte("hello world"))
+	canned, _ := json.Marshal(test_response("Hello, world."))
+	write_test_file(t, filepath.Join(dir, "canned.response"), canned)
+	t.Setenv("CANNED_RESPONSE", filepath.Join(dir, "canned.response"))
+
+	report, err := Evaluate_corpus(context.Background(), dir, EvaluationOptions{Transcriber: "canned"})
+	if err != nil {
+		t.Fatalf("Evaluate_corpus: %v", err)
+	}
+	if report.Transcriber != "canned" || len(report.Files) != 1 || report.Total.Wer != 0 || report.Total.Reference != 2 {
+		t.Errorf("report = %+v", report)
+	}
+	if _, err := Evaluate_corpus(context.Background(), dir, EvaluationOptions{Transcriber: "google"}); err == nil {
+		t.Errorf("expected an error for a Google transcriber on a local corpus")
+	}
+}
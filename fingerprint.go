@@ -0,0 +1,347 @@
+package function
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// DuplicateMatch links a call to an earlier upload of the same audio.
+type DuplicateMatch struct {
+	Fileid     string  `json:"fileid"`
+	Callid     string  `json:"callid"`
+	Filename   string  `json:"filename"`
+	Similarity float64 `json:"similarity"`
+}
+
+// FingerprintEntry is what the index keeps for each original call.
+type FingerprintEntry struct {
+	Fileid      string  `json:"fileid"`
+	Callid      string  `json:"callid"`
+	Filename    string  `json:"filename"`
+	Duration    float64 `json:"duration"`
+	Fingerprint []byte  `json:"fingerprint"`
+}
+
+// FingerprintIndex stores the fingerprints of processed calls. Entries are
+// grouped by duration so a lookup only reads calls of similar length.
+type FingerprintIndex interface {
+	Candidates(ctx context.Context, duration float64) ([]FingerprintEntry, error)
+	Add(ctx context.Context, entry FingerprintEntry) error
+}
+
+const (
+	//Only every n-th frame hash is stored, five per second
+	fingerprintStride = 8
+	//Highest bit error rate at which two fingerprints count as the same audio
+	fingerprintMaxBER = 0.3
+	//Share of the longer recording that must line up with the other, so an
+	//excerpt of a call is not taken for a copy of it
+	fingerprintMinOverlap = 0.8
+	//Width of the duration groups in the index
+	fingerprintGroupSecs = 30.0
+)
+
+// Spectral hashes of the mono mix, one per hashHopSecs
+func audio_hashes(audio *WavAudio) []uint32 {
+	mono, rate := analysis_mono(audio)
+	return frame_hashes(band_energies(mono, rate))
+}
+
+// Reduces the hashes to the compact fingerprint stored with the record:
+// every fingerprintStride-th hash, little-endian.
+func encode_fingerprint(hashes []uint32) []byte {
+	fp := make([]byte, 0, 4*(len(hashes)/fingerprintStride+1))
+	word := make([]byte, 4)
+	for n := 0; n < len(hashes); n += fingerprintStride {
+		binary.LittleEndian.PutUint32(word, hashes[n])
+		fp = append(fp, word...)
+	}
+	return fp
+}
+
+func decode_fingerprint(fp []byte) []uint32 {
+	hashes := make([]uint32, len(fp)/4)
+	for i := range hashes {
+		hashes[i] = binary.LittleEndian.Uint32(fp[4*i:])
+	}
+	return hashes
+}
+
+// Compares the full-rate hashes of a recording with a stored fingerprint.
+// The offset between them is found by voting on frames that share half a
+// hash, so copies trimmed differently at the start still line up. Returns
+// the share of matching bits over the aligned frames, or 0 when the two
+// recordings overlap too little.
+func match_fingerprint(hashes, stored []uint32) float64 {
+	index := map[uint32][]int{}
+	for p := 1; p < len(hashes); p++ {
+		for _, key := range []uint32{hashes[p] & 0xFFFF, hashes[p]>>16 | 1<<16} {
+			index[key] = append(index[key], p)
+		}
+	}
+	votes := map[int]int{}
+	for k := 1; k < len(stored); k++ {
+		for _, key := range []uint32{stored[k] & 0xFFFF, stored[k]>>16 | 1<<16} {
+			if len(index[key]) > promptMaxBucket {
+				continue
+			}
+			for _, p := range index[key] {
+				votes[p-k*fingerprintStride]++
+			}
+		}
+	}
+	best, offset := 0, 0
+	for o, v := range votes {
+		if v > best || v == best && o < offset {
+			best, offset = v, o
+		}
+	}
+	if best == 0 {
+		return 0
+	}
+	errors, frames := 0, 0
+	for k := 1; k < len(stored); k++ {
+		p := k*fingerprintStride + offset
+		if p < 1 || p >= len(hashes) {
+			continue
+		}
+		frames++
+		//Digital silence hashes to zero on both sides and says nothing
+		if stored[k] == 0 && hashes[p] == 0 {
+			continue
+		}
+		errors += bits.OnesCount32(stored[k] ^ hashes[p])
+	}
+	longer := math.Max(float64(len(stored)-1), float64(len(hashes)-1)/fingerprintStride)
+	if frames == 0 || float64(frames) < fingerprintMinOverlap*longer {
+		return 0
+	}
+	return 1 - float64(errors)/float64(32*frames)
+}
+
+// Looks the recording up in the index. Entries for the same file, e.g.
+// from a retried event, are not reported as duplicates.
+func find_duplicate(ctx context.Context, index FingerprintIndex, hashes []uint32, duration float64, filename string) (*DuplicateMatch, error) {
+	candidates, err := index.Candidates(ctx, duration)
+	if err != nil {
+		return nil, err
+	}
+	var best *DuplicateMatch
+	for _, c := range candidates {
+		if c.Filename == filename {
+			continue
+		}
+		similarity := match_fingerprint(hashes, decode_fingerprint(c.Fingerprint))
+		if similarity < 1-fingerprintMaxBER || best != nil && similarity <= best.Similarity {
+			continue
+		}
+		best = &DuplicateMatch{Fileid: c.Fileid, Callid: c.Callid, Filename: c.Filename, Similarity: similarity}
+	}
+	return best, nil
+}
+
+// Duplicate handling from DUPLICATES: "flag" (default) links the record to
+// the original, "skip" also stops processing, "off" disables the check.
+func duplicate_mode() (string, error) {
+	mode := os.Getenv("DUPLICATES")
+	switch mode {
+	case "":
+		return "flag", nil
+	case "flag", "skip", "off":
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown DUPLICATES mode %q", mode)
+}
+
+// Fingerprints the recording and looks it up in the index. A duplicate is
+// linked to the original in the record; an original is added to the index.
+// Returns true when the call should not be processed further.
+func check_duplicate(ctx context.Context, audio *WavAudio, bucket string, record *TranscriptRecord) (bool, error) {
+	hashes := audio_hashes(audio)
+	record.Fingerprint = encode_fingerprint(hashes)
+	mode, err := duplicate_mode()
+	if err != nil || mode == "off" {
+		return false, err
+	}
+	index := get_fingerprint_index(bucket)
+	match, err := find_duplicate(ctx, index, hashes, audio.Duration(), record.Filename)
+	if err != nil {
+		return false, err
+	}
+	if match != nil {
+		record.Duplicate = *match
+		return mode == "skip", nil
+	}
+	return false, index.Add(ctx, FingerprintEntry{
+		Fileid:      record.Fileid,
+		Callid:      record.Callid,
+		Filename:    record.Filename,
+		Duration:    audio.Duration(),
+		Fingerprint: record.Fingerprint,
+	})
+}
+
+func fingerprint_group(duration float64) int {
+	return int(duration / fingerprintGroupSecs)
+}
+
+// Groups to read for a lookup: the call's own and its neighbours, so copies
+// trimmed across a group boundary are still found
+func fingerprint_groups(duration float64) []int {
+	g := fingerprint_group(duration)
+	if g == 0 {
+		return []int{0, 1}
+	}
+	return []int{g - 1, g, g + 1}
+}
+
+// How far back a lookup searches. FINGERPRINT_LOOKBACK_DAYS defaults to
+// 30; 0 keeps entries for ever. Older entries are deleted when a lookup
+// comes across them, so the groups stay small.
+func fingerprint_lookback() time.Duration {
+	days, err := strconv.ParseFloat(os.Getenv("FINGERPRINT_LOOKBACK_DAYS"), 64)
+	if err != nil || days < 0 {
+		days = 30
+	}
+	return time.Duration(days * float64(24*time.Hour))
+}
+
+// Reports whether an entry written at created is past the lookback
+func fingerprint_expired(created time.Time, lookback time.Duration) bool {
+	return lookback > 0 && time.Since(created) > lookback
+}
+
+// Returns the index named by FINGERPRINT_INDEX: a gs://bucket/prefix URI or
+// a local directory. Defaults to fingerprints/ in the output location.
+func get_fingerprint_index(bucket string) FingerprintIndex {
+	location := os.Getenv("FINGERPRINT_INDEX")
+	if location == "" {
+		outBucket, prefix := artifact_location(bucket, "fingerprints", "/")
+		return &gcsFingerprintIndex{bucket: outBucket, prefix: prefix}
+	}
+	if strings.HasPrefix(location, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		prefix := ""
+		if len(parts) == 2 && parts[1] != "" {
+			prefix = strings.TrimSuffix(parts[1], "/") + "/"
+		}
+		return &gcsFingerprintIndex{bucket: parts[0], prefix: prefix}
+	}
+	return &dirFingerprintIndex{dir: location}
+}
+
+// Keeps one JSON object per call under prefix/<group>/<fileid>.json, so
+// concurrent invocations never rewrite a shared file.
+type gcsFingerprintIndex struct {
+	bucket string
+	prefix string
+}
+
+func (g *gcsFingerprintIndex) Candidates(ctx context.Context, duration float64) ([]FingerprintEntry, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	lookback := fingerprint_lookback()
+	var entries []FingerprintEntry
+	for _, group := range fingerprint_groups(duration) {
+		it := client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: fmt.Sprintf("%s%d/", g.prefix, group)})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if fingerprint_expired(attrs.Created, lookback) {
+				//Another lookup may have deleted it already
+				client.Bucket(g.bucket).Object(attrs.Name).Delete(ctx)
+				continue
+			}
+			rc, err := client.Bucket(g.bucket).Object(attrs.Name).NewReader(ctx)
+			if err != nil {
+				return nil, err
+			}
+			var entry FingerprintEntry
+			err = json.NewDecoder(rc).Decode(&entry)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", attrs.Name, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (g *gcsFingerprintIndex) Add(ctx context.Context, entry FingerprintEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s%d/%s.json", g.prefix, fingerprint_group(entry.Duration), entry.Fileid)
+	return write_gcs_object(ctx, g.bucket, name, data, "application/json")
+}
+
+// Same layout as gcsFingerprintIndex in a directory on local disk
+type dirFingerprintIndex struct {
+	dir string
+}
+
+func (d *dirFingerprintIndex) Candidates(ctx context.Context, duration float64) ([]FingerprintEntry, error) {
+	lookback := fingerprint_lookback()
+	var entries []FingerprintEntry
+	for _, group := range fingerprint_groups(duration) {
+		files, err := filepath.Glob(filepath.Join(d.dir, fmt.Sprint(group), "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, err
+			}
+			if fingerprint_expired(info.ModTime(), lookback) {
+				os.Remove(file)
+				continue
+			}
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			var entry FingerprintEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (d *dirFingerprintIndex) Add(ctx context.Context, entry FingerprintEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(d.dir, fmt.Sprint(fingerprint_group(entry.Duration)))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, entry.Fileid+".json"), data, 0644)
+}
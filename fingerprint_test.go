@@ -0,0 +1,121 @@
+package function
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func make_babble_audio(seed int64, secs float64) *WavAudio {
+	rng := rand.New(rand.NewSource(seed))
+	return &WavAudio{SampleRate: 8000, BitsPerSample: 16, Channels: [][]float32{
+		append_babble(nil, rng, 8000, secs),
+		append_babble(nil, rng, 8000, secs),
+	}}
+}
+
+// A copy of the call as another recorder would produce it: trimmed at the
+// start, quieter and with some added noise
+func make_copy(audio *WavAudio, trimSecs float64) *WavAudio {
+	rng := rand.New(rand.NewSource(99))
+	c := slice_audio(audio, trimSecs, audio.Duration())
+	for _, samples := range c.Channels {
+		for i := range samples {
+			samples[i] = samples[i]*0.7 + float32(rng.NormFloat64()*0.002)
+		}
+	}
+	return c
+}
+
+func TestMatchFingerprint(t *testing.T) {
+	original := make_babble_audio(1, 40)
+	stored := decode_fingerprint(encode_fingerprint(audio_hashes(original)))
+
+	copy := make_copy(original, 1.33)
+	if similarity := match_fingerprint(audio_hashes(copy), stored); similarity < 1-fingerprintMaxBER {
+		t.Errorf("trimmed copy similarity = %.2f, want at least %.2f", similarity, 1-fingerprintMaxBER)
+	}
+	other := make_babble_audio(2, 40)
+	if similarity := match_fingerprint(audio_hashes(other), stored); similarity >= 1-fingerprintMaxBER {
+		t.Errorf("different call similarity = %.2f, want below %.2f", similarity, 1-fingerprintMaxBER)
+	}
+	//A short excerpt of the call is not a duplicate of the whole of it
+	excerpt := slice_audio(original, 10, 15)
+	if similarity := match_fingerprint(audio_hashes(excerpt), stored); similarity >= 1-fingerprintMaxBER {
+		t.Errorf("excerpt similarity = %.2f, want below %.2f", similarity, 1-fingerprintMaxBER)
+	}
+}
+
+func TestCheckDuplicate(t *testing.T) {
+	t.Setenv("FINGERPRINT_INDEX", t.TempDir())
+	t.Setenv("DUPLICATES", "skip")
+	ctx := context.Background()
+	original := make_babble_audio(1, 40)
+
+	first := TranscriptRecord{Fileid: "f1", Callid: "c1", Filename: "audio/a.wav"}
+	skip, err := check_duplicate(ctx, original, "audio", &first)
+	if err != nil || skip || first.Duplicate.Fileid != "" || len(first.Fingerprint) == 0 {
+		t.Fatalf("original: skip = %v, err = %v, duplicate = %+v", skip, err, first.Duplicate)
+	}
+	//A retried event for the same file is not its own duplicate
+	retry := TranscriptRecord{Fileid: "f2", Callid: "c1", Filename: "audio/a.wav"}
+	if skip, err := check_duplicate(ctx, original, "audio", &retry); err != nil || skip {
+		t.Fatalf("retry: skip = %v, err = %v", skip, err)
+	}
+
+	second := TranscriptRecord{Fileid: "f3", Callid: "c2", Filename: "audio/b.wav"}
+	skip, err = check_duplicate(ctx, make_copy(original, 0.5), "audio", &second)
+	if err != nil || !skip {
+		t.Fatalf("copy: skip = %v, err = %v", skip, err)
+	}
+	if second.Duplicate.Fileid != "f1" || second.Duplicate.Callid != "c1" || second.Duplicate.Filename != "audio/a.wav" {
+		t.Errorf("copy linked to %+v, want the original", second.Duplicate)
+	}
+
+	t.Setenv("DUPLICATES", "flag")
+	third := TranscriptRecord{Fileid: "f4", Callid: "c3", Filename: "audio/c.wav"}
+	if skip, err := check_duplicate(ctx, make_copy(original, 0.2), "audio", &third); err != nil || skip || third.Duplicate.Fileid != "f1" {
+		t.Errorf("flag mode: skip = %v, err = %v, duplicate = %+v", skip, err, third.Duplicate)
+	}
+	other := TranscriptRecord{Fileid: "f5", Callid: "c4", Filename: "audio/d.wav"}
+	if _, err := check_duplicate(ctx, make_babble_audio(2, 40), "audio", &other); err != nil || other.Duplicate.Fileid != "" {
+		t.Errorf("different call: err = %v, duplicate = %+v", err, other.Duplicate)
+	}
+}
+
+func TestFingerprintLookback(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("FINGERPRINT_INDEX", dir)
+	ctx := context.Background()
+	index := get_fingerprint_index("audio")
+	for _, id := range []string{"old", "new"} {
+		if err := index.Add(ctx, FingerprintEntry{Fileid: id, Duration: 40}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale := filepath.Join(dir, "1", "old.json")
+	past := time.Now().Add(-45 * 24 * time.Hour)
+	if err := os.Chtimes(stale, past, past); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := index.Candidates(ctx, 40)
+	if err != nil || len(entries) != 1 || entries[0].Fileid != "new" {
+		t.Errorf("entries = %+v, %v", entries, err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expired entry kept: %v", err)
+	}
+	t.Setenv("FINGERPRINT_LOOKBACK_DAYS", "0")
+	if fingerprint_expired(past, fingerprint_lookback()) {
+		t.Errorf("entry expired without a lookback")
+	}
+}
+
+func TestBandEnergiesTinyRate(t *testing.T) {
+	if energies := band_energies(make([]float32, 100), 20); energies != nil {
+		t.Errorf("got %d frames at 20 Hz", len(energies))
+	}
+}
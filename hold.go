@@ -0,0 +1,213 @@
+package function
+
+import (
+	"math"
+	"sort"
+)
+
+// HoldSegment is a stretch of hold music, tones or a recorded prompt.
+// Kind is "music" or "prompt".
+type HoldSegment struct {
+	Kind      string  `json:"kind"`
+	StartSecs float64 `json:"startSecs"`
+	EndSecs   float64 `json:"endSecs"`
+}
+
+const (
+	//Music is judged over windows of this length
+	musicWindowSecs = 1.0
+	//Share of a window's frames that must be above the noise floor
+	musicMinActive = 0.95
+	//Speech rises and falls with every syllable; music and tones hold a
+	//steady level. Windows whose active frames vary less than this are
+	//treated as music.
+	musicMaxLevelStdDb = 3.0
+	//Shorter stretches of music are not reported as hold
+	musicMinSecs = 4.0
+	//Shortest recorded prompt, and the minimum distance between two plays
+	promptMinSecs = 2.0
+	//Hash runs compared when checking a candidate repeat
+	promptBlockSecs = 1.0
+	//Highest bit error rate at which two hash runs count as the same audio
+	promptMaxBER = 0.25
+	//Hashes seen more often than this carry too little information to index
+	promptMaxBucket = 32
+	//Gaps shorter than this inside a repeated prompt are bridged
+	promptMaxGapSecs = 1.0
+)
+
+// Flags each window of steady, continuous sound
+func music_windows(mono []float32, rate int) []bool {
+	frame := int(vadFrameSecs * float64(rate))
+	if frame == 0 {
+		return nil
+	}
+	levels := frame_levels(mono, frame)
+	threshold := math.Max(percentile(levels, vadNoisePercentile)+vadThresholdDb, vadMinLevelDb)
+	per := int(musicWindowSecs / vadFrameSecs)
+	var windows []bool
+	for start := 0; start+per <= len(levels); start += per {
+		var active []float64
+		for _, l := range levels[start : start+per] {
+			if l >= threshold {
+				active = append(active, l)
+			}
+		}
+		if float64(len(active)) < musicMinActive*float64(per) {
+			windows = append(windows, false)
+			continue
+		}
+		mean := 0.0
+		for _, l := range active {
+			mean += l
+		}
+		mean /= float64(len(active))
+		variance := 0.0
+		for _, l := range active {
+			variance += (l - mean) * (l - mean)
+		}
+		windows = append(windows, math.Sqrt(variance/float64(len(active))) <= musicMaxLevelStdDb)
+	}
+	return windows
+}
+
+// Converts runs of flagged units into segments of at least min seconds
+func flag_segments(flags []bool, unitSecs, minSecs float64) []AudioSegment {
+	var segments []AudioSegment
+	for i := 0; i < len(flags); {
+		if !flags[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(flags) && flags[j] {
+			j++
+		}
+		if float64(j-i)*unitSecs >= minSecs {
+			segments = append(segments, AudioSegment{StartSecs: float64(i) * unitSecs, EndSecs: float64(j) * unitSecs})
+		}
+		i = j
+	}
+	return segments
+}
+
+// Finds audio that plays more than once in the call, such as a recorded
+// "your call is important to us" prompt. Frames are indexed by each half of
+// their hash, since a whole 32-bit hash rarely survives a replay intact.
+// Frames sharing a half with a frame at least promptMinSecs earlier are
+// confirmed by comparing a block of hashes after them.
+func repeated_segments(mono []float32, rate int) []AudioSegment {
+	energies := band_energies(mono, rate)
+	hashes := frame_hashes(energies)
+	if len(hashes) == 0 {
+		return nil
+	}
+	//Silence gives near-identical hashes everywhere, so only index frames
+	//with some energy in them
+	totals := make([]float64, len(energies))
+	for n, bands := range energies {
+		for _, e := range bands {
+			totals[n] += e
+		}
+		totals[n] = 10 * math.Log10(totals[n]+1e-12)
+	}
+	floor := percentile(totals, vadNoisePercentile) + vadThresholdDb
+	minGap := int(promptMinSecs / hashHopSecs)
+	block := int(promptBlockSecs / hashHopSecs)
+	index := map[uint32][]int{}
+	repeated := make([]bool, len(hashes))
+	for n := 1; n+block <= len(hashes); n++ {
+		if totals[n] < floor {
+			continue
+		}
+		for _, key := range []uint32{hashes[n] & 0xFFFF, hashes[n]>>16 | 1<<16} {
+			if len(index[key]) <= promptMaxBucket {
+				for _, m := range index[key] {
+					if n-m < minGap || repeated[n] && repeated[m] {
+						continue
+					}
+					if bit_error_rate(hashes[n:n+block], hashes[m:m+block]) <= promptMaxBER {
+						for k := 0; k < block; k++ {
+							repeated[n+k], repeated[m+k] = true, true
+						}
+					}
+				}
+			}
+			index[key] = append(index[key], n)
+		}
+	}
+	fill_runs(repeated, false, int(promptMaxGapSecs/hashHopSecs))
+	return flag_segments(repeated, hashHopSecs, promptMinSecs)
+}
+
+// Detects hold music, tones and repeated prompts in the recording
+func detect_holds(audio *WavAudio) []HoldSegment {
+	mono, rate := analysis_mono(audio)
+	var holds []HoldSegment
+	for _, s := range flag_segments(music_windows(mono, rate), musicWindowSecs, musicMinSecs) {
+		holds = append(holds, HoldSegment{Kind: "music", StartSecs: s.StartSecs, EndSecs: s.EndSecs})
+	}
+	music := hold_ranges(holds)
+	for _, s := range repeated_segments(mono, rate) {
+		//Looping hold music repeats too; it is already reported as music
+		if in_segments((s.StartSecs+s.EndSecs)/2, music) {
+			continue
+		}
+		holds = append(holds, HoldSegment{Kind: "prompt", StartSecs: s.StartSecs, EndSecs: s.EndSecs})
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].StartSecs < holds[j].StartSecs })
+	return holds
+}
+
+// Merged time ranges covered by any hold segment
+func hold_ranges(holds []HoldSegment) []AudioSegment {
+	var segments []AudioSegment
+	for _, h := range holds {
+		segments = append(segments, AudioSegment{StartSecs: h.StartSecs, EndSecs: h.EndSecs})
+	}
+	return merge_segments(segments, 0)
+}
+
+func in_segments(secs float64, segments []AudioSegment) bool {
+	for _, s := range segments {
+		if secs >= s.StartSecs && secs < s.EndSecs {
+			return true
+		}
+	}
+	return false
+}
+
+func segments_secs(segments []AudioSegment) float64 {
+	total := 0.0
+	for _, s := range segments {
+		total += s.EndSecs - s.StartSecs
+	}
+	return total
+}
+
+// Recomputes the transcript talk and silence figures without the hold
+// periods, so music transcribed as words does not count as talk and hold
+// does not count as silence.
+func exclude_hold(record *TranscriptRecord, holds []AudioSegment) {
+	record.Holdsecs = segments_secs(holds)
+	if len(holds) == 0 {
+		return
+	}
+	record.Speakeronespeaking, record.Speakertwospeaking = 0, 0
+	for _, w := range record.Words {
+		if in_segments((w.StartSecs+w.EndSecs)/2, holds) {
+			continue
+		}
+		if w.SpeakerTag == 1 {
+			record.Speakeronespeaking += w.EndSecs - w.StartSecs
+		} else {
+			record.Speakertwospeaking += w.EndSecs - w.StartSecs
+		}
+	}
+	talkable := record.Duration - record.Holdsecs
+	record.Silencesecs = talkable - record.Speakeronespeaking - record.Speakertwospeaking
+	record.Silencepercentage = 0
+	if talkable > 0 {
+		record.Silencepercentage = int(record.Silencesecs / talkable * 100)
+	}
+}
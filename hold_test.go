@@ -0,0 +1,114 @@
+package function
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Appends speech-like audio: bursts of noisy voicing at random pitch and
+// level, separated by short pauses, like syllables.
+func append_babble(samples []float32, rng *rand.Rand, rate int, secs float64) []float32 {
+	end := len(samples) + int(secs*float64(rate))
+	for len(samples) < end {
+		pitch := 120 + rng.Float64()*150
+		level := 0.05 + rng.Float64()*0.3
+		burst := int((0.08 + rng.Float64()*0.2) * float64(rate))
+		for i := 0; i < burst && len(samples) < end; i++ {
+			t := float64(i) / float64(rate)
+			env := math.Sin(math.Pi * float64(i) / float64(burst))
+			v := level * env * (math.Sin(2*math.Pi*pitch*t) + 0.5*math.Sin(2*math.Pi*pitch*3.1*t) + 0.3*rng.NormFloat64())
+			samples = append(samples, float32(v))
+		}
+		pause := int((0.05 + rng.Float64()*0.25) * float64(rate))
+		for i := 0; i < pause && len(samples) < end; i++ {
+			samples = append(samples, float32(rng.NormFloat64()*0.001))
+		}
+	}
+	return samples
+}
+
+// Appends steady music: a sustained three-note chord changing every half second
+func append_music(samples []float32, rate int, secs float64) []float32 {
+	chords := [][]float64{{261.6, 329.6, 392}, {293.7, 349.2, 440}, {246.9, 311.1, 370}}
+	n := int(secs * float64(rate))
+	for i := 0; i < n; i++ {
+		t := float64(i) / float64(rate)
+		chord := chords[int(t*2)%len(chords)]
+		v := 0.0
+		for _, hz := range chord {
+			v += 0.1 * math.Sin(2*math.Pi*hz*t)
+		}
+		samples = append(samples, float32(v))
+	}
+	return samples
+}
+
+func TestDetectHoldMusic(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	var samples []float32
+	samples = append_babble(samples, rng, 8000, 10)
+	samples = append_music(samples, 8000, 10)
+	samples = append_babble(samples, rng, 8000, 10)
+	holds := detect_holds(&WavAudio{SampleRate: 8000, BitsPerSample: 16, Channels: [][]float32{samples}})
+	if len(holds) != 1 || holds[0].Kind != "music" {
+		t.Fatalf("got %+v, want one music segment", holds)
+	}
+	if math.Abs(holds[0].StartSecs-10) > 1 || math.Abs(holds[0].EndSecs-20) > 1 {
+		t.Errorf("got music %.1f-%.1f, want about 10-20", holds[0].StartSecs, holds[0].EndSecs)
+	}
+}
+
+func TestDetectRepeatedPrompt(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	prompt := append_babble(nil, rand.New(rand.NewSource(6)), 8000, 3)
+	var samples []float32
+	samples = append_babble(samples, rng, 8000, 5)
+	samples = append(samples, prompt...)
+	samples = append_babble(samples, rng, 8000, 7.013)
+	samples = append(samples, prompt...)
+	samples = append_babble(samples, rng, 8000, 5)
+	holds := detect_holds(&WavAudio{SampleRate: 8000, BitsPerSample: 16, Channels: [][]float32{samples}})
+	var prompts []HoldSegment
+	for _, h := range holds {
+		if h.Kind == "prompt" {
+			prompts = append(prompts, h)
+		}
+	}
+	if len(prompts) != 2 {
+		t.Fatalf("got %+v, want two prompt segments", holds)
+	}
+	for i, want := range []float64{5, 15.013} {
+		if math.Abs(prompts[i].StartSecs-want) > 0.5 || math.Abs(prompts[i].EndSecs-want-3) > 0.5 {
+			t.Errorf("got prompt %.2f-%.2f, want about %.2f-%.2f", prompts[i].StartSecs, prompts[i].EndSecs, want, want+3)
+		}
+	}
+}
+
+func TestDetectHoldIgnoresConversation(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	samples := append_babble(nil, rng, 8000, 30)
+	if holds := detect_holds(&WavAudio{SampleRate: 8000, BitsPerSample: 16, Channels: [][]float32{samples}}); len(holds) != 0 {
+		t.Errorf("got %+v, want no hold", holds)
+	}
+}
+
+func TestExcludeHold(t *testing.T) {
+	record := TranscriptRecord{Duration: 100}
+	for _, w := range []AudioSegment{{10, 20}, {50, 55}, {80, 90}} {
+		record.Words = append(record.Words, struct {
+			Word       string  `json:"word"`
+			StartSecs  float64 `json:"startSecs"`
+			EndSecs    float64 `json:"endSecs"`
+			SpeakerTag int     `json:"speakertag"`
+			Confidence float64 `json:"confidence"`
+		}{Word: "la", StartSecs: w.StartSecs, EndSecs: w.EndSecs, SpeakerTag: 1})
+	}
+	exclude_hold(&record, []AudioSegment{{40, 60}})
+	if record.Holdsecs != 20 || record.Speakeronespeaking != 20 {
+		t.Errorf("got hold %.1f and talk %.1f, want 20 and 20", record.Holdsecs, record.Speakeronespeaking)
+	}
+	if record.Silencesecs != 60 || record.Silencepercentage != 75 {
+		t.Errorf("got silence %.1f (%d%%), want 60 (75%%)", record.Silencesecs, record.Silencepercentage)
+	}
+}
@@ -0,0 +1,573 @@
+package function
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NormalizedSpan is a run of recognized words that inverse text
+// normalization rewrote, e.g. "four oh nine eight six six five oh eight
+// eight" as "409-866-5088". Text is what the normalized transcript shows,
+// Value a machine-readable form (digits, an ISO 8601 date, an amount with
+// its currency code) and Original the recognized words. FirstWord and
+// LastWord index Words.
+type NormalizedSpan struct {
+	Kind       string  `json:"kind"`
+	Text       string  `json:"text"`
+	Value      string  `json:"value"`
+	Original   string  `json:"original"`
+	FirstWord  int     `json:"firstword"`
+	LastWord   int     `json:"lastword"`
+	StartSecs  float64 `json:"startSecs"`
+	EndSecs    float64 `json:"endSecs"`
+	SpeakerTag int     `json:"speakertag"`
+}
+
+const (
+	itnNumber   = "number"
+	itnDigits   = "digits"
+	itnPhone    = "phone"
+	itnOrdinal  = "ordinal"
+	itnDate     = "date"
+	itnCurrency = "currency"
+	itnPercent  = "percent"
+	itnSpelled  = "spelled"
+)
+
+var cardinalValues = map[string]int64{
+	"zero": 0, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+	"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+	"thirteen": 13, "fourteen": 14, "fifteen": 15, "sixteen": 16,
+	"seventeen": 17, "eighteen": 18, "nineteen": 19,
+}
+
+var tensValues = map[string]int64{
+	"twenty": 20, "thirty": 30, "forty": 40, "fifty": 50,
+	"sixty": 60, "seventy": 70, "eighty": 80, "ninety": 90,
+}
+
+var scaleValues = map[string]int64{
+	"thousand": 1000, "million": 1000000, "billion": 1000000000,
+}
+
+var ordinalValues = map[string]int{
+	"first": 1, "second": 2, "third": 3, "fourth": 4, "fifth": 5, "sixth": 6,
+	"seventh": 7, "eighth": 8, "ninth": 9, "tenth": 10, "eleventh": 11,
+	"twelfth": 12, "thirteenth": 13, "fourteenth": 14, "fifteenth": 15,
+	"sixteenth": 16, "seventeenth": 17, "eighteenth": 18, "nineteenth": 19,
+	"twentieth": 20, "thirtieth": 30, "fortieth": 40, "fiftieth": 50,
+	"sixtieth": 60, "seventieth": 70, "eightieth": 80, "ninetieth": 90,
+}
+
+var monthNames = []string{"January", "February", "March", "April", "May", "June",
+	"July", "August", "September", "October", "November", "December"}
+
+var currencyWords = map[string]string{
+	"dollar": "USD", "dollars": "USD", "bucks": "USD", "euro": "EUR", "euros": "EUR",
+}
+
+var currencySymbols = map[string]string{"USD": "$", "EUR": "€"}
+
+// itnItem is one cleaned word of a speaker's turn. Hyphenated numbers such
+// as "twenty-five" become several items of the same word.
+type itnItem struct {
+	text string
+	word int
+}
+
+type itnMatch struct {
+	kind  string
+	text  string
+	value string
+	n     int
+}
+
+// Splits a speaker's words into items
+func itn_items(record *TranscriptRecord, first, last int) []itnItem {
+	var items []itnItem
+	for w := first; w <= last; w++ {
+		word := clean_spoken_word(record.Words[w].Word)
+		parts := strings.Split(word, "-")
+		split := len(parts) > 1
+		for _, p := range parts {
+			if !is_number_word(p) {
+				split = false
+			}
+		}
+		if !split {
+			parts = []string{word}
+		}
+		for _, p := range parts {
+			items = append(items, itnItem{p, w})
+		}
+	}
+	return items
+}
+
+func is_number_word(w string) bool {
+	_, cardinal := cardinalValues[w]
+	_, tens := tensValues[w]
+	_, ordinal := ordinalValues[w]
+	return cardinal || tens || ordinal
+}
+
+// Reads a spoken cardinal such as "two thousand and twenty four" or "three
+// point five". Returns the integer part, the decimal digits and how many
+// items were read, 0 when items[i] does not start a number.
+func parse_cardinal(items []itnItem, i int) (int64, string, int) {
+	var total, current int64
+	last := ""
+	bigScale := int64(0)
+	j := i
+	for ; j < len(items); j++ {
+		w := items[j].text
+		small := last == "" || last == "hundred" || last == "scale" || last == "and"
+		if v, ok := cardinalValues[w]; ok && v < 10 && (small || last == "tens") {
+			current += v
+			last = "unit"
+		} else if ok && v >= 10 && small {
+			current += v
+			last = "teen"
+		} else if v, ok := tensValues[w]; ok && small {
+			current += v
+			last = "tens"
+		} else if w == "hundred" && (last == "unit" || last == "teen") {
+			current *= 100
+			last = "hundred"
+		} else if w == "a" && last == "" && j+1 < len(items) && (items[j+1].text == "hundred" || scaleValues[items[j+1].text] > 0) {
+			current = 1
+			last = "unit"
+		} else if s, ok := scaleValues[w]; ok && current > 0 && (bigScale == 0 || s < bigScale) && last != "and" {
+			total += current * s
+			current = 0
+			bigScale = s
+			last = "scale"
+		} else if w == "and" && (last == "hundred" || last == "scale") && j+1 < len(items) && (cardinalValues[items[j+1].text] > 0 || tensValues[items[j+1].text] > 0) {
+			last = "and"
+		} else {
+			break
+		}
+	}
+	if j == i {
+		return 0, "", 0
+	}
+	decimals := ""
+	if j+1 < len(items) && items[j].text == "point" {
+		k := j + 1
+		for ; k < len(items); k++ {
+			d, ok := digitWords[items[k].text]
+			if !ok {
+				break
+			}
+			decimals += d
+		}
+		if decimals != "" {
+			j = k
+		}
+	}
+	return total + current, decimals, j - i
+}
+
+// Reads a number written in digits, such as "12" or "12.50"
+func written_number(w string) (string, bool) {
+	if w == "" || strings.Count(w, ".") > 1 || strings.HasPrefix(w, ".") || strings.HasSuffix(w, ".") {
+		return "", false
+	}
+	for _, r := range w {
+		if (r < '0' || r > '9') && r != '.' {
+			return "", false
+		}
+	}
+	return w, true
+}
+
+// Reads a number spoken or written in digits, formatted as digits
+func parse_number(items []itnItem, i int) (string, int) {
+	if n, ok := written_number(items[i].text); ok {
+		return n, 1
+	}
+	value, decimals, n := parse_cardinal(items, i)
+	if n == 0 {
+		return "", 0
+	}
+	text := strconv.FormatInt(value, 10)
+	if decimals != "" {
+		text += "." + decimals
+	}
+	return text, n
+}
+
+// Reads digits read out one by one, e.g. a phone or account number. At
+// least two single digits must be read out in a row, so "twenty five" stays
+// a number.
+func parse_digit_sequence(items []itnItem, i int) (string, int) {
+	texts := make([]string, len(items))
+	for k, item := range items {
+		texts[k] = item.text
+	}
+	digits := ""
+	singles, run, pieces := 0, 0, 0
+	written := true
+	j := i
+	for j < len(texts) {
+		d, n := spoken_digits(texts, j)
+		if n == 0 {
+			break
+		}
+		if !is_digit_word(texts[j]) {
+			written = false
+		}
+		if len(d) == 1 {
+			run++
+			if run > singles {
+				singles = run
+			}
+		} else {
+			run = 0
+		}
+		digits += d
+		pieces++
+		j += n
+	}
+	//Written digits are only joined into long numbers, e.g. "409 866 5088"
+	if pieces < 2 || (written && len(digits) < minDigitSequence) || (!written && (singles < 2 || len(digits) < 3)) {
+		return "", 0
+	}
+	return digits, j - i
+}
+
+// Formats phone numbers as 409-866-5088
+func format_digits(digits string) (string, string) {
+	switch {
+	case len(digits) == 10:
+		return itnPhone, digits[:3] + "-" + digits[3:6] + "-" + digits[6:]
+	case len(digits) == 11 && digits[0] == '1':
+		return itnPhone, "1-" + digits[1:4] + "-" + digits[4:7] + "-" + digits[7:]
+	case len(digits) == 7:
+		return itnPhone, digits[:3] + "-" + digits[3:]
+	}
+	return itnDigits, digits
+}
+
+// Reads an ordinal such as "third", "twenty-first" or "21st"
+func parse_ordinal(items []itnItem, i int) (int, int) {
+	w := items[i].text
+	if t, ok := tensValues[w]; ok && i+1 < len(items) {
+		if o, ok := ordinalValues[items[i+1].text]; ok && o < 10 {
+			return int(t) + o, 2
+		}
+	}
+	if o, ok := ordinalValues[w]; ok {
+		return o, 1
+	}
+	if len(w) > 2 {
+		if n, err := strconv.Atoi(w[:len(w)-2]); err == nil && n > 0 && w == strconv.Itoa(n)+ordinal_suffix(n) {
+			return n, 1
+		}
+	}
+	return 0, 0
+}
+
+func ordinal_suffix(n int) string {
+	if n%100 >= 11 && n%100 <= 13 {
+		return "th"
+	}
+	switch n % 10 {
+	case 1:
+		return "st"
+	case 2:
+		return "nd"
+	case 3:
+		return "rd"
+	}
+	return "th"
+}
+
+// Reads a year from 1900 to 2099: "2024", "twenty twenty four",
+// "nineteen ninety", "two thousand five" or "twenty oh five"
+func parse_year(items []itnItem, i int) (int, int) {
+	if i >= len(items) {
+		return 0, 0
+	}
+	year, n := 0, 0
+	if y, err := strconv.Atoi(items[i].text); err == nil && len(items[i].text) == 4 {
+		year, n = y, 1
+	} else if century := cardinalValues[items[i].text] + tensValues[items[i].text]; (century == 19 || century == 20) && i+1 < len(items) {
+		next := items[i+1].text
+		if v, ok := cardinalValues[next]; ok && v >= 10 {
+			year, n = int(century)*100+int(v), 2
+		} else if t, ok := tensValues[next]; ok {
+			year, n = int(century)*100+int(t), 2
+			if i+2 < len(items) {
+				if u, ok := cardinalValues[items[i+2].text]; ok && u > 0 && u < 10 {
+					year, n = year+int(u), 3
+				}
+			}
+		} else if (next == "oh" || next == "o") && i+2 < len(items) {
+			if u, ok := cardinalValues[items[i+2].text]; ok && u > 0 && u < 10 {
+				year, n = int(century)*100+int(u), 3
+			}
+		} else if next == "hundred" {
+			year, n = int(century)*100, 2
+		}
+	}
+	if n == 0 {
+		if v, decimals, m := parse_cardinal(items, i); m > 1 && decimals == "" {
+			year, n = int(v), m
+		}
+	}
+	if year < 1900 || year > 2099 {
+		return 0, 0
+	}
+	return year, n
+}
+
+// Reads a day of the month, spoken as an ordinal or, after the month, as a
+// cardinal
+func parse_day(items []itnItem, i int, cardinal bool) (int, int) {
+	if i >= len(items) {
+		return 0, 0
+	}
+	day, n := parse_ordinal(items, i)
+	if n == 0 && cardinal {
+		if v, decimals, m := parse_cardinal(items, i); m > 0 && decimals == "" {
+			day, n = int(v), m
+		} else if v, err := strconv.Atoi(items[i].text); err == nil {
+			day, n = v, 1
+		}
+	}
+	if day < 1 || day > 31 {
+		return 0, 0
+	}
+	return day, n
+}
+
+// Reads "March third", "March the third, twenty twenty four" or "the third
+// of March"
+func match_date(items []itnItem, i int) (itnMatch, bool) {
+	j := i
+	month, day := 0, 0
+	if m := month_value(items[j].text); m > 0 {
+		j++
+		if j < len(items) && items[j].text == "the" {
+			j++
+		}
+		d, n := parse_day(items, j, true)
+		if n == 0 {
+			return itnMatch{}, false
+		}
+		month, day = m, d
+		j += n
+	} else {
+		if items[j].text == "the" {
+			j++
+		}
+		if j >= len(items) {
+			return itnMatch{}, false
+		}
+		d, n := parse_day(items, j, false)
+		if n == 0 || j+n+1 >= len(items) || items[j+n].text != "of" {
+			return itnMatch{}, false
+		}
+		m := month_value(items[j+n+1].text)
+		if m == 0 {
+			return itnMatch{}, false
+		}
+		month, day = m, d
+		j += n + 2
+	}
+	match := itnMatch{kind: itnDate, text: fmt.Sprintf("%s %d", monthNames[month-1], day), value: fmt.Sprintf("--%02d-%02d", month, day)}
+	if year, n := parse_year(items, j); n > 0 {
+		match.text += fmt.Sprintf(", %d", year)
+		match.value = fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+		j += n
+	}
+	match.n = j - i
+	return match, true
+}
+
+// Returns the month named by a word, 0 if it names none
+func month_value(w string) int {
+	for i, name := range monthNames {
+		if strings.ToLower(name) == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Reads amounts and percentages: "twelve dollars and fifty cents", "fifty
+// cents", "three point five percent"
+func match_amount(items []itnItem, i int) (itnMatch, bool) {
+	number, n := parse_number(items, i)
+	if n == 0 || i+n >= len(items) {
+		return itnMatch{}, false
+	}
+	j := i + n
+	unit := items[j].text
+	if unit == "percent" || (unit == "per" && j+1 < len(items) && items[j+1].text == "cent") {
+		if unit == "per" {
+			j++
+		}
+		return itnMatch{kind: itnPercent, text: number + "%", value: number + "%", n: j + 1 - i}, true
+	}
+	if unit == "cents" || unit == "cent" {
+		cents, err := strconv.Atoi(number)
+		if err != nil || cents >= 100 {
+			return itnMatch{}, false
+		}
+		amount := fmt.Sprintf("0.%02d", cents)
+		return itnMatch{kind: itnCurrency, text: "$" + amount, value: amount + " USD", n: j + 1 - i}, true
+	}
+	code, ok := currencyWords[unit]
+	if !ok {
+		return itnMatch{}, false
+	}
+	j++
+	amount := number
+	//"and fifty cents", or just "fifty" after the currency
+	k := j
+	if k < len(items) && items[k].text == "and" {
+		k++
+	}
+	if k < len(items) && !strings.Contains(number, ".") {
+		if cents, m := parse_number(items, k); m > 0 {
+			c, err := strconv.Atoi(cents)
+			named := k+m < len(items) && (items[k+m].text == "cents" || items[k+m].text == "cent")
+			if err == nil && c < 100 && (named || k == j) {
+				amount = fmt.Sprintf("%s.%02d", number, c)
+				j = k + m
+				if named {
+					j++
+				}
+			}
+		}
+	}
+	return itnMatch{kind: itnCurrency, text: currencySymbols[code] + amount, value: amount + " " + code, n: j - i}, true
+}
+
+// Reads letters spelled out one by one, possibly mixed with digits, e.g.
+// "j o h n" or "a b one two three"
+func match_spelled(items []itnItem, i int) (itnMatch, bool) {
+	text := ""
+	letters := 0
+	j := i
+	for ; j < len(items); j++ {
+		w := items[j].text
+		if utf8.RuneCountInString(w) == 1 && unicode.IsLetter([]rune(w)[0]) {
+			text += strings.ToUpper(w)
+			letters++
+		} else if d, ok := digitWords[w]; ok && letters > 0 {
+			text += d
+		} else if len(w) == 1 && w[0] >= '0' && w[0] <= '9' && letters > 0 {
+			text += w
+		} else {
+			break
+		}
+	}
+	if letters < 2 || j-i < minSpelledLetters || utf8.RuneCountInString(items[i].text) != 1 {
+		return itnMatch{}, false
+	}
+	return itnMatch{kind: itnSpelled, text: text, value: text, n: j - i}, true
+}
+
+// Tries the rewrites at items[i], the most specific first
+func match_itn(items []itnItem, i int) (itnMatch, bool) {
+	if m, ok := match_date(items, i); ok {
+		return m, true
+	}
+	if m, ok := match_amount(items, i); ok {
+		return m, true
+	}
+	if m, ok := match_spelled(items, i); ok {
+		return m, true
+	}
+	if digits, n := parse_digit_sequence(items, i); n > 0 {
+		kind, text := format_digits(digits)
+		return itnMatch{kind: kind, text: text, value: digits, n: n}, true
+	}
+	if value, n := parse_ordinal(items, i); n > 0 {
+		//"first", "second" and "third" alone are more often words than ordinals
+		if n > 1 || value > 3 {
+			text := strconv.Itoa(value) + ordinal_suffix(value)
+			return itnMatch{kind: itnOrdinal, text: text, value: strconv.Itoa(value), n: n}, true
+		}
+	}
+	if text, n := parse_number(items, i); n > 0 {
+		//Numbers under ten read better as words, as in "one of those"
+		_, written := written_number(items[i].text)
+		if !written && (n > 1 || cardinalValues[items[i].text] >= 10 || tensValues[items[i].text] > 0) {
+			return itnMatch{kind: itnNumber, text: text, value: text, n: n}, true
+		}
+	}
+	return itnMatch{}, false
+}
+
+// Keeps the punctuation that ended the last word of a span, e.g. "5088."
+func trailing_punctuation(word string) string {
+	end := len(word)
+	for end > 0 {
+		r, size := utf8.DecodeLastRuneInString(word[:end])
+		if !unicode.IsPunct(r) || r == '-' {
+			break
+		}
+		end -= size
+	}
+	return word[end:]
+}
+
+// Builds Normalizedtranscript from the recognized words with numbers,
+// dates, amounts, ordinals and spelled sequences in canonical form, and
+// records every rewrite in Normalizedspans. Words, and the transcript the
+// recognizer returned, are left as they are. A span never crosses a change
+// of speaker.
+func normalize_transcript(record *TranscriptRecord) {
+	record.Normalizedspans = nil
+	var out []string
+	for first := 0; first < len(record.Words); {
+		last := first
+		for last+1 < len(record.Words) && record.Words[last+1].SpeakerTag == record.Words[first].SpeakerTag {
+			last++
+		}
+		items := itn_items(record, first, last)
+		word := first
+		for i := 0; i < len(items); {
+			m, ok := match_itn(items, i)
+			//Rewrites must cover whole words
+			ok = ok && items[i].word >= word && (i+m.n == len(items) || items[i+m.n].word != items[i+m.n-1].word)
+			if !ok {
+				w := items[i].word
+				if w >= word {
+					out = append(out, record.Words[w].Word)
+					word = w + 1
+				}
+				i++
+				continue
+			}
+			firstWord, lastWord := items[i].word, items[i+m.n-1].word
+			var original []string
+			for w := firstWord; w <= lastWord; w++ {
+				original = append(original, record.Words[w].Word)
+			}
+			out = append(out, m.text+trailing_punctuation(record.Words[lastWord].Word))
+			record.Normalizedspans = append(record.Normalizedspans, NormalizedSpan{
+				Kind:       m.kind,
+				Text:       m.text,
+				Value:      m.value,
+				Original:   strings.Join(original, " "),
+				FirstWord:  firstWord,
+				LastWord:   lastWord,
+				StartSecs:  record.Words[firstWord].StartSecs,
+				EndSecs:    record.Words[lastWord].EndSecs,
+				SpeakerTag: record.Words[firstWord].SpeakerTag,
+			})
+			word = lastWord + 1
+			i += m.n
+		}
+		first = last + 1
+	}
+	record.Normalizedtranscript = strings.Join(out, " ")
+}
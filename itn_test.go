@@ -0,0 +1,92 @@
+package function
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// Builds a record from the words, one second per word, all from speaker 1
+func itn_record(words string) *TranscriptRecord {
+	record := &TranscriptRecord{}
+	for i, w := range strings.Fields(words) {
+		add_test_word(record, w, float64(i), float64(i)+1, 1)
+	}
+	return record
+}
+
+func TestNormalizeTranscript(t *testing.T) {
+	tests := []struct {
+		words string
+		want  string
+	}{
+		{"call me at four oh nine eight six six five oh eight eight.", "call me at 409-866-5088."},
+		{"it's one eight hundred five five five one two one two", "it's 1-800-555-1212"},
+		{"account five five two one nine", "account 55219"},
+		{"I paid twelve dollars and fifty cents for two roses", "I paid $12.50 for two roses"},
+		{"that's twenty five euros", "that's €25"},
+		{"about fifty cents", "about $0.50"},
+		{"a hundred dollars", "$100"},
+		{"rates went up three point five percent", "rates went up 3.5%"},
+		{"delivered on March third, twenty twenty four please", "delivered on March 3, 2024 please"},
+		{"by the twenty-first of June", "by June 21"},
+		{"may I have June fifteen", "may I have June 15"},
+		{"that's the fourth time, first of all", "that's the 4th time, first of all"},
+		{"one of those two thousand and twenty three orders", "one of those 2023 orders"},
+		{"twenty-five bouquets", "25 bouquets"},
+		{"my name is j o h n", "my name is JOHN"},
+		{"code a b one two three", "code AB123"},
+		{"order 409 866 5088", "order 409-866-5088"},
+		{"room 12 on floor 3", "room 12 on floor 3"},
+	}
+	for _, tt := range tests {
+		record := itn_record(tt.words)
+		normalize_transcript(record)
+		if record.Normalizedtranscript != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.words, record.Normalizedtranscript, tt.want)
+		}
+	}
+}
+
+func TestNormalizedSpans(t *testing.T) {
+	record := itn_record("ship on March third twenty twenty four to four oh nine eight six six five oh eight eight")
+	words := len(record.Words)
+	normalize_transcript(record)
+	if len(record.Words) != words || record.Words[2].Word != "March" {
+		t.Errorf("the recognized words were changed")
+	}
+	if len(record.Normalizedspans) != 2 {
+		t.Fatalf("spans = %+v", record.Normalizedspans)
+	}
+	date, phone := record.Normalizedspans[0], record.Normalizedspans[1]
+	if date.Kind != itnDate || date.Value != "2024-03-03" || date.FirstWord != 2 || date.LastWord != 6 || date.StartSecs != 2 || date.EndSecs != 7 || date.Original != "March third twenty twenty four" {
+		t.Errorf("date = %+v", date)
+	}
+	if phone.Kind != itnPhone || phone.Value != "4098665088" || phone.Text != "409-866-5088" || phone.FirstWord != 8 || phone.LastWord != 17 {
+		t.Errorf("phone = %+v", phone)
+	}
+}
+
+func TestNormalizeSpeakerTurns(t *testing.T) {
+	//Digits read by different speakers are not joined
+	record := itn_record("four five six")
+	add_test_word(record, "seven", 3, 4, 2)
+	add_test_word(record, "eight", 4, 5, 2)
+	add_test_word(record, "nine", 5, 6, 2)
+	normalize_transcript(record)
+	if record.Normalizedtranscript != "456 789" {
+		t.Errorf("got %q", record.Normalizedtranscript)
+	}
+}
+
+func TestNormalizeRedacted(t *testing.T) {
+	record := itn_record("call me at four oh nine eight six six five oh eight eight")
+	record.Transcript = "call me at four oh nine eight six six five oh eight eight"
+	normalize_transcript(record)
+	if err := redact_record(context.Background(), []Redactor{&localRedactor{}}, record); err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(record.Normalizedtranscript, "0123456789") || len(record.Normalizedspans) != 0 {
+		t.Errorf("normalized transcript not redacted: %q, %+v", record.Normalizedtranscript, record.Normalizedspans)
+	}
+}
@@ -0,0 +1,382 @@
+package function
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// RtpStream describes one RTP stream found in a packet capture.
+type RtpStream struct {
+	SSRC        uint32
+	PayloadType int
+	Packets     int
+	//Packets missing from the sequence, filled with silence
+	Lost int
+	//Packets left out because their timestamp jumped further than the
+	//capture's wall-clock time allows
+	Outliers int
+	//Position of the stream's first sample in the call, in seconds
+	StartSecs float64
+	samples   []float32
+}
+
+type rtpPacket struct {
+	seq       uint16
+	timestamp uint32
+	arrival   float64
+	payload   []byte
+}
+
+const (
+	rtpPayloadPCMU = 0
+	rtpPayloadPCMA = 8
+	//G.711 is always sampled at 8 kHz
+	g711Rate = 8000
+	//SSRCs seen in fewer packets are stray UDP traffic rather than a call leg
+	rtpMinPackets = 10
+	//Timestamps further than this from the start of a stream are corrupt
+	rtpMaxSecs = 4 * 60 * 60
+	//How far a timestamp may run ahead of the packet's arrival time, for
+	//jitter and senders whose clock runs fast
+	rtpMaxDriftSecs = 2
+)
+
+// Link-layer types of the captures we read
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// Reports whether an uploaded object is a packet capture
+func is_pcap(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".pcap")
+}
+
+// Decodes one G.711 mu-law byte to a linear sample in [-1, 1]
+func ulaw_decode(b byte) float32 {
+	u := ^b
+	exp := (u >> 4) & 7
+	mag := ((int(u&0x0f) << 3) + 0x84) << exp
+	mag -= 0x84
+	if u&0x80 != 0 {
+		mag = -mag
+	}
+	return float32(mag) / 32768
+}
+
+// Decodes one G.711 A-law byte to a linear sample in [-1, 1]
+func alaw_decode(b byte) float32 {
+	a := b ^ 0x55
+	exp := (a >> 4) & 7
+	mag := int(a&0x0f)<<4 + 8
+	if exp > 0 {
+		mag = (int(a&0x0f)<<4 + 0x108) << (exp - 1)
+	}
+	if a&0x80 == 0 {
+		mag = -mag
+	}
+	return float32(mag) / 32768
+}
+
+// Returns the UDP payload of a captured frame, or nil for anything else.
+// IP fragments other than the first are skipped.
+func udp_payload(frame []byte, link int) []byte {
+	var ip []byte
+	switch link {
+	case linkEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		etherType, pos := binary.BigEndian.Uint16(frame[12:14]), 14
+		//VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= pos+4 {
+			etherType, pos = binary.BigEndian.Uint16(frame[pos+2:pos+4]), pos+4
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil
+		}
+		ip = frame[pos:]
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		ip = frame[16:]
+	case linkNull:
+		if len(frame) < 4 {
+			return nil
+		}
+		ip = frame[4:]
+	case linkRaw:
+		ip = frame
+	default:
+		return nil
+	}
+	var udp []byte
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		ihl := int(ip[0]&0x0f) * 4
+		fragment := binary.BigEndian.Uint16(ip[6:8]) & 0x1fff
+		if ip[9] != 17 || fragment != 0 || len(ip) < ihl+8 {
+			return nil
+		}
+		udp = ip[ihl:]
+	case len(ip) >= 48 && ip[0]>>4 == 6:
+		if ip[6] != 17 {
+			return nil
+		}
+		udp = ip[40:]
+	default:
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		length = len(udp)
+	}
+	return udp[8:length]
+}
+
+// Parses an RTP header, returning false for anything that is not an RTP
+// media packet, such as RTCP sharing the port range
+func parse_rtp(data []byte) (uint32, int, rtpPacket, bool) {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return 0, 0, rtpPacket{}, false
+	}
+	pt := int(data[1] & 0x7f)
+	if pt >= 72 && pt <= 76 {
+		return 0, 0, rtpPacket{}, false
+	}
+	header := 12 + 4*int(data[0]&0x0f)
+	if data[0]&0x10 != 0 {
+		if len(data) < header+4 {
+			return 0, 0, rtpPacket{}, false
+		}
+		header += 4 + 4*int(binary.BigEndian.Uint16(data[header+2:header+4]))
+	}
+	end := len(data)
+	if data[0]&0x20 != 0 && end > 0 {
+		end -= int(data[end-1])
+	}
+	if header > end {
+		return 0, 0, rtpPacket{}, false
+	}
+	packet := rtpPacket{
+		seq:       binary.BigEndian.Uint16(data[2:4]),
+		timestamp: binary.BigEndian.Uint32(data[4:8]),
+		payload:   data[header:end],
+	}
+	return binary.BigEndian.Uint32(data[8:12]), pt, packet, true
+}
+
+// Reads a classic libpcap file and groups the G.711 RTP packets in it by
+// SSRC
+func read_pcap(data []byte) (map[uint32]*RtpStream, map[uint32][]rtpPacket, error) {
+	if len(data) < 24 {
+		return nil, nil, fmt.Errorf("not a pcap file")
+	}
+	var order binary.ByteOrder
+	nanos := false
+	switch binary.LittleEndian.Uint32(data[0:4]) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, nil, fmt.Errorf("pcapng captures are not supported; save the capture as pcap")
+	default:
+		return nil, nil, fmt.Errorf("not a pcap file")
+	}
+	link := int(order.Uint32(data[20:24]))
+	streams := map[uint32]*RtpStream{}
+	packets := map[uint32][]rtpPacket{}
+	for pos := 24; pos+16 <= len(data); {
+		secs, frac := order.Uint32(data[pos:pos+4]), order.Uint32(data[pos+4:pos+8])
+		size := int(order.Uint32(data[pos+8 : pos+12]))
+		if size > len(data)-pos-16 {
+			size = len(data) - pos - 16
+		}
+		frame := data[pos+16 : pos+16+size]
+		pos += 16 + size
+		ssrc, pt, packet, ok := parse_rtp(udp_payload(frame, link))
+		if !ok || pt != rtpPayloadPCMU && pt != rtpPayloadPCMA {
+			continue
+		}
+		packet.arrival = float64(secs) + float64(frac)/1e6
+		if nanos {
+			packet.arrival = float64(secs) + float64(frac)/1e9
+		}
+		if streams[ssrc] == nil {
+			streams[ssrc] = &RtpStream{SSRC: ssrc, PayloadType: pt}
+		}
+		packets[ssrc] = append(packets[ssrc], packet)
+	}
+	return streams, packets, nil
+}
+
+// Lays a stream's payloads out by RTP timestamp, so packets that arrived
+// late or out of order land in the right place and lost packets leave
+// silence. A timestamp may not advance further past the previous packet's,
+// or past the start of the stream, than the capture's wall-clock time
+// allows; such packets are corrupt and counted in Outliers. Returns the
+// arrival time of the stream's first sample.
+func decode_rtp_stream(stream *RtpStream, packets []rtpPacket) float64 {
+	//Unwrap the 16-bit sequence numbers in arrival order, then sort
+	ext := make([]int64, len(packets))
+	for i := 1; i < len(packets); i++ {
+		ext[i] = ext[i-1] + int64(int16(packets[i].seq-packets[i-1].seq))
+	}
+	order := make([]int, len(packets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return ext[order[a]] < ext[order[b]] })
+	decode := ulaw_decode
+	if stream.PayloadType == rtpPayloadPCMA {
+		decode = alaw_decode
+	}
+	first := packets[order[0]]
+	lastArrival := first.arrival
+	for _, p := range packets {
+		if p.arrival > lastArrival {
+			lastArrival = p.arrival
+		}
+	}
+	span := int64((lastArrival - first.arrival + rtpMaxDriftSecs) * g711Rate)
+	if span > rtpMaxSecs*g711Rate {
+		span = rtpMaxSecs * g711Rate
+	}
+	//Place the packets first, so the samples are allocated once
+	offsets := make([]int64, len(packets))
+	end := 0
+	prev, last := ext[order[0]]-1, -1
+	for _, i := range order {
+		offsets[i] = -1
+		if ext[i] == prev {
+			continue
+		}
+		stream.Lost += int(ext[i] - prev - 1)
+		prev = ext[i]
+		stream.Packets++
+		offset := int64(int32(packets[i].timestamp - first.timestamp))
+		if offset < 0 || offset > span {
+			stream.Outliers++
+			continue
+		}
+		if last >= 0 {
+			jump := offset - offsets[last]
+			allowed := int64((packets[i].arrival - packets[last].arrival + rtpMaxDriftSecs) * g711Rate)
+			if jump > allowed || -jump > allowed {
+				stream.Outliers++
+				continue
+			}
+		}
+		offsets[i], last = offset, i
+		if n := int(offset) + len(packets[i].payload); n > end {
+			end = n
+		}
+	}
+	samples := make([]float32, end)
+	for i, offset := range offsets {
+		if offset < 0 {
+			continue
+		}
+		for j, b := range packets[i].payload {
+			samples[int(offset)+j] = decode(b)
+		}
+	}
+	stream.samples = samples
+	return first.arrival
+}
+
+// Rebuilds a two-channel recording from the two busiest G.711 streams in a
+// packet capture, ordered by when they start and aligned on capture time.
+// A capture with a single stream gives a silent second channel.
+func pcap_to_audio(data []byte) (*WavAudio, []*RtpStream, error) {
+	streams, packets, err := read_pcap(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var found []*RtpStream
+	starts := map[uint32]float64{}
+	for ssrc, stream := range streams {
+		if len(packets[ssrc]) < rtpMinPackets {
+			continue
+		}
+		starts[ssrc] = decode_rtp_stream(stream, packets[ssrc])
+		found = append(found, stream)
+	}
+	if len(found) == 0 {
+		return nil, nil, fmt.Errorf("no G.711 RTP streams found")
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Packets != found[j].Packets {
+			return found[i].Packets > found[j].Packets
+		}
+		return found[i].SSRC < found[j].SSRC
+	})
+	if len(found) > 2 {
+		found = found[:2]
+	}
+	sort.Slice(found, func(i, j int) bool { return starts[found[i].SSRC] < starts[found[j].SSRC] })
+	callStart := starts[found[0].SSRC]
+	audio := &WavAudio{SampleRate: g711Rate, BitsPerSample: 16, Channels: make([][]float32, 2)}
+	length := 0
+	offsets := make([]int, len(found))
+	for i, stream := range found {
+		stream.StartSecs = starts[stream.SSRC] - callStart
+		offsets[i] = int(stream.StartSecs*g711Rate + 0.5)
+		if end := offsets[i] + len(stream.samples); end > length {
+			length = end
+		}
+	}
+	for c := range audio.Channels {
+		audio.Channels[c] = make([]float32, length)
+		if c < len(found) {
+			copy(audio.Channels[c][offsets[c]:], found[c].samples)
+		}
+	}
+	return audio, found, nil
+}
+
+// Converts an uploaded packet capture to <name>.wav in the same bucket,
+// carrying over the capture's metadata. The new WAV upload is then
+// processed like any other recording.
+func ingest_pcap(ctx context.Context, bucket, name string) ([]*RtpStream, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	object := client.Bucket(bucket).Object(name)
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := read_gcs_object(ctx, bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	audio, streams, err := pcap_to_audio(data)
+	if err != nil {
+		return nil, err
+	}
+	w := client.Bucket(bucket).Object(strings.TrimSuffix(name, path.Ext(name)) + ".wav").NewWriter(ctx)
+	w.ContentType = "audio/wav"
+	w.Metadata = attrs.Metadata
+	if _, err := w.Write(encode_wav(audio)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return streams, w.Close()
+}
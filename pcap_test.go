@@ -0,0 +1,180 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type testRtp struct {
+	ssrc      uint32
+	pt        byte
+	seq       uint16
+	timestamp uint32
+	arrival   float64
+	payload   []byte
+}
+
+// Wraps a UDP payload in Ethernet and IPv4 headers
+func make_test_frame(udpPayload []byte) []byte {
+	var frame bytes.Buffer
+	frame.Write(make([]byte, 12))
+	binary.Write(&frame, binary.BigEndian, uint16(0x0800))
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(udpPayload)))
+	ip[8], ip[9] = 64, 17
+	frame.Write(ip)
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 10000)
+	binary.BigEndian.PutUint16(udp[2:4], 20000)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(udpPayload)))
+	frame.Write(udp)
+	frame.Write(udpPayload)
+	return frame.Bytes()
+}
+
+func make_test_pcap(packets []testRtp, extra ...[]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{0xa1b2c3d4})
+	binary.Write(&buf, binary.LittleEndian, []uint16{2, 4})
+	binary.Write(&buf, binary.LittleEndian, []uint32{0, 0, 65535, linkEthernet})
+	write := func(arrival float64, frame []byte) {
+		secs := uint32(arrival)
+		binary.Write(&buf, binary.LittleEndian, []uint32{secs, uint32((arrival - float64(secs)) * 1e6), uint32(len(frame)), uint32(len(frame))})
+		buf.Write(frame)
+	}
+	for _, p := range packets {
+		rtp := make([]byte, 12)
+		rtp[0], rtp[1] = 0x80, p.pt
+		binary.BigEndian.PutUint16(rtp[2:4], p.seq)
+		binary.BigEndian.PutUint32(rtp[4:8], p.timestamp)
+		binary.BigEndian.PutUint32(rtp[8:12], p.ssrc)
+		write(p.arrival, make_test_frame(append(rtp, p.payload...)))
+	}
+	for _, payload := range extra {
+		write(1000, make_test_frame(payload))
+	}
+	return buf.Bytes()
+}
+
+func TestG711Decode(t *testing.T) {
+	for b, want := range map[byte]float32{0xFF: 0, 0x7F: 0, 0x80: 32124, 0x00: -32124} {
+		if got := ulaw_decode(b) * 32768; got != want {
+			t.Errorf("ulaw_decode(%#x) = %v, want %v", b, got, want)
+		}
+	}
+	for b, want := range map[byte]float32{0xD5: 8, 0x55: -8, 0xAA: 32256, 0x2A: -32256} {
+		if got := alaw_decode(b) * 32768; got != want {
+			t.Errorf("alaw_decode(%#x) = %v, want %v", b, got, want)
+		}
+	}
+}
+
+func TestPcapToAudio(t *testing.T) {
+	//20ms packets of 160 samples. The caller's stream starts at
+	//1000.0s, wraps its sequence number and loses one packet; the agent's
+	//starts half a second later in A-law with two packets swapped.
+	var packets []testRtp
+	for i := 0; i < 50; i++ {
+		if i == 20 {
+			continue
+		}
+		packets = append(packets, testRtp{ssrc: 0x1111, pt: rtpPayloadPCMU, seq: uint16(65530 + i), timestamp: uint32(4294967000 + 160*i), arrival: 1000 + 0.02*float64(i), payload: bytes.Repeat([]byte{0x80}, 160)})
+	}
+	var agent []testRtp
+	for i := 0; i < 25; i++ {
+		agent = append(agent, testRtp{ssrc: 0x2222, pt: rtpPayloadPCMA, seq: uint16(100 + i), timestamp: uint32(5000 + 160*i), arrival: 1000.5 + 0.02*float64(i), payload: bytes.Repeat([]byte{0xAA}, 160)})
+	}
+	agent[10], agent[11] = agent[11], agent[10]
+	packets = append(packets, agent...)
+	//A stray SSRC, RTCP and non-RTP UDP are ignored
+	packets = append(packets, testRtp{ssrc: 0x3333, pt: rtpPayloadPCMU, seq: 1, timestamp: 0, arrival: 1000.1, payload: []byte{0x80}})
+	rtcp := []byte{0x80, 200, 0, 6, 0, 0, 0x11, 0x11}
+	data := make_test_pcap(packets, rtcp, []byte("hello"))
+
+	audio, streams, err := pcap_to_audio(data)
+	if err != nil {
+		t.Fatalf("pcap_to_audio: %v", err)
+	}
+	if len(streams) != 2 || streams[0].SSRC != 0x1111 || streams[1].SSRC != 0x2222 {
+		t.Fatalf("got streams %+v", streams)
+	}
+	if streams[0].Packets != 49 || streams[0].Lost != 1 || streams[1].Packets != 25 || streams[1].Lost != 0 {
+		t.Errorf("packets/lost = %d/%d and %d/%d, want 49/1 and 25/0", streams[0].Packets, streams[0].Lost, streams[1].Packets, streams[1].Lost)
+	}
+	if audio.SampleRate != 8000 || len(audio.Channels) != 2 || len(audio.Channels[0]) != 8000 {
+		t.Fatalf("got %d Hz, %d channels of %d samples", audio.SampleRate, len(audio.Channels), len(audio.Channels[0]))
+	}
+	caller, agentChannel := audio.Channels[0], audio.Channels[1]
+	if caller[0] != ulaw_decode(0x80) || caller[19*160] != ulaw_decode(0x80) {
+		t.Errorf("caller audio not decoded")
+	}
+	for i := 20 * 160; i < 21*160; i++ {
+		if caller[i] != 0 {
+			t.Fatalf("lost packet not filled with silence at sample %d", i)
+		}
+	}
+	if caller[21*160] != ulaw_decode(0x80) {
+		t.Errorf("caller audio after the lost packet is misplaced")
+	}
+	for i := 0; i < 4000; i++ {
+		if agentChannel[i] != 0 {
+			t.Fatalf("agent audio starts at sample %d, want 4000", i)
+		}
+	}
+	for i := 4000; i < 8000; i++ {
+		if agentChannel[i] != alaw_decode(0xAA) {
+			t.Fatalf("agent sample %d = %v", i, agentChannel[i])
+		}
+	}
+}
+
+func TestPcapCorruptTimestamp(t *testing.T) {
+	//One packet claims to be three hours into a one-second call
+	var packets []testRtp
+	for i := 0; i < 50; i++ {
+		timestamp := uint32(160 * i)
+		if i == 30 {
+			timestamp = 3 * 60 * 60 * g711Rate
+		}
+		packets = append(packets, testRtp{ssrc: 0x1111, pt: rtpPayloadPCMU, seq: uint16(i), timestamp: timestamp, arrival: 1000 + 0.02*float64(i), payload: bytes.Repeat([]byte{0x80}, 160)})
+	}
+	audio, streams, err := pcap_to_audio(make_test_pcap(packets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams[0].Outliers != 1 || streams[0].Packets != 50 || len(audio.Channels[0]) != 8000 {
+		t.Errorf("outliers = %d, packets = %d, %d samples", streams[0].Outliers, streams[0].Packets, len(audio.Channels[0]))
+	}
+	//Silence suppression advances the timestamp without a gap in sequence
+	packets = packets[:0]
+	for i := 0; i < 20; i++ {
+		timestamp := uint32(160 * i)
+		arrival := 1000 + 0.02*float64(i)
+		if i >= 10 {
+			timestamp += 5 * g711Rate
+			arrival += 5
+		}
+		packets = append(packets, testRtp{ssrc: 0x1111, pt: rtpPayloadPCMU, seq: uint16(i), timestamp: timestamp, arrival: arrival, payload: bytes.Repeat([]byte{0x80}, 160)})
+	}
+	audio, streams, err = pcap_to_audio(make_test_pcap(packets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams[0].Outliers != 0 || len(audio.Channels[0]) != 20*160+5*g711Rate {
+		t.Errorf("silence suppression: outliers = %d, %d samples", streams[0].Outliers, len(audio.Channels[0]))
+	}
+}
+
+func TestPcapToAudioRejects(t *testing.T) {
+	if _, _, err := pcap_to_audio([]byte("RIFF....WAVE")); err == nil {
+		t.Errorf("expected an error for a WAV file")
+	}
+	if _, _, err := pcap_to_audio(make_test_pcap(nil, []byte("hello"))); err == nil {
+		t.Errorf("expected an error for a capture without RTP")
+	}
+	if !is_pcap("calls/a.PCAP") || is_pcap("calls/a.wav") {
+		t.Errorf("is_pcap")
+	}
+}
@@ -0,0 +1,178 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// preprocessConfig describes how audio is normalized before recognition.
+// A Rate of 0 keeps the recording's own; Channels is "keep", "mono" to
+// downmix or "split" to recognize each channel on its own. Normalized audio
+// is always written as 16-bit PCM, the LINEAR16 encoding Speech is asked for.
+type preprocessConfig struct {
+	Rate     int
+	Channels string
+}
+
+// Zero crossings of the resampling filter on each side of the centre
+const resampleTaps = 16
+
+// Reads PREPROCESS_RATE and PREPROCESS_CHANNELS. Returns false when neither
+// is set and the recording is sent to Speech as uploaded.
+func get_preprocess_config() (preprocessConfig, bool, error) {
+	cfg := preprocessConfig{Channels: os.Getenv("PREPROCESS_CHANNELS")}
+	rate := os.Getenv("PREPROCESS_RATE")
+	if rate == "" && cfg.Channels == "" {
+		return cfg, false, nil
+	}
+	if rate != "" {
+		var err error
+		if cfg.Rate, err = strconv.Atoi(rate); err != nil || cfg.Rate <= 0 {
+			return cfg, false, fmt.Errorf("invalid PREPROCESS_RATE %q", rate)
+		}
+	}
+	switch cfg.Channels {
+	case "":
+		cfg.Channels = "keep"
+	case "keep", "mono", "split":
+	default:
+		return cfg, false, fmt.Errorf("invalid PREPROCESS_CHANNELS %q", cfg.Channels)
+	}
+	return cfg, true, nil
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Converts samples between rates with a Hann-windowed sinc filter. When
+// reducing the rate the filter's cutoff drops to the new Nyquist frequency,
+// so content above it is removed rather than aliased.
+func resample(samples []float32, from, to int) []float32 {
+	if from == to || from <= 0 || to <= 0 {
+		return append([]float32(nil), samples...)
+	}
+	ratio := float64(to) / float64(from)
+	cutoff := math.Min(1, ratio) * 0.95
+	half := int(math.Ceil(resampleTaps / cutoff))
+	out := make([]float32, int(float64(len(samples))*ratio))
+	for j := range out {
+		center := float64(j) / ratio
+		first := int(math.Floor(center)) - half + 1
+		sum := 0.0
+		for i := first; i < first+2*half; i++ {
+			if i < 0 || i >= len(samples) {
+				continue
+			}
+			x := center - float64(i)
+			window := 0.5 + 0.5*math.Cos(math.Pi*x/float64(half))
+			sum += float64(samples[i]) * cutoff * sinc(cutoff*x) * window
+		}
+		out[j] = float32(sum)
+	}
+	return out
+}
+
+// Averages all channels into one
+func downmix(audio *WavAudio) *WavAudio {
+	mono := &WavAudio{SampleRate: audio.SampleRate, BitsPerSample: audio.BitsPerSample}
+	if len(audio.Channels) == 0 {
+		return mono
+	}
+	mixed := make([]float32, len(audio.Channels[0]))
+	for _, samples := range audio.Channels {
+		for i, x := range samples {
+			mixed[i] += x / float32(len(audio.Channels))
+		}
+	}
+	mono.Channels = [][]float32{mixed}
+	return mono
+}
+
+// Produces the normalized audio streams sent for recognition: one stream, or
+// one mono stream per channel in split mode. The input is not modified.
+func preprocess_audio(audio *WavAudio, cfg preprocessConfig) []*WavAudio {
+	rate := audio.SampleRate
+	if cfg.Rate > 0 {
+		rate = cfg.Rate
+	}
+	normalized := &WavAudio{SampleRate: rate, BitsPerSample: 16}
+	for _, samples := range audio.Channels {
+		normalized.Channels = append(normalized.Channels, resample(samples, audio.SampleRate, rate))
+	}
+	switch cfg.Channels {
+	case "mono":
+		return []*WavAudio{downmix(normalized)}
+	case "split":
+		var streams []*WavAudio
+		for _, samples := range normalized.Channels {
+			streams = append(streams, &WavAudio{SampleRate: rate, BitsPerSample: 16, Channels: [][]float32{samples}})
+		}
+		return streams
+	}
+	return []*WavAudio{normalized}
+}
+
+// Interleaves the results of separately recognized channels in the order
+// they were spoken, as a multi-channel recognition returns them
+func sort_results_by_end(results []*speechpb.SpeechRecognitionResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return get_seconds_from_duration(results[i].ResultEndTime) < get_seconds_from_duration(results[j].ResultEndTime)
+	})
+}
+
+// Writes the normalized streams next to the upload and transcribes them.
+// Split channels are recognized separately and their results tagged with
+// the channel they came from. Returns the locations of the normalized audio.
+func get_preprocessed_transcript(ctx context.Context, audio *WavAudio, cfg preprocessConfig, bucket, name string, adaptation *speechpb.SpeechAdaptation) (error, *speechpb.LongRunningRecognizeResponse, []string) {
+	streams := preprocess_audio(audio, cfg)
+	base := strings.TrimSuffix(name, path.Ext(name))
+	merged := &speechpb.LongRunningRecognizeResponse{}
+	var uris, failed []string
+	for i, stream := range streams {
+		suffix := ".normalized.wav"
+		if cfg.Channels == "split" {
+			suffix = fmt.Sprintf(".channel%d.wav", i+1)
+		}
+		outBucket, outName := artifact_location(bucket, name, suffix)
+		err := write_gcs_object(ctx, outBucket, outName, encode_wav(stream), "audio/wav")
+		if err != nil {
+			return err, nil, uris
+		}
+		uri := fmt.Sprintf("gs://%s/%s", outBucket, outName)
+		uris = append(uris, uri)
+		var resp *speechpb.LongRunningRecognizeResponse
+		if stream.Duration() > chunk_max_secs() {
+			err, resp = get_chunked_transcript(ctx, stream, bucket, base+suffix, adaptation)
+		} else {
+			err, resp = recognize_uri(ctx, uri, int32(stream.SampleRate), int32(len(stream.Channels)), adaptation)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", uri, err))
+		}
+		for _, result := range resp.GetResults() {
+			if cfg.Channels == "split" {
+				result.ChannelTag = int32(i + 1)
+			}
+			merged.Results = append(merged.Results, result)
+		}
+	}
+	if cfg.Channels == "split" {
+		sort_results_by_end(merged.Results)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("recognition failed for %s", strings.Join(failed, "; ")), merged, uris
+	}
+	return nil, merged, uris
+}
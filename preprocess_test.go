@@ -0,0 +1,144 @@
+package function
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// RMS of the samples away from the edges, where the filter has no history
+func interior_rms(samples []float32) float64 {
+	from, to := len(samples)/10, len(samples)*9/10
+	sum := 0.0
+	for _, x := range samples[from:to] {
+		sum += float64(x) * float64(x)
+	}
+	return math.Sqrt(sum / float64(to-from))
+}
+
+func TestResampleKeepsTone(t *testing.T) {
+	audio := make_test_tone(44100, 1, 1, 1000, 0.5)
+	out := resample(audio.Channels[0], 44100, 8000)
+	if len(out) != 8000 {
+		t.Fatalf("got %d samples, want 8000", len(out))
+	}
+	if rms := interior_rms(out); math.Abs(rms-0.5/math.Sqrt2) > 0.01 {
+		t.Errorf("1 kHz tone RMS after resampling = %.3f, want %.3f", rms, 0.5/math.Sqrt2)
+	}
+	crossings := 0
+	for i := 1; i < len(out); i++ {
+		if (out[i-1] < 0) != (out[i] < 0) {
+			crossings++
+		}
+	}
+	if crossings < 1990 || crossings > 2010 {
+		t.Errorf("got %d zero crossings, want about 2000", crossings)
+	}
+}
+
+func TestResampleRemovesContentAboveNyquist(t *testing.T) {
+	//5 kHz cannot be represented at 8 kHz and must not fold back to 3 kHz
+	audio := make_test_tone(44100, 1, 1, 5000, 0.5)
+	out := resample(audio.Channels[0], 44100, 8000)
+	if rms := interior_rms(out); rms > 0.01 {
+		t.Errorf("5 kHz tone RMS after resampling to 8 kHz = %.3f, want close to 0", rms)
+	}
+}
+
+func TestResampleUpsample(t *testing.T) {
+	audio := make_test_tone(8000, 1, 1, 440, 0.5)
+	out := resample(audio.Channels[0], 8000, 16000)
+	want := make_test_tone(16000, 1, 1, 440, 0.5).Channels[0]
+	for i := len(out) / 10; i < len(out)*9/10; i++ {
+		if math.Abs(float64(out[i]-want[i])) > 0.01 {
+			t.Fatalf("sample %d = %.4f, want %.4f", i, out[i], want[i])
+		}
+	}
+}
+
+func TestPreprocessAudio(t *testing.T) {
+	audio := make_test_tone(16000, 2, 1, 440, 0.5)
+	audio.BitsPerSample = 24
+	for i := range audio.Channels[1] {
+		audio.Channels[1][i] = 0
+	}
+	original := clone_audio(audio)
+
+	streams := preprocess_audio(audio, preprocessConfig{Rate: 8000, Channels: "keep"})
+	if len(streams) != 1 || len(streams[0].Channels) != 2 || streams[0].SampleRate != 8000 || streams[0].BitsPerSample != 16 {
+		t.Fatalf("keep: got %d streams, first %d channels at %d Hz/%d bits", len(streams), len(streams[0].Channels), streams[0].SampleRate, streams[0].BitsPerSample)
+	}
+
+	streams = preprocess_audio(audio, preprocessConfig{Channels: "mono"})
+	if len(streams) != 1 || len(streams[0].Channels) != 1 || streams[0].SampleRate != 16000 {
+		t.Fatalf("mono: got %d streams", len(streams))
+	}
+	if got, want := streams[0].Channels[0][100], audio.Channels[0][100]/2; got != want {
+		t.Errorf("mono sample = %v, want the average %v", got, want)
+	}
+
+	streams = preprocess_audio(audio, preprocessConfig{Rate: 8000, Channels: "split"})
+	if len(streams) != 2 || len(streams[0].Channels) != 1 || len(streams[1].Channels) != 1 {
+		t.Fatalf("split: got %d streams", len(streams))
+	}
+	if interior_rms(streams[1].Channels[0]) != 0 {
+		t.Errorf("split: second stream should hold the silent channel")
+	}
+
+	for c := range audio.Channels {
+		for i := range audio.Channels[c] {
+			if audio.Channels[c][i] != original.Channels[c][i] {
+				t.Fatalf("preprocess_audio modified its input")
+			}
+		}
+	}
+	if audio.SampleRate != 16000 || audio.BitsPerSample != 24 {
+		t.Fatalf("preprocess_audio modified its input format")
+	}
+}
+
+func TestGetPreprocessConfig(t *testing.T) {
+	t.Setenv("PREPROCESS_RATE", "")
+	t.Setenv("PREPROCESS_CHANNELS", "")
+	if _, enabled, err := get_preprocess_config(); enabled || err != nil {
+		t.Errorf("unset: enabled = %v, err = %v", enabled, err)
+	}
+	t.Setenv("PREPROCESS_RATE", "16000")
+	cfg, enabled, err := get_preprocess_config()
+	if !enabled || err != nil || cfg.Rate != 16000 || cfg.Channels != "keep" {
+		t.Errorf("rate only: got %+v, %v, %v", cfg, enabled, err)
+	}
+	t.Setenv("PREPROCESS_CHANNELS", "split")
+	if cfg, _, _ := get_preprocess_config(); cfg.Channels != "split" {
+		t.Errorf("channels = %q, want split", cfg.Channels)
+	}
+	t.Setenv("PREPROCESS_CHANNELS", "stereo")
+	if _, _, err := get_preprocess_config(); err == nil {
+		t.Errorf("expected an error for PREPROCESS_CHANNELS=stereo")
+	}
+	t.Setenv("PREPROCESS_CHANNELS", "")
+	t.Setenv("PREPROCESS_RATE", "fast")
+	if _, _, err := get_preprocess_config(); err == nil {
+		t.Errorf("expected an error for PREPROCESS_RATE=fast")
+	}
+}
+
+func TestSortResultsByEnd(t *testing.T) {
+	var results []*speechpb.SpeechRecognitionResult
+	for _, r := range []struct {
+		channel int32
+		end     float64
+	}{{1, 2}, {1, 9}, {2, 4}, {2, 9}, {2, 12}} {
+		results = append(results, &speechpb.SpeechRecognitionResult{ChannelTag: r.channel, ResultEndTime: seconds_to_duration(r.end)})
+	}
+	sort_results_by_end(results)
+	var order []int32
+	for _, r := range results {
+		order = append(order, r.ChannelTag)
+	}
+	if fmt.Sprint(order) != "[1 2 1 2 2]" {
+		t.Errorf("channels in order %v", order)
+	}
+}
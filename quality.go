@@ -0,0 +1,128 @@
+package function
+
+import (
+	"fmt"
+	"math"
+)
+
+// ChannelQuality describes the signal on one channel of the recording.
+// Levels are in dBFS.
+type ChannelQuality struct {
+	Channel            int     `json:"channel"`
+	Rmsdb              float64 `json:"rmsdb"`
+	Peakdb             float64 `json:"peakdb"`
+	Clippingpercentage float64 `json:"clippingpercentage"`
+	Snrdb              float64 `json:"snrdb"`
+	Dcoffset           float64 `json:"dcoffset"`
+	Dropouts           int     `json:"dropouts"`
+	Dropoutsecs        float64 `json:"dropoutsecs"`
+}
+
+// AudioQuality holds per-channel measurements and the reasons, if any, the
+// call was flagged as having poor audio.
+type AudioQuality struct {
+	Channels []ChannelQuality `json:"channels"`
+	Poor     bool             `json:"poor"`
+	Issues   []string         `json:"issues"`
+}
+
+const (
+	//Samples at or above this magnitude are counted as clipped
+	clipLevel = 0.99
+	//Samples below one 16-bit step are digital silence
+	dropoutLevel = 1.0 / 32768
+	//Digital silence shorter than this is not reported as a dropout
+	minDropoutSecs = 0.5
+	//Percentiles of frame levels taken as speech and noise for the SNR
+	snrSignalPercentile = 0.9
+	snrNoisePercentile  = 0.1
+)
+
+// Thresholds beyond which a channel is flagged
+const (
+	poorMinRmsDb       = -40.0
+	poorMaxClipping    = 1.0
+	poorMinSnrDb       = 15.0
+	poorMaxDcOffset    = 0.05
+	poorMaxDropoutRate = 0.05
+)
+
+func to_db(v float64) float64 {
+	return 20 * math.Log10(v+1e-9)
+}
+
+// Measures one channel's level, clipping, noise, DC offset and dropouts
+func channel_quality(samples []float32, rate, channel int) ChannelQuality {
+	q := ChannelQuality{Channel: channel}
+	if len(samples) == 0 {
+		return q
+	}
+	var sum, squares, peak float64
+	clipped, run := 0, 0
+	minRun := int(minDropoutSecs * float64(rate))
+	dropout := func() {
+		if run >= minRun {
+			q.Dropouts++
+			q.Dropoutsecs += float64(run) / float64(rate)
+		}
+		run = 0
+	}
+	for _, s := range samples {
+		x := float64(s)
+		a := math.Abs(x)
+		sum += x
+		squares += x * x
+		if a > peak {
+			peak = a
+		}
+		if a >= clipLevel {
+			clipped++
+		}
+		if a < dropoutLevel {
+			run++
+		} else {
+			dropout()
+		}
+	}
+	dropout()
+	n := float64(len(samples))
+	q.Dcoffset = sum / n
+	q.Rmsdb = to_db(math.Sqrt(squares / n))
+	q.Peakdb = to_db(peak)
+	q.Clippingpercentage = float64(clipped) * 100 / n
+	frame := int(vadFrameSecs * float64(rate))
+	if frame < 1 {
+		return q
+	}
+	levels := frame_levels(samples, frame)
+	q.Snrdb = percentile(levels, snrSignalPercentile) - percentile(levels, snrNoisePercentile)
+	return q
+}
+
+// Measures every channel and flags the call if any channel is too quiet,
+// clipped, noisy, offset or full of dropouts.
+func get_audio_quality(audio *WavAudio) AudioQuality {
+	quality := AudioQuality{}
+	duration := audio.Duration()
+	for c, samples := range audio.Channels {
+		q := channel_quality(samples, audio.SampleRate, c+1)
+		quality.Channels = append(quality.Channels, q)
+		if q.Rmsdb < poorMinRmsDb {
+			quality.Issues = append(quality.Issues, fmt.Sprintf("channel %d: level %.1f dBFS", q.Channel, q.Rmsdb))
+		}
+		if q.Clippingpercentage > poorMaxClipping {
+			quality.Issues = append(quality.Issues, fmt.Sprintf("channel %d: %.1f%% clipped", q.Channel, q.Clippingpercentage))
+		}
+		if q.Snrdb < poorMinSnrDb {
+			quality.Issues = append(quality.Issues, fmt.Sprintf("channel %d: SNR %.1f dB", q.Channel, q.Snrdb))
+		}
+		if math.Abs(q.Dcoffset) > poorMaxDcOffset {
+			quality.Issues = append(quality.Issues, fmt.Sprintf("channel %d: DC offset %.3f", q.Channel, q.Dcoffset))
+		}
+		if duration > 0 && q.Dropoutsecs > poorMaxDropoutRate*duration {
+			quality.Issues = append(quality.Issues, fmt.Sprintf("channel %d: %d dropouts, %.1fs", q.Channel, q.Dropouts, q.Dropoutsecs))
+		}
+	}
+	quality.Poor = len(quality.Issues) > 0
+	return quality
+}
@@ -0,0 +1,53 @@
+package function
+
+import (
+	"math"
+	"testing"
+)
+
+func TestChannelQuality(t *testing.T) {
+	audio := make_talk_audio(4, AudioSegment{1, 3})
+	q := channel_quality(audio.Channels[0], audio.SampleRate, 1)
+	if q.Peakdb > -10 || q.Peakdb < -11 {
+		t.Errorf("got peak %.1f dBFS, want about -10.5", q.Peakdb)
+	}
+	if q.Snrdb < 40 {
+		t.Errorf("got SNR %.1f dB, want at least 40", q.Snrdb)
+	}
+	if q.Clippingpercentage != 0 || q.Dropouts != 0 {
+		t.Errorf("got %.1f%% clipping and %d dropouts, want none", q.Clippingpercentage, q.Dropouts)
+	}
+}
+
+func TestChannelQualityTinyRate(t *testing.T) {
+	//Too few samples per second for an analysis frame
+	q := channel_quality([]float32{0.1, -0.1, 0.2}, 10, 1)
+	if q.Snrdb != 0 || q.Peakdb > -13 {
+		t.Errorf("got %+v", q)
+	}
+}
+
+func TestAudioQualityFlagsPoorChannels(t *testing.T) {
+	audio := make_talk_audio(4, AudioSegment{0, 4}, AudioSegment{0, 4})
+	//Channel 1 clips, channel 2 carries an offset and drops out for a second
+	for i := range audio.Channels[0] {
+		audio.Channels[0][i] = float32(math.Max(-1, math.Min(1, float64(audio.Channels[0][i])*5)))
+		audio.Channels[1][i] += 0.1
+	}
+	for i := 8000; i < 16000; i++ {
+		audio.Channels[1][i] = 0
+	}
+	quality := get_audio_quality(audio)
+	if !quality.Poor {
+		t.Fatalf("call not flagged as poor")
+	}
+	if quality.Channels[0].Clippingpercentage < poorMaxClipping {
+		t.Errorf("got %.1f%% clipping, want more than %.1f%%", quality.Channels[0].Clippingpercentage, poorMaxClipping)
+	}
+	if math.Abs(quality.Channels[1].Dcoffset-0.075) > 0.01 {
+		t.Errorf("got DC offset %.3f, want about 0.075", quality.Channels[1].Dcoffset)
+	}
+	if quality.Channels[1].Dropouts != 1 || math.Abs(quality.Channels[1].Dropoutsecs-1) > 0.01 {
+		t.Errorf("got %d dropouts, %.2fs, want 1 of 1s", quality.Channels[1].Dropouts, quality.Channels[1].Dropoutsecs)
+	}
+}
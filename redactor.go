@@ -0,0 +1,485 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	dlp "cloud.google.com/go/dlp/apiv2"
+	dlppb "google.golang.org/genproto/googleapis/privacy/dlp/v2"
+)
+
+// PIIFinding is a single piece of sensitive data located in a text.
+// Start and End are byte offsets into the inspected text.
+type PIIFinding struct {
+	InfoType   string
+	Likelihood string
+	Start      int
+	End        int
+}
+
+// RedactedSpan records where a redacted finding was spoken. It never holds
+// the redacted value itself.
+type RedactedSpan struct {
+	InfoType   string
+	Likelihood string
+	SpeakerTag int
+	StartSecs  float64
+	EndSecs    float64
+	//Indexes of the first and last word covered, when located is set
+	firstWord, lastWord int
+	located             bool
+}
+
+// RedactionSummary aggregates the redacted spans of one infoType and speaker
+// for auditing. StartSecs and EndSecs cover the first and last occurrence.
+type RedactionSummary struct {
+	Infotype   string  `json:"infotype"`
+	Count      int     `json:"count"`
+	Likelihood string  `json:"likelihood"`
+	Speakertag int     `json:"speakertag"`
+	StartSecs  float64 `json:"startSecs"`
+	EndSecs    float64 `json:"endSecs"`
+}
+
+// Redactor locates sensitive data in free text.
+type Redactor interface {
+	Inspect(ctx context.Context, text string) ([]PIIFinding, error)
+	Close() error
+}
+
+// Builds the redactor chain named by the REDACTORS environment variable,
+// e.g. "dlp", "local" or "dlp,local". Defaults to Cloud DLP only.
+func get_redactors(ctx context.Context) ([]Redactor, error) {
+	names := os.Getenv("REDACTORS")
+	if names == "" {
+		names = "dlp"
+	}
+	var redactors []Redactor
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "dlp":
+			client, err := dlp.NewClient(ctx)
+			if err != nil {
+				close_redactors(redactors)
+				return nil, err
+			}
+			redactors = append(redactors, &dlpRedactor{client: client})
+		case "local":
+			redactors = append(redactors, &localRedactor{})
+		default:
+			close_redactors(redactors)
+			return nil, fmt.Errorf("unknown redactor %q in REDACTORS", name)
+		}
+	}
+	return redactors, nil
+}
+
+func close_redactors(redactors []Redactor) {
+	for _, r := range redactors {
+		r.Close()
+	}
+}
+
+// Runs every redactor over the text in turn and masks what they find. Each
+// pass sees the output of the previous one, so a later redactor only reports
+// what the earlier ones missed.
+func redact_text(ctx context.Context, redactors []Redactor, text string) (string, []PIIFinding, error) {
+	var all []PIIFinding
+	for _, r := range redactors {
+		findings, err := r.Inspect(ctx, text)
+		if err != nil {
+			return text, all, err
+		}
+		text = mask_findings(text, findings)
+		all = append(all, findings...)
+	}
+	return text, all, nil
+}
+
+// Replaces every character covered by a finding with '*', the same masking
+// Cloud DLP applies with a CharacterMaskConfig. A multibyte character gets
+// one '*' per byte, so the masked text keeps the byte offsets later passes
+// and align_words rely on.
+func mask_findings(text string, findings []PIIFinding) string {
+	if len(findings) == 0 {
+		return text
+	}
+	masked := make([]bool, len(text))
+	for _, f := range findings {
+		for i := f.Start; i < f.End && i < len(text); i++ {
+			masked[i] = true
+		}
+	}
+	out := []byte(text)
+	for i := 0; i < len(text); {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		hidden := false
+		for j := i; j < i+size; j++ {
+			hidden = hidden || masked[j]
+		}
+		if hidden {
+			for j := i; j < i+size; j++ {
+				out[j] = '*'
+			}
+		}
+		i += size
+	}
+	return string(out)
+}
+
+// dlpRedactor inspects text with the Cloud DLP default infoTypes.
+type dlpRedactor struct {
+	client *dlp.Client
+}
+
+func (d *dlpRedactor) Inspect(ctx context.Context, text string) ([]PIIFinding, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	resp, err := d.client.InspectContent(ctx, &dlppb.InspectContentRequest{
+		Parent:        "projects/" + os.Getenv("GOOGLE_CLOUD_PROJECT"),
+		InspectConfig: &dlppb.InspectConfig{},
+		Item: &dlppb.ContentItem{
+			DataItem: &dlppb.ContentItem_Value{
+				Value: text,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var findings []PIIFinding
+	for _, f := range resp.GetResult().GetFindings() {
+		r := f.GetLocation().GetByteRange()
+		findings = append(findings, PIIFinding{
+			InfoType:   f.GetInfoType().GetName(),
+			Likelihood: f.GetLikelihood().String(),
+			Start:      int(r.GetStart()),
+			End:        int(r.GetEnd()),
+		})
+	}
+	return findings, nil
+}
+
+func (d *dlpRedactor) Close() error {
+	return d.client.Close()
+}
+
+// localRedactor detects common PII with regular expressions and validators.
+// It needs no network access, so it can stand in for DLP offline or run as
+// a second pass to catch what DLP missed.
+type localRedactor struct{}
+
+type piiDetector struct {
+	infoType   string
+	likelihood string
+	pattern    *regexp.Regexp
+	//Optional check on the match; text and start give access to context
+	valid func(match, text string, start int) bool
+}
+
+var localDetectors = []piiDetector{
+	{
+		infoType:   "CREDIT_CARD_NUMBER",
+		likelihood: "VERY_LIKELY",
+		pattern:    regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		valid: func(match, text string, start int) bool {
+			return luhn_valid(digits_only(match))
+		},
+	},
+	{
+		infoType:   "US_SOCIAL_SECURITY_NUMBER",
+		likelihood: "LIKELY",
+		pattern:    regexp.MustCompile(`\b\d{3}[- ]\d{2}[- ]\d{4}\b`),
+		valid: func(match, text string, start int) bool {
+			return ssn_valid(digits_only(match))
+		},
+	},
+	{
+		infoType:   "US_SOCIAL_SECURITY_NUMBER",
+		likelihood: "POSSIBLE",
+		pattern:    regexp.MustCompile(`\b\d{9}\b`),
+		valid: func(match, text string, start int) bool {
+			return ssn_valid(match) && has_context(text, start, "ssn", "social security", "social")
+		},
+	},
+	{
+		infoType:   "EMAIL_ADDRESS",
+		likelihood: "VERY_LIKELY",
+		pattern:    regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`),
+	},
+	{
+		infoType:   "PHONE_NUMBER",
+		likelihood: "LIKELY",
+		pattern:    regexp.MustCompile(`(?:\+?1[ .-]?)?(?:\(\d{3}\)|\b\d{3})[ .-]?\d{3}[ .-]\d{4}\b`),
+	},
+	{
+		infoType:   "STREET_ADDRESS",
+		likelihood: "LIKELY",
+		pattern: regexp.MustCompile(`\b\d{1,6}\s+(?:[A-Z][A-Za-z'.-]*\s+){1,3}` +
+			`(?i:(?:street|avenue|road|boulevard|lane|drive|court|way|place|terrace|circle|highway|parkway)\b|` +
+			`(?:st|ave|rd|blvd|ln|dr|ct|pl|cir|hwy|pkwy)\b\.?)`),
+	},
+	{
+		infoType:   "DATE_OF_BIRTH",
+		likelihood: "LIKELY",
+		pattern:    regexp.MustCompile(`\b(?:0?[1-9]|1[0-2])[/.-](?:0?[1-9]|[12]\d|3[01])[/.-](?:19|20)?\d{2}\b`),
+		valid: func(match, text string, start int) bool {
+			return has_context(text, start, "birth", "born", "dob", "d.o.b")
+		},
+	},
+	{
+		infoType:   "DATE_OF_BIRTH",
+		likelihood: "LIKELY",
+		pattern: regexp.MustCompile(`(?i)\b(?:jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?|sep(?:t(?:ember)?)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)\.?` +
+			`\s+(?:0?[1-9]|[12]\d|3[01])(?:st|nd|rd|th)?,?\s+(?:19|20)\d{2}\b`),
+		valid: func(match, text string, start int) bool {
+			return has_context(text, start, "birth", "born", "dob", "d.o.b")
+		},
+	},
+}
+
+func (l *localRedactor) Inspect(ctx context.Context, text string) ([]PIIFinding, error) {
+	return detect_pii(text), nil
+}
+
+func (l *localRedactor) Close() error {
+	return nil
+}
+
+// Runs the local detectors and drops findings that overlap a longer one
+func detect_pii(text string) []PIIFinding {
+	var candidates []PIIFinding
+	for _, d := range localDetectors {
+		for _, loc := range d.pattern.FindAllStringIndex(text, -1) {
+			match := text[loc[0]:loc[1]]
+			if d.valid != nil && !d.valid(match, text, loc[0]) {
+				continue
+			}
+			candidates = append(candidates, PIIFinding{
+				InfoType:   d.infoType,
+				Likelihood: d.likelihood,
+				Start:      loc[0],
+				End:        loc[1],
+			})
+		}
+	}
+	//Longest first, so shorter overlapping matches are the ones discarded
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].End-candidates[i].Start > candidates[j].End-candidates[j].Start
+	})
+	var findings []PIIFinding
+	for _, c := range candidates {
+		overlaps := false
+		for _, f := range findings {
+			if c.Start < f.End && f.Start < c.End {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			findings = append(findings, c)
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+	return findings
+}
+
+func digits_only(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Luhn checksum used by payment card numbers
+func luhn_valid(number string) bool {
+	if len(number) < 13 || len(number) > 19 {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Rejects the area, group and serial numbers the SSA never issues
+func ssn_valid(number string) bool {
+	if len(number) != 9 {
+		return false
+	}
+	area, group, serial := number[0:3], number[3:5], number[5:9]
+	if area == "000" || area == "666" || area[0] == '9' {
+		return false
+	}
+	return group != "00" && serial != "0000"
+}
+
+// Reports whether any keyword appears shortly before start
+func has_context(text string, start int, keywords ...string) bool {
+	from := start - 40
+	if from < 0 {
+		from = 0
+	}
+	window := strings.ToLower(text[from:start])
+	for _, k := range keywords {
+		if strings.Contains(window, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Records a finding against the words it covers. Findings outside the word
+// list, e.g. in entity names, carry no speaker or timing.
+func add_redacted_span(record *TranscriptRecord, f PIIFinding, words []int) {
+	span := RedactedSpan{InfoType: f.InfoType, Likelihood: f.Likelihood}
+	for i, w := range words {
+		word := record.Words[w]
+		if i == 0 {
+			span.SpeakerTag = word.SpeakerTag
+			span.StartSecs = word.StartSecs
+			span.firstWord, span.located = w, true
+		}
+		if w > span.lastWord {
+			span.lastWord = w
+		}
+		if word.EndSecs > span.EndSecs {
+			span.EndSecs = word.EndSecs
+		}
+	}
+	record.redactedSpans = append(record.redactedSpans, span)
+}
+
+// Finds the byte offset of each word in the transcript, or -1 if the word
+// could not be located. Words appear in the transcript in the same order, so
+// a moving cursor keeps repeated words apart.
+func align_words(transcript string, record *TranscriptRecord) []int {
+	offsets := make([]int, len(record.Words))
+	cursor := 0
+	for i, w := range record.Words {
+		pos := strings.Index(transcript[cursor:], w.Word)
+		if w.Word == "" || pos < 0 {
+			offsets[i] = -1
+			continue
+		}
+		offsets[i] = cursor + pos
+		cursor += pos + len(w.Word)
+	}
+	return offsets
+}
+
+// Returns the indexes of the words overlapping a finding in the transcript
+func finding_words(f PIIFinding, offsets []int, record *TranscriptRecord) []int {
+	var words []int
+	for i, off := range offsets {
+		if off >= 0 && off < f.End && f.Start < off+len(record.Words[i].Word) {
+			words = append(words, i)
+		}
+	}
+	return words
+}
+
+// Drops the spans that repeat a finding. The transcript, word and spoken
+// passes find the same value over overlapping words; those spans are merged.
+// Sentences, alternatives and entities repeat text of the transcript but
+// cannot be located in it, so their spans only count for an infoType that
+// no located span has.
+func dedupe_redacted_spans(spans []RedactedSpan) []RedactedSpan {
+	var kept []RedactedSpan
+	locatedTypes := map[string]bool{}
+	for _, span := range spans {
+		if !span.located {
+			continue
+		}
+		locatedTypes[span.InfoType] = true
+		merged := false
+		for i := range kept {
+			k := &kept[i]
+			if k.InfoType != span.InfoType || span.lastWord < k.firstWord || k.lastWord < span.firstWord {
+				continue
+			}
+			if span.firstWord < k.firstWord {
+				k.firstWord, k.StartSecs, k.SpeakerTag = span.firstWord, span.StartSecs, span.SpeakerTag
+			}
+			if span.lastWord > k.lastWord {
+				k.lastWord = span.lastWord
+			}
+			if span.EndSecs > k.EndSecs {
+				k.EndSecs = span.EndSecs
+			}
+			if dlppb.Likelihood_value[span.Likelihood] > dlppb.Likelihood_value[k.Likelihood] {
+				k.Likelihood = span.Likelihood
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			kept = append(kept, span)
+		}
+	}
+	for _, span := range spans {
+		if !span.located && !locatedTypes[span.InfoType] {
+			kept = append(kept, span)
+		}
+	}
+	return kept
+}
+
+// Groups the redacted spans by infoType and speaker, keeping the highest
+// likelihood seen.
+func summarize_redactions(spans []RedactedSpan) []RedactionSummary {
+	var summaries []RedactionSummary
+	index := map[string]int{}
+	for _, span := range spans {
+		key := fmt.Sprintf("%s/%d", span.InfoType, span.SpeakerTag)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(summaries)
+			summaries = append(summaries, RedactionSummary{
+				Infotype:   span.InfoType,
+				Likelihood: span.Likelihood,
+				Speakertag: span.SpeakerTag,
+				StartSecs:  span.StartSecs,
+				EndSecs:    span.EndSecs,
+			})
+			i = len(summaries) - 1
+		}
+		s := &summaries[i]
+		s.Count++
+		if dlppb.Likelihood_value[span.Likelihood] > dlppb.Likelihood_value[s.Likelihood] {
+			s.Likelihood = span.Likelihood
+		}
+		if span.StartSecs < s.StartSecs {
+			s.StartSecs = span.StartSecs
+		}
+		if span.EndSecs > s.EndSecs {
+			s.EndSecs = span.EndSecs
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Infotype != summaries[j].Infotype {
+			return summaries[i].Infotype < summaries[j].Infotype
+		}
+		return summaries[i].Speakertag < summaries[j].Speakertag
+	})
+	return summaries
+}
@@ -0,0 +1,115 @@
+package function
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLocalRedactor(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"my SSN is 123-45-6789.", "my SSN is ***********."},
+		{"my social is 123456789", "my social is *********"},
+		{"order 123456789 shipped", "order 123456789 shipped"},
+		{"card 4111 1111 1111 1111 please", "card ******************* please"},
+		{"card 4111 1111 1111 1112 please", "card 4111 1111 1111 1112 please"},
+		{"call me at 409-866-5088", "call me at ************"},
+		{"or (409) 866-5088", "or **************"},
+		{"email randall.thomas@example.com now", "email ************************** now"},
+		{"I live at 6800 Madison Avenue.", "I live at *******************."},
+		{"I was born on 04/12/1980", "I was born on **********"},
+		{"date of birth March 3rd, 1975", "date of birth ***************"},
+		{"delivery on 04/12/2022", "delivery on 04/12/2022"},
+	}
+	for _, tt := range tests {
+		got, _, err := redact_text(context.Background(), []Redactor{&localRedactor{}}, tt.text)
+		if err != nil {
+			t.Fatalf("redact_text: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestDetectPIIInfoTypes(t *testing.T) {
+	findings := detect_pii("SSN 123-45-6789, phone 409-866-5088")
+	if len(findings) != 2 {
+		t.Fatalf("got %d findings, want 2", len(findings))
+	}
+	if findings[0].InfoType != "US_SOCIAL_SECURITY_NUMBER" {
+		t.Errorf("got %s, want US_SOCIAL_SECURITY_NUMBER", findings[0].InfoType)
+	}
+	if findings[1].InfoType != "PHONE_NUMBER" {
+		t.Errorf("got %s, want PHONE_NUMBER", findings[1].InfoType)
+	}
+}
+
+func TestMaskFindingsMultibyte(t *testing.T) {
+	text := "née 123"
+	got := mask_findings(text, []PIIFinding{{Start: 0, End: 4}})
+	if want := "**** 123"; got != want || len(got) != len(text) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	//A second pass over the masked text still finds the digits where they are
+	got = mask_findings(got, []PIIFinding{{Start: strings.Index(text, "123"), End: len(text)}})
+	if want := "**** ***"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRedactionSummary(t *testing.T) {
+	record := TranscriptRecord{}
+	for i, w := range strings.Fields("call 409-866-5088 or 409-866-5089 SSN 123-45-6789") {
+		record.Words = append(record.Words, struct {
+			Word       string  `json:"word"`
+			StartSecs  float64 `json:"startSecs"`
+			EndSecs    float64 `json:"endSecs"`
+			SpeakerTag int     `json:"speakertag"`
+			Confidence float64 `json:"confidence"`
+		}{Word: w, StartSecs: float64(i), EndSecs: float64(i) + 0.5, SpeakerTag: 2})
+	}
+	record.Transcript = "call 409-866-5088 or 409-866-5089 SSN 123-45-6789"
+	//The sentence repeats the transcript and must not be counted again
+	record.Sentences = append(record.Sentences, struct {
+		Sentence  string  `json:"sentence"`
+		Sentiment float32 `json:"sentiment"`
+		Magnitude float32 `json:"magnitude"`
+	}{Sentence: record.Transcript})
+	if err := redact_record(context.Background(), []Redactor{&localRedactor{}}, &record); err != nil {
+		t.Fatalf("redact_record: %v", err)
+	}
+	if len(record.Redactions) != 2 {
+		t.Fatalf("got %d summaries, want 2: %+v", len(record.Redactions), record.Redactions)
+	}
+	phone := record.Redactions[0]
+	if phone.Infotype != "PHONE_NUMBER" || phone.Count != 2 || phone.Speakertag != 2 {
+		t.Errorf("got %+v, want 2 PHONE_NUMBER findings for speaker 2", phone)
+	}
+	if ssn := record.Redactions[1]; ssn.Infotype != "US_SOCIAL_SECURITY_NUMBER" || ssn.Count != 1 {
+		t.Errorf("got %+v, want 1 US_SOCIAL_SECURITY_NUMBER finding", ssn)
+	}
+	if phone.StartSecs != 1 || phone.EndSecs != 3.5 {
+		t.Errorf("got range %v-%v, want 1-3.5", phone.StartSecs, phone.EndSecs)
+	}
+	if strings.Contains(record.Transcript, "409") {
+		t.Errorf("transcript not redacted: %s", record.Transcript)
+	}
+}
+
+func TestDedupeRedactedSpans(t *testing.T) {
+	spans := []RedactedSpan{
+		{InfoType: "PHONE_NUMBER", Likelihood: "LIKELY", StartSecs: 1, EndSecs: 3, firstWord: 1, lastWord: 3, located: true},
+		{InfoType: "PHONE_NUMBER", Likelihood: "VERY_LIKELY", StartSecs: 2, EndSecs: 2.5, firstWord: 2, lastWord: 2, located: true},
+		{InfoType: "PHONE_NUMBER", StartSecs: 8, EndSecs: 9, firstWord: 8, lastWord: 9, located: true},
+		{InfoType: "PHONE_NUMBER"},
+		{InfoType: "EMAIL_ADDRESS"},
+	}
+	got := dedupe_redacted_spans(spans)
+	if len(got) != 3 || got[0].Likelihood != "VERY_LIKELY" || got[0].StartSecs != 1 || got[0].EndSecs != 3 || got[1].StartSecs != 8 || got[2].InfoType != "EMAIL_ADDRESS" {
+		t.Errorf("got %+v", got)
+	}
+}
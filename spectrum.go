@@ -0,0 +1,147 @@
+package function
+
+import (
+	"math"
+	"math/bits"
+	"math/cmplx"
+)
+
+// Rate the audio is reduced to before spectral analysis. Everything the
+// analysis looks at lies well below its Nyquist frequency.
+const analysisRate = 8000
+
+const (
+	//Frame length and hop of the fingerprint hashes. The large overlap keeps
+	//hashes similar when the same audio starts at a different offset.
+	hashFrameSecs = 0.2
+	hashHopSecs   = 0.025
+	//Band edges for the 33 log-spaced bands behind the 32 hash bits
+	hashMinHz = 300.0
+	hashMaxHz = 2000.0
+	hashBands = 33
+)
+
+// In-place iterative radix-2 FFT; len(x) must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	shift := 64 - uint(bits.Len(uint(n))-1)
+	for i := 0; i < n; i++ {
+		j := int(bits.Reverse64(uint64(i)) >> shift)
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+func next_pow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// Mixes all channels to mono and reduces the rate to about analysisRate by
+// averaging blocks of samples. Returns the samples and their rate.
+func analysis_mono(audio *WavAudio) ([]float32, int) {
+	if len(audio.Channels) == 0 {
+		return nil, audio.SampleRate
+	}
+	factor := audio.SampleRate / analysisRate
+	if factor < 1 {
+		factor = 1
+	}
+	frames := len(audio.Channels[0]) / factor
+	mono := make([]float32, frames)
+	scale := float32(factor * len(audio.Channels))
+	for i := range mono {
+		var sum float32
+		for _, samples := range audio.Channels {
+			for _, x := range samples[i*factor : (i+1)*factor] {
+				sum += x
+			}
+		}
+		mono[i] = sum / scale
+	}
+	return mono, audio.SampleRate / factor
+}
+
+// Energy of each hash band in every analysis frame, using a Hann window
+func band_energies(samples []float32, rate int) [][]float64 {
+	frame := int(hashFrameSecs * float64(rate))
+	hop := int(hashHopSecs * float64(rate))
+	//Rates this low cannot hold a frame, and the frames would never advance
+	if frame < 2 || hop < 1 {
+		return nil
+	}
+	size := next_pow2(frame)
+	edges := make([]int, hashBands+1)
+	for b := range edges {
+		hz := hashMinHz * math.Pow(hashMaxHz/hashMinHz, float64(b)/hashBands)
+		edges[b] = int(hz * float64(size) / float64(rate))
+	}
+	window := make([]float64, frame)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frame-1))
+	}
+	var energies [][]float64
+	buf := make([]complex128, size)
+	for start := 0; start+frame <= len(samples); start += hop {
+		for i := range buf {
+			buf[i] = 0
+		}
+		for i := 0; i < frame; i++ {
+			buf[i] = complex(float64(samples[start+i])*window[i], 0)
+		}
+		fft(buf)
+		bands := make([]float64, hashBands)
+		for b := 0; b < hashBands; b++ {
+			for k := edges[b]; k < edges[b+1] || k == edges[b]; k++ {
+				bands[b] += real(buf[k])*real(buf[k]) + imag(buf[k])*imag(buf[k])
+			}
+		}
+		energies = append(energies, bands)
+	}
+	return energies
+}
+
+// Computes a 32-bit hash per analysis frame from the sign of the energy
+// differences between neighbouring bands and frames (Haitsma and Kalker).
+// The hashes of the first frame are zero.
+func frame_hashes(energies [][]float64) []uint32 {
+	hashes := make([]uint32, len(energies))
+	for n := 1; n < len(energies); n++ {
+		var h uint32
+		for m := 0; m < hashBands-1; m++ {
+			d := energies[n][m] - energies[n][m+1] - (energies[n-1][m] - energies[n-1][m+1])
+			if d > 0 {
+				h |= 1 << uint(m)
+			}
+		}
+		hashes[n] = h
+	}
+	return hashes
+}
+
+// Share of differing bits between two equally long runs of hashes
+func bit_error_rate(a, b []uint32) float64 {
+	if len(a) == 0 {
+		return 1
+	}
+	errors := 0
+	for i := range a {
+		errors += bits.OnesCount32(a[i] ^ b[i])
+	}
+	return float64(errors) / float64(32*len(a))
+}
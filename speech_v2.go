@@ -0,0 +1,262 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// SpeechV2Config selects the Speech-to-Text v2 recognizer and the features
+// requested for a call. Recognizer is a full resource name,
+// projects/<project>/locations/<location>/recognizers/<id>; the id "_" uses
+// no stored recognizer, so Model and LanguageCodes must be given. Features
+// are RecognitionFeatures fields in their JSON form and override the
+// defaults, which match the v1 request.
+type SpeechV2Config struct {
+	Recognizer    string                 `json:"recognizer"`
+	Model         string                 `json:"model"`
+	LanguageCodes []string               `json:"languageCodes"`
+	Features      map[string]interface{} `json:"features"`
+}
+
+// How often a BatchRecognize operation is polled
+const speechV2PollInterval = 5 * time.Second
+
+// Google Speech-to-Text v2 BatchRecognize over REST, with the transcript
+// returned inline. Long recordings are handled by the service, so no local
+// chunking is done.
+type speechV2Transcriber struct {
+	config     SpeechV2Config
+	adaptation AdaptationConfig
+	//Endpoint and client are replaced in tests
+	endpoint string
+	client   *http.Client
+	poll     time.Duration
+}
+
+// Fills in the recognizer and model from SPEECH_V2_RECOGNIZER and the
+// project's default recognizer when the tenant leaves them out
+func new_speech_v2_transcriber(cfg SpeechV2Config, adaptation AdaptationConfig) (*speechV2Transcriber, error) {
+	if cfg.Recognizer == "" {
+		cfg.Recognizer = os.Getenv("SPEECH_V2_RECOGNIZER")
+	}
+	if cfg.Recognizer == "" {
+		cfg.Recognizer = fmt.Sprintf("projects/%s/locations/global/recognizers/_", os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	}
+	parts := strings.Split(cfg.Recognizer, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "recognizers" {
+		return nil, fmt.Errorf("invalid recognizer %q", cfg.Recognizer)
+	}
+	if parts[5] == "_" {
+		if cfg.Model == "" {
+			cfg.Model = "telephony"
+		}
+		if len(cfg.LanguageCodes) == 0 {
+			cfg.LanguageCodes = []string{"en-US"}
+		}
+	}
+	endpoint := "https://speech.googleapis.com/v2/"
+	if parts[3] != "global" {
+		endpoint = fmt.Sprintf("https://%s-speech.googleapis.com/v2/", parts[3])
+	}
+	return &speechV2Transcriber{config: cfg, adaptation: adaptation, endpoint: endpoint, poll: speechV2PollInterval}, nil
+}
+
+// Builds the BatchRecognize request body for one file
+func (s *speechV2Transcriber) request(uri string) map[string]interface{} {
+	features := map[string]interface{}{
+		"enableWordTimeOffsets":      true,
+		"enableWordConfidence":       true,
+		"enableAutomaticPunctuation": true,
+		"multiChannelMode":           "SEPARATE_RECOGNITION_PER_CHANNEL",
+	}
+	if n := max_alternatives(); n > 1 {
+		features["maxAlternatives"] = n
+	}
+	for k, v := range s.config.Features {
+		features[k] = v
+	}
+	config := map[string]interface{}{
+		"autoDecodingConfig": map[string]interface{}{},
+		"features":           features,
+	}
+	if s.config.Model != "" {
+		config["model"] = s.config.Model
+	}
+	if len(s.config.LanguageCodes) > 0 {
+		config["languageCodes"] = s.config.LanguageCodes
+	}
+	if adaptation := speech_adaptation_v2(s.adaptation); adaptation != nil {
+		config["adaptation"] = adaptation
+	}
+	return map[string]interface{}{
+		"config":                  config,
+		"files":                   []map[string]string{{"uri": uri}},
+		"recognitionOutputConfig": map[string]interface{}{"inlineResponseConfig": map[string]interface{}{}},
+	}
+}
+
+type speechV2Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type speechV2Results struct {
+	Results []struct {
+		Alternatives []struct {
+			Transcript string  `json:"transcript"`
+			Confidence float32 `json:"confidence"`
+			Words      []struct {
+				StartOffset string  `json:"startOffset"`
+				EndOffset   string  `json:"endOffset"`
+				Word        string  `json:"word"`
+				Confidence  float32 `json:"confidence"`
+			} `json:"words"`
+		} `json:"alternatives"`
+		ChannelTag      int32  `json:"channelTag"`
+		ResultEndOffset string `json:"resultEndOffset"`
+		LanguageCode    string `json:"languageCode"`
+	} `json:"results"`
+}
+
+type speechV2Operation struct {
+	Name     string          `json:"name"`
+	Done     bool            `json:"done"`
+	Error    *speechV2Status `json:"error"`
+	Response struct {
+		Results map[string]struct {
+			Error *speechV2Status `json:"error"`
+			//Older API versions put the transcript at the top level
+			Transcript   *speechV2Results `json:"transcript"`
+			InlineResult struct {
+				Transcript *speechV2Results `json:"transcript"`
+			} `json:"inlineResult"`
+		} `json:"results"`
+	} `json:"response"`
+}
+
+// Parses a protobuf JSON duration such as "12.340s"
+func parse_offset(offset string) float64 {
+	if offset == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(offset)
+	if err != nil {
+		return 0
+	}
+	return d.Seconds()
+}
+
+// Maps v2 results into the v1 response parse_transcript reads
+func v2_to_v1(results *speechV2Results) *speechpb.LongRunningRecognizeResponse {
+	response := &speechpb.LongRunningRecognizeResponse{}
+	for _, r := range results.Results {
+		if len(r.Alternatives) == 0 {
+			continue
+		}
+		result := &speechpb.SpeechRecognitionResult{
+			ChannelTag:    r.ChannelTag,
+			ResultEndTime: seconds_to_duration(parse_offset(r.ResultEndOffset)),
+			LanguageCode:  r.LanguageCode,
+		}
+		for _, a := range r.Alternatives {
+			alt := &speechpb.SpeechRecognitionAlternative{Transcript: a.Transcript, Confidence: a.Confidence}
+			for _, w := range a.Words {
+				alt.Words = append(alt.Words, &speechpb.WordInfo{
+					Word:       w.Word,
+					StartTime:  seconds_to_duration(parse_offset(w.StartOffset)),
+					EndTime:    seconds_to_duration(parse_offset(w.EndOffset)),
+					Confidence: w.Confidence,
+				})
+			}
+			result.Alternatives = append(result.Alternatives, alt)
+		}
+		response.Results = append(response.Results, result)
+	}
+	return response
+}
+
+func (s *speechV2Transcriber) call(ctx context.Context, method, url string, body interface{}, out interface{}) error {
+	reader := bytes.NewReader(nil)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (s *speechV2Transcriber) Transcribe(ctx context.Context, job TranscriptionJob) (*speechpb.LongRunningRecognizeResponse, error) {
+	if s.client == nil {
+		client, _, err := htransport.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	uri := fmt.Sprintf("gs://%s/%s", job.Bucket, job.Name)
+	op := &speechV2Operation{}
+	err := s.call(ctx, http.MethodPost, s.endpoint+s.config.Recognizer+":batchRecognize", s.request(uri), op)
+	if err != nil {
+		return nil, err
+	}
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.poll):
+		}
+		name := op.Name
+		op = &speechV2Operation{}
+		if err := s.call(ctx, http.MethodGet, s.endpoint+name, nil, op); err != nil {
+			return nil, err
+		}
+	}
+	if op.Error != nil {
+		return nil, fmt.Errorf("batch recognition failed: %s", op.Error.Message)
+	}
+	file, ok := op.Response.Results[uri]
+	if !ok {
+		return nil, fmt.Errorf("no result for %s", uri)
+	}
+	if file.Error != nil && file.Error.Code != 0 {
+		return nil, fmt.Errorf("recognition of %s failed: %s", uri, file.Error.Message)
+	}
+	results := file.InlineResult.Transcript
+	if results == nil {
+		results = file.Transcript
+	}
+	if results == nil {
+		return nil, fmt.Errorf("no transcript for %s", uri)
+	}
+	return v2_to_v1(results), nil
+}
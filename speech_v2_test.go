@@ -0,0 +1,109 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const v2Results = `{"results": [
+	{"alternatives": [{"transcript": "Thank you for calling.", "confidence": 0.9, "words": [
+		{"startOffset": "0.500s", "endOffset": "0.800s", "word": "Thank", "confidence": 0.9},
+		{"startOffset": "0.800s", "endOffset": "1s", "word": "you", "confidence": 0.9},
+		{"startOffset": "1s", "endOffset": "1.200s", "word": "for", "confidence": 0.8},
+		{"endOffset": "1.700s", "startOffset": "1.200s", "word": "calling.", "confidence": 0.95}]}],
+	 "channelTag": 1, "resultEndOffset": "1.900s", "languageCode": "en-us"},
+	{"alternatives": [{"transcript": " Hi.", "confidence": 0.8, "words": [
+		{"startOffset": "2.100s", "endOffset": "2.400s", "word": "Hi.", "confidence": 0.8}]}],
+	 "channelTag": 2, "resultEndOffset": "2.500s", "languageCode": "en-us"}]}`
+
+func TestSpeechV2Transcriber(t *testing.T) {
+	var request map[string]interface{}
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/projects/p/locations/us/recognizers/calls:batchRecognize":
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &request)
+			w.Write([]byte(`{"name": "projects/p/locations/us/operations/42"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/projects/p/locations/us/operations/42":
+			polls++
+			if polls < 2 {
+				w.Write([]byte(`{"name": "projects/p/locations/us/operations/42", "done": false}`))
+				return
+			}
+			w.Write([]byte(`{"name": "projects/p/locations/us/operations/42", "done": true, "response": {"results": {"gs://audio/calls/a.wav": {"inlineResult": {"transcript": ` + v2Results + `}}}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	transcriber, err := new_speech_v2_transcriber(SpeechV2Config{
+		Recognizer: "projects/p/locations/us/recognizers/calls",
+		Features:   map[string]interface{}{"profanityFilter": true, "enableAutomaticPunctuation": false},
+	}, AdaptationConfig{Phrases: []PhraseHint{{Value: "Chromecast"}}, PhraseSets: []string{"projects/p/locations/us/phraseSets/catalog"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transcriber.endpoint != "https://us-speech.googleapis.com/v2/" {
+		t.Errorf("endpoint = %s", transcriber.endpoint)
+	}
+	transcriber.endpoint, transcriber.client, transcriber.poll = server.URL+"/v2/", server.Client(), 0
+	resp, err := transcriber.Transcribe(context.Background(), TranscriptionJob{Bucket: "audio", Name: "calls/a.wav"})
+	if err != nil {
+		t.Fatalf("Transcribe: %v", err)
+	}
+
+	config := request["config"].(map[string]interface{})
+	features := config["features"].(map[string]interface{})
+	if features["profanityFilter"] != true || features["enableAutomaticPunctuation"] != false || features["enableWordTimeOffsets"] != true || features["multiChannelMode"] != "SEPARATE_RECOGNITION_PER_CHANNEL" {
+		t.Errorf("features = %v", features)
+	}
+	sets := config["adaptation"].(map[string]interface{})["phraseSets"].([]interface{})
+	if len(sets) != 2 || sets[1].(map[string]interface{})["phraseSet"] != "projects/p/locations/us/phraseSets/catalog" {
+		t.Errorf("adaptation phrase sets = %v", sets)
+	}
+	if _, ok := config["model"]; ok {
+		t.Errorf("a stored recognizer's model should not be overridden")
+	}
+	files := request["files"].([]interface{})
+	if files[0].(map[string]interface{})["uri"] != "gs://audio/calls/a.wav" {
+		t.Errorf("files = %v", files)
+	}
+
+	record := TranscriptRecord{}
+	if err := parse_transcript(resp, &record); err != nil {
+		t.Fatalf("parse_transcript: %v", err)
+	}
+	if record.Transcript != "Thank you for calling. Hi." || len(record.Words) != 5 || record.Duration != 2.5 {
+		t.Errorf("got %q, %d words, %vs", record.Transcript, len(record.Words), record.Duration)
+	}
+	if w := record.Words[3]; w.StartSecs != 1.2 || w.EndSecs != 1.7 || w.SpeakerTag != 1 {
+		t.Errorf("fourth word = %+v", w)
+	}
+	if record.Words[4].SpeakerTag != 2 {
+		t.Errorf("last word from speaker %d, want 2", record.Words[4].SpeakerTag)
+	}
+}
+
+func TestSpeechV2FileError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "op", "done": true, "response": {"results": {"gs://audio/a.wav": {"error": {"code": 3, "message": "audio too long"}}}}}`))
+	}))
+	defer server.Close()
+	transcriber, _ := new_speech_v2_transcriber(SpeechV2Config{Recognizer: "projects/p/locations/global/recognizers/_"}, AdaptationConfig{})
+	if transcriber.config.Model != "telephony" || len(transcriber.config.LanguageCodes) != 1 {
+		t.Errorf("default recognizer without model/language: %+v", transcriber.config)
+	}
+	transcriber.endpoint, transcriber.client = server.URL+"/v2/", server.Client()
+	if _, err := transcriber.Transcribe(context.Background(), TranscriptionJob{Bucket: "audio", Name: "a.wav"}); err == nil {
+		t.Errorf("expected the file's error to be returned")
+	}
+	if _, err := new_speech_v2_transcriber(SpeechV2Config{Recognizer: "calls"}, AdaptationConfig{}); err == nil {
+		t.Errorf("expected an error for a recognizer that is not a resource name")
+	}
+}
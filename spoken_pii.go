@@ -0,0 +1,297 @@
+package function
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// spokenToken is one token of the normalized word stream. Start and End are
+// byte offsets into the normalized text; FirstWord and LastWord index the
+// recognized words the token was built from.
+type spokenToken struct {
+	Text      string
+	Kind      string
+	Start     int
+	End       int
+	FirstWord int
+	LastWord  int
+}
+
+const (
+	tokenWord    = "word"
+	tokenDigits  = "digits"
+	tokenLetters = "letters"
+)
+
+var digitWords = map[string]string{
+	"zero": "0", "oh": "0", "o": "0", "one": "1", "two": "2", "three": "3",
+	"four": "4", "five": "5", "six": "6", "seven": "7", "eight": "8", "nine": "9",
+}
+
+var teenWords = map[string]string{
+	"ten": "10", "eleven": "11", "twelve": "12", "thirteen": "13", "fourteen": "14",
+	"fifteen": "15", "sixteen": "16", "seventeen": "17", "eighteen": "18", "nineteen": "19",
+}
+
+var tensWords = map[string]string{
+	"twenty": "2", "thirty": "3", "forty": "4", "fifty": "5",
+	"sixty": "6", "seventy": "7", "eighty": "8", "ninety": "9",
+}
+
+// Minimum run of single letters treated as spelling rather than the words
+// "a" or "I".
+const minSpelledLetters = 3
+
+// Minimum run of digits reported as a DIGIT_SEQUENCE when no other detector
+// claims it.
+const minDigitSequence = 7
+
+// Strips the punctuation ASR attaches to words, e.g. "r." or "b,"
+func clean_spoken_word(word string) string {
+	return strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+		return unicode.IsPunct(r) && r != '-'
+	}))
+}
+
+// Reports whether the word is written digits such as "409" or "409-866-5088"
+func is_digit_word(word string) bool {
+	if word == "" {
+		return false
+	}
+	digits := 0
+	for _, r := range word {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r == '-' || r == '.':
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// Converts the number words starting at words[i] into digits. Returns the
+// digits and how many words were consumed, or 0 if words[i] is not a number.
+func spoken_digits(words []string, i int) (string, int) {
+	w := words[i]
+	if is_digit_word(w) {
+		return digits_only(w), 1
+	}
+	if w == "double" || w == "triple" {
+		if i+1 < len(words) {
+			if d, ok := digitWords[words[i+1]]; ok {
+				if w == "double" {
+					return d + d, 2
+				}
+				return d + d + d, 2
+			}
+		}
+		return "", 0
+	}
+	if d, ok := teenWords[w]; ok {
+		return with_hundred(words, i+1, d, 1)
+	}
+	if t, ok := tensWords[w]; ok {
+		if i+1 < len(words) {
+			if d, ok := digitWords[words[i+1]]; ok && d != "0" {
+				return with_hundred(words, i+2, t+d, 2)
+			}
+		}
+		return with_hundred(words, i+1, t+"0", 1)
+	}
+	if d, ok := digitWords[w]; ok {
+		return with_hundred(words, i+1, d, 1)
+	}
+	return "", 0
+}
+
+// Handles "eight hundred" and "six eight hundred" style groups
+func with_hundred(words []string, next int, digits string, used int) (string, int) {
+	if next < len(words) && words[next] == "hundred" {
+		return digits + "00", used + 1
+	}
+	return digits, used
+}
+
+// Builds a normalized text from the recognized words in which spoken digit
+// sequences become digit runs and letter-by-letter spelling becomes a single
+// token, so the PII detectors can see them.
+func normalize_spoken(words []string) (string, []spokenToken) {
+	cleaned := make([]string, len(words))
+	for i, w := range words {
+		cleaned[i] = clean_spoken_word(w)
+	}
+	var tokens []spokenToken
+	for i := 0; i < len(cleaned); {
+		//Digit runs, from written digits or number words
+		if _, n := spoken_digits(cleaned, i); n > 0 {
+			tok := spokenToken{Kind: tokenDigits, FirstWord: i}
+			for i < len(cleaned) {
+				d, n := spoken_digits(cleaned, i)
+				if n == 0 {
+					break
+				}
+				tok.Text += d
+				i += n
+			}
+			tok.LastWord = i - 1
+			//A lone "one" or "oh" is a word, not a number being read out
+			if tok.LastWord > tok.FirstWord || is_digit_word(cleaned[tok.FirstWord]) {
+				tokens = append(tokens, tok)
+				continue
+			}
+			i = tok.FirstWord
+		}
+		//Spelled letters
+		j := i
+		for j < len(cleaned) && utf8.RuneCountInString(cleaned[j]) == 1 && unicode.IsLetter([]rune(cleaned[j])[0]) {
+			j++
+		}
+		if j-i >= minSpelledLetters {
+			tokens = append(tokens, spokenToken{Kind: tokenLetters, Text: strings.Join(cleaned[i:j], ""), FirstWord: i, LastWord: j - 1})
+			i = j
+			continue
+		}
+		tokens = append(tokens, spokenToken{Kind: tokenWord, Text: cleaned[i], FirstWord: i, LastWord: i})
+		i++
+	}
+	var b strings.Builder
+	for i := range tokens {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		tokens[i].Start = b.Len()
+		b.WriteString(tokens[i].Text)
+		tokens[i].End = b.Len()
+	}
+	return b.String(), tokens
+}
+
+// Findings that only make sense on the normalized stream: bare phone numbers,
+// long digit runs and anything spelled out letter by letter.
+func detect_spoken_pii(tokens []spokenToken, claimed []PIIFinding) []PIIFinding {
+	var findings []PIIFinding
+	for _, tok := range tokens {
+		if overlaps_findings(tok.Start, tok.End, claimed) {
+			continue
+		}
+		infoType, likelihood := "", ""
+		switch {
+		case tok.Kind == tokenDigits && (len(tok.Text) == 10 || len(tok.Text) == 11 && tok.Text[0] == '1'):
+			infoType, likelihood = "PHONE_NUMBER", "LIKELY"
+		case tok.Kind == tokenDigits && len(tok.Text) >= minDigitSequence:
+			infoType, likelihood = "DIGIT_SEQUENCE", "POSSIBLE"
+		case tok.Kind == tokenLetters:
+			infoType, likelihood = "SPELLED_SEQUENCE", "POSSIBLE"
+		default:
+			continue
+		}
+		findings = append(findings, PIIFinding{InfoType: infoType, Likelihood: likelihood, Start: tok.Start, End: tok.End})
+	}
+	return findings
+}
+
+func overlaps_findings(start, end int, findings []PIIFinding) bool {
+	for _, f := range findings {
+		if start < f.End && f.Start < end {
+			return true
+		}
+	}
+	return false
+}
+
+// Maps findings on the normalized text back to indexes of the original words
+func spoken_finding_words(tokens []spokenToken, f PIIFinding) []int {
+	var words []int
+	for _, tok := range tokens {
+		if tok.Start < f.End && f.Start < tok.End {
+			for w := tok.FirstWord; w <= tok.LastWord; w++ {
+				words = append(words, w)
+			}
+		}
+	}
+	return words
+}
+
+// Detects PII spoken across several words and masks those words in the word
+// list and the transcript. The configured redactors and the local detector
+// run on the normalized text, followed by the spoken-form checks.
+func redact_spoken(ctx context.Context, redactors []Redactor, record *TranscriptRecord) error {
+	words := make([]string, len(record.Words))
+	for i, w := range record.Words {
+		words[i] = w.Word
+	}
+	text, tokens := normalize_spoken(words)
+	findings := detect_pii(text)
+	for _, r := range redactors {
+		if _, ok := r.(*localRedactor); ok {
+			continue
+		}
+		more, err := r.Inspect(ctx, text)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, more...)
+	}
+	findings = append(findings, detect_spoken_pii(tokens, findings)...)
+	masked := make([]bool, len(words))
+	for i, f := range findings {
+		//DLP and the local detector may both report the same digits
+		if overlaps_findings(f.Start, f.End, findings[:i]) {
+			continue
+		}
+		covered := spoken_finding_words(tokens, f)
+		for _, w := range covered {
+			masked[w] = true
+		}
+		add_redacted_span(record, f, covered)
+	}
+	offsets := align_words(record.Transcript, record)
+	//Mask from the end so earlier offsets stay valid
+	for i := len(record.Words) - 1; i >= 0; i-- {
+		if !masked[i] {
+			continue
+		}
+		word := record.Words[i].Word
+		stars := strings.Repeat("*", utf8.RuneCountInString(word))
+		record.Words[i].Word = stars
+		if off := offsets[i]; off >= 0 {
+			record.Transcript = record.Transcript[:off] + stars + record.Transcript[off+len(word):]
+		}
+	}
+	return nil
+}
+
+// Redacts a text that has no word list of its own, such as a runner-up
+// hypothesis: spoken-form PII first, then the redactors on what is left.
+// The returned spans carry no speaker or timing.
+func redact_unaligned_text(ctx context.Context, redactors []Redactor, text string) (string, []RedactedSpan, error) {
+	scratch := &TranscriptRecord{Transcript: text}
+	for _, w := range strings.Fields(text) {
+		scratch.Words = append(scratch.Words, struct {
+			Word       string  `json:"word"`
+			StartSecs  float64 `json:"startSecs"`
+			EndSecs    float64 `json:"endSecs"`
+			SpeakerTag int     `json:"speakertag"`
+			Confidence float64 `json:"confidence"`
+		}{Word: w})
+	}
+	if err := redact_spoken(ctx, redactors, scratch); err != nil {
+		return "", nil, err
+	}
+	redacted, findings, err := redact_text(ctx, redactors, scratch.Transcript)
+	if err != nil {
+		return "", nil, err
+	}
+	var spans []RedactedSpan
+	for _, span := range scratch.redactedSpans {
+		spans = append(spans, RedactedSpan{InfoType: span.InfoType, Likelihood: span.Likelihood})
+	}
+	for _, f := range findings {
+		spans = append(spans, RedactedSpan{InfoType: f.InfoType, Likelihood: f.Likelihood})
+	}
+	return redacted, spans, nil
+}
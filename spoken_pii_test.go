@@ -0,0 +1,71 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+func TestNormalizeSpoken(t *testing.T) {
+	tests := []struct {
+		words string
+		want  string
+	}{
+		{"it is four oh nine eight six six five oh eight eight", "it is 4098665088"},
+		{"double five triple two", "55222"},
+		{"six eight hundred Madison", "6800 madison"},
+		{"twenty one forty", "2140"},
+		{"Randall r. A n b, a l l", "randall ranball"},
+		{"one moment please", "one moment please"},
+		{"I have a dog", "i have a dog"},
+	}
+	for _, tt := range tests {
+		got, _ := normalize_spoken(strings.Fields(tt.words))
+		if got != tt.want {
+			t.Errorf("normalize_spoken(%q): got %q, want %q", tt.words, got, tt.want)
+		}
+	}
+}
+
+func TestSpokenFindingWords(t *testing.T) {
+	words := strings.Fields("my number is four oh nine eight six six five oh eight eight thanks")
+	text, tokens := normalize_spoken(words)
+	findings := detect_spoken_pii(tokens, detect_pii(text))
+	if len(findings) != 1 || findings[0].InfoType != "PHONE_NUMBER" {
+		t.Fatalf("got %v, want one PHONE_NUMBER", findings)
+	}
+	got := spoken_finding_words(tokens, findings[0])
+	if len(got) != 10 || got[0] != 3 || got[9] != 12 {
+		t.Errorf("got words %v, want 3..12", got)
+	}
+}
+
+func TestRedactSpokenSample(t *testing.T) {
+	jsonFile, err := ioutil.ReadFile("sample_transcript.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := speechpb.LongRunningRecognizeResponse{}
+	if err = json.Unmarshal(jsonFile, &result); err != nil {
+		t.Fatal(err)
+	}
+	record := TranscriptRecord{}
+	if err = parse_transcript(&result, &record); err != nil {
+		t.Fatal(err)
+	}
+	if err = redact_spoken(context.Background(), nil, &record); err != nil {
+		t.Fatalf("redact_spoken: %v", err)
+	}
+	for _, leaked := range []string{"409-866-5088", "r. A n b,"} {
+		if strings.Contains(record.Transcript, leaked) {
+			t.Errorf("transcript still contains %q", leaked)
+		}
+	}
+	if !strings.Contains(record.Transcript, "Thank you for calling") {
+		t.Errorf("transcript over-redacted: %s", record.Transcript)
+	}
+}
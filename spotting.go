@@ -0,0 +1,371 @@
+package function
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// KeywordDictionary is a named list of terms to spot in transcripts, e.g.
+// competitor names or escalation phrases. Match is the default for its
+// terms: exact (the default), stem or fuzzy. File is a gs:// URI or local
+// path of more terms, one per line.
+type KeywordDictionary struct {
+	Name  string        `json:"name"`
+	Match string        `json:"match"`
+	Terms []KeywordTerm `json:"terms"`
+	File  string        `json:"file"`
+}
+
+// KeywordTerm is a word or phrase of a dictionary. In the configuration a
+// term is a string or {"phrase", "match", "maxDistance"}. MaxDistance is
+// the number of letters a fuzzy match may differ by in each word; by
+// default 0 for words up to 3 letters, 1 up to 7 and 2 beyond.
+type KeywordTerm struct {
+	Phrase      string `json:"phrase"`
+	Match       string `json:"match"`
+	MaxDistance int    `json:"maxDistance"`
+}
+
+func (t *KeywordTerm) UnmarshalJSON(data []byte) error {
+	var phrase string
+	if err := json.Unmarshal(data, &phrase); err == nil {
+		*t = KeywordTerm{Phrase: phrase}
+		return nil
+	}
+	type term KeywordTerm
+	return json.Unmarshal(data, (*term)(t))
+}
+
+// KeywordHit is a place a speaker said a dictionary term. Text is the
+// words as recognized and FirstWord and LastWord their indexes in Words.
+// Confidence is the words' recognition confidence, reduced for fuzzy
+// matches by the share of letters that differ.
+type KeywordHit struct {
+	Dictionary string  `json:"dictionary"`
+	Term       string  `json:"term"`
+	Match      string  `json:"match"`
+	Text       string  `json:"text"`
+	SpeakerTag int     `json:"speakertag"`
+	StartSecs  float64 `json:"startSecs"`
+	EndSecs    float64 `json:"endSecs"`
+	FirstWord  int     `json:"firstword"`
+	LastWord   int     `json:"lastword"`
+	Confidence float64 `json:"confidence"`
+}
+
+const (
+	matchExact = "exact"
+	matchStem  = "stem"
+	matchFuzzy = "fuzzy"
+)
+
+// Parses a term list, skipping blank lines and lines starting with #
+func parse_term_list(data []byte) []KeywordTerm {
+	var terms []KeywordTerm
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			terms = append(terms, KeywordTerm{Phrase: line})
+		}
+	}
+	return terms
+}
+
+// Adds the terms of each dictionary's file to its term list
+func load_dictionary_files(ctx context.Context, dictionaries []KeywordDictionary) error {
+	for i := range dictionaries {
+		d := &dictionaries[i]
+		if d.File == "" {
+			continue
+		}
+		data, err := read_location(ctx, d.File)
+		if err != nil {
+			return fmt.Errorf("dictionary %s: %v", d.Name, err)
+		}
+		d.Terms = append(d.Terms, parse_term_list(data)...)
+		d.File = ""
+	}
+	return nil
+}
+
+// Returns the dictionaries shared by every tenant, from the JSON list at
+// KEYWORD_DICTIONARIES, followed by the tenant's own. When the shared list
+// cannot be loaded, the tenant's are still returned with the error.
+func keyword_dictionaries(ctx context.Context, tenant *TenantConfig) ([]KeywordDictionary, error) {
+	shared, err := shared_keyword_dictionaries(ctx)
+	return append(shared, tenant.Dictionaries...), err
+}
+
+func shared_keyword_dictionaries(ctx context.Context) ([]KeywordDictionary, error) {
+	location := os.Getenv("KEYWORD_DICTIONARIES")
+	if location == "" {
+		return nil, nil
+	}
+	data, err := read_location(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	var dictionaries []KeywordDictionary
+	if err := json.Unmarshal(data, &dictionaries); err != nil {
+		return nil, fmt.Errorf("%s: %v", location, err)
+	}
+	if err := load_dictionary_files(ctx, dictionaries); err != nil {
+		return nil, err
+	}
+	return dictionaries, nil
+}
+
+// Normalizes a word for spotting, dropping a possessive so that a term
+// also matches e.g. "Fleurop's"
+func spot_token(word string) string {
+	w := normalize_word(word)
+	for _, possessive := range []string{"'s", "’s"} {
+		if strings.HasSuffix(w, possessive) && len(w) > len(possessive) {
+			return w[:len(w)-len(possessive)]
+		}
+	}
+	return w
+}
+
+// A light English stemmer: drops common inflections and derivations so
+// that e.g. cancel, cancels, canceled, cancelled, cancelling and
+// cancellation share a stem. Stems are only compared with each other.
+func stem_word(word string) string {
+	w := strings.ToLower(word)
+	if len(w) <= 3 {
+		return w
+	}
+	for _, suffix := range []string{"ations", "ation", "ingly", "ings", "ing", "edly", "ies", "ied", "ed", "es", "ly", "s"} {
+		if !strings.HasSuffix(w, suffix) || len(w)-len(suffix) < 3 {
+			continue
+		}
+		//Keeps e.g. reply and only
+		if suffix == "ly" && len(w)-len(suffix) < 4 {
+			continue
+		}
+		stem := w[:len(w)-len(suffix)]
+		switch suffix {
+		case "ies", "ied":
+			stem += "i"
+		case "es":
+			//Only after sibilants, e.g. boxes and wishes; roses keeps its e
+			if !strings.HasSuffix(stem, "s") && !strings.HasSuffix(stem, "x") && !strings.HasSuffix(stem, "z") && !strings.HasSuffix(stem, "ch") && !strings.HasSuffix(stem, "sh") {
+				continue
+			}
+		case "s":
+			if strings.HasSuffix(stem, "s") {
+				continue
+			}
+		}
+		w = stem
+		break
+	}
+	if strings.HasSuffix(w, "y") {
+		w = w[:len(w)-1] + "i"
+	}
+	if len(w) > 3 && strings.HasSuffix(w, "e") {
+		w = w[:len(w)-1]
+	}
+	if n := len(w); n > 3 && w[n-1] == w[n-2] && !strings.ContainsRune("aeiou", rune(w[n-1])) {
+		w = w[:n-1]
+	}
+	return w
+}
+
+// Levenshtein distance between two words, in letters
+func edit_distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// Letters a fuzzy match of a term word may differ by
+func fuzzy_allowance(word string, maxDistance int) int {
+	if maxDistance > 0 {
+		return maxDistance
+	}
+	switch n := len([]rune(word)); {
+	case n <= 3:
+		return 0
+	case n <= 7:
+		return 1
+	}
+	return 2
+}
+
+// A term prepared for matching
+type spotTerm struct {
+	dictionary string
+	phrase     string
+	match      string
+	words      []string
+	stems      []string
+	allowance  []int
+	letters    int
+}
+
+func prepare_terms(dictionaries []KeywordDictionary) []spotTerm {
+	var terms []spotTerm
+	for _, d := range dictionaries {
+		for _, t := range d.Terms {
+			term := spotTerm{dictionary: d.Name, phrase: t.Phrase, match: strings.ToLower(t.Match)}
+			if term.match == "" {
+				term.match = strings.ToLower(d.Match)
+			}
+			if term.match != matchStem && term.match != matchFuzzy {
+				term.match = matchExact
+			}
+			for _, w := range strings.Fields(t.Phrase) {
+				if n := spot_token(w); n != "" {
+					term.words = append(term.words, n)
+					term.stems = append(term.stems, stem_word(n))
+					term.allowance = append(term.allowance, fuzzy_allowance(n, t.MaxDistance))
+					term.letters += len([]rune(n))
+				}
+			}
+			if len(term.words) > 0 {
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms
+}
+
+// Compares the term with the words from position i of a speaker's words.
+// Returns the letters that differ, or -1 when it does not match.
+func match_term(term spotTerm, words, stems []string, i int) int {
+	if i+len(term.words) > len(words) {
+		return -1
+	}
+	distance := 0
+	for j, w := range term.words {
+		word := words[i+j]
+		switch {
+		case word == w:
+		case term.match != matchExact && stems[i+j] == term.stems[j]:
+		case term.match == matchFuzzy:
+			d := edit_distance(word, w)
+			if d > term.allowance[j] {
+				return -1
+			}
+			distance += d
+		default:
+			return -1
+		}
+	}
+	return distance
+}
+
+// Finds the dictionary terms each speaker says and stores them in
+// Keywordhits in time order. Where terms of one dictionary overlap, the
+// longest is kept.
+func spot_keywords(record *TranscriptRecord, dictionaries []KeywordDictionary) {
+	record.Keywordhits = nil
+	terms := prepare_terms(dictionaries)
+	if len(terms) == 0 {
+		return
+	}
+	speakers := map[int][]int{}
+	for i, w := range record.Words {
+		if spot_token(w.Word) != "" {
+			speakers[w.SpeakerTag] = append(speakers[w.SpeakerTag], i)
+		}
+	}
+	var hits []KeywordHit
+	for speaker, indexes := range speakers {
+		sort.SliceStable(indexes, func(a, b int) bool { return record.Words[indexes[a]].StartSecs < record.Words[indexes[b]].StartSecs })
+		words := make([]string, len(indexes))
+		stems := make([]string, len(indexes))
+		for k, i := range indexes {
+			words[k] = spot_token(record.Words[i].Word)
+			stems[k] = stem_word(words[k])
+		}
+		//The best hit of each dictionary starting at each word
+		best := map[string]KeywordHit{}
+		for i := range words {
+			for _, term := range terms {
+				distance := match_term(term, words, stems, i)
+				if distance < 0 {
+					continue
+				}
+				first, last := indexes[i], indexes[i+len(term.words)-1]
+				var text []string
+				var confidence float64
+				for _, k := range indexes[i : i+len(term.words)] {
+					text = append(text, record.Words[k].Word)
+					confidence += record.Words[k].Confidence
+				}
+				match := matchExact
+				if strings.Join(words[i:i+len(term.words)], " ") != strings.Join(term.words, " ") {
+					match = term.match
+				}
+				hit := KeywordHit{
+					Dictionary: term.dictionary,
+					Term:       term.phrase,
+					Match:      match,
+					Text:       strings.Join(text, " "),
+					SpeakerTag: speaker,
+					StartSecs:  record.Words[first].StartSecs,
+					EndSecs:    record.Words[last].EndSecs,
+					FirstWord:  first,
+					LastWord:   last,
+					Confidence: confidence / float64(len(term.words)) * (1 - float64(distance)/float64(term.letters)),
+				}
+				key := fmt.Sprintf("%s|%d", term.dictionary, i)
+				if prev, ok := best[key]; !ok || hit.EndSecs > prev.EndSecs || (hit.EndSecs == prev.EndSecs && hit.Confidence > prev.Confidence) {
+					best[key] = hit
+				}
+			}
+		}
+		//Drop hits inside a longer hit of the same dictionary
+		for key, hit := range best {
+			for other, longer := range best {
+				if other != key && longer.Dictionary == hit.Dictionary && longer.StartSecs <= hit.StartSecs && longer.EndSecs >= hit.EndSecs && (longer.StartSecs < hit.StartSecs || longer.EndSecs > hit.EndSecs) {
+					delete(best, key)
+					break
+				}
+			}
+		}
+		for _, hit := range best {
+			hits = append(hits, hit)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].StartSecs != hits[j].StartSecs {
+			return hits[i].StartSecs < hits[j].StartSecs
+		}
+		if hits[i].SpeakerTag != hits[j].SpeakerTag {
+			return hits[i].SpeakerTag < hits[j].SpeakerTag
+		}
+		return hits[i].Dictionary < hits[j].Dictionary
+	})
+	record.Keywordhits = hits
+}
@@ -0,0 +1,114 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestStemWord(t *testing.T) {
+	groups := [][]string{
+		{"cancel", "cancels", "canceled", "cancelled", "cancelling", "cancellation"},
+		{"manage", "managed", "managing", "manages"},
+		{"reply", "replies", "replied"},
+		{"rose", "roses"},
+		{"box", "boxes"},
+		{"supervisor", "supervisors"},
+	}
+	for _, group := range groups {
+		want := stem_word(group[0])
+		for _, w := range group[1:] {
+			if got := stem_word(w); got != want {
+				t.Errorf("stem(%s) = %s, stem(%s) = %s", w, got, group[0], want)
+			}
+		}
+	}
+	if stem_word("class") == stem_word("cla") || stem_word("bus") != "bus" {
+		t.Errorf("short words were stemmed: %s %s", stem_word("class"), stem_word("bus"))
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{{"fleurop", "fluerop", 2}, {"acme", "acne", 1}, {"", "abc", 3}, {"same", "same", 0}} {
+		if got := edit_distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("edit_distance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestKeywordTermJSON(t *testing.T) {
+	var d KeywordDictionary
+	err := json.Unmarshal([]byte(`{"name": "competitors", "match": "fuzzy", "terms": ["Fleurop", {"phrase": "Bloom and Wild", "match": "exact"}]}`), &d)
+	if err != nil || len(d.Terms) != 2 || d.Terms[0].Phrase != "Fleurop" || d.Terms[1].Match != "exact" {
+		t.Errorf("got %+v, %v", d, err)
+	}
+}
+
+func TestSpotKeywords(t *testing.T) {
+	record := &TranscriptRecord{}
+	for i, w := range []string{"I", "want", "to", "speak", "to", "your", "supervisor."} {
+		add_test_word(record, w, float64(i), float64(i)+0.5, 2)
+	}
+	add_test_word(record, "We", 3.2, 3.4, 1)
+	add_test_word(record, "beat", 3.4, 3.6, 1)
+	add_test_word(record, "Flerop's", 3.6, 4.0, 1)
+	add_test_word(record, "prices", 4.0, 4.4, 1)
+	for i, w := range []string{"I'm", "cancelling", "my", "flower", "subscription"} {
+		add_test_word(record, w, 8+float64(i), 8.5+float64(i), 2)
+	}
+	dictionaries := []KeywordDictionary{
+		{Name: "escalation", Terms: []KeywordTerm{{Phrase: "supervisor"}, {Phrase: "speak to your supervisor"}, {Phrase: "manager"}}},
+		{Name: "churn", Match: matchStem, Terms: []KeywordTerm{{Phrase: "cancel"}, {Phrase: "cancel my subscription"}}},
+		{Name: "competitors", Match: matchFuzzy, Terms: []KeywordTerm{{Phrase: "Fleurop"}, {Phrase: "Bloom"}}},
+	}
+	spot_keywords(record, dictionaries)
+	hits := record.Keywordhits
+	if len(hits) != 3 {
+		t.Fatalf("hits = %+v", hits)
+	}
+	if h := hits[0]; h.Dictionary != "escalation" || h.Term != "speak to your supervisor" || h.Match != matchExact || h.Text != "speak to your supervisor." || h.SpeakerTag != 2 || h.StartSecs != 3 || h.EndSecs != 6.5 || h.FirstWord != 3 || h.LastWord != 6 {
+		t.Errorf("escalation hit = %+v", h)
+	}
+	//One letter of seven missing, at confidence 0.9
+	if h := hits[1]; h.Dictionary != "competitors" || h.Match != matchFuzzy || h.Text != "Flerop's" || h.SpeakerTag != 1 || h.Confidence < 0.77 || h.Confidence > 0.78 {
+		t.Errorf("competitor hit = %+v", h)
+	}
+	if h := hits[2]; h.Dictionary != "churn" || h.Term != "cancel" || h.Match != matchStem || h.Text != "cancelling" || h.Confidence != 0.9 {
+		t.Errorf("churn hit = %+v", h)
+	}
+	spot_keywords(record, nil)
+	if record.Keywordhits != nil {
+		t.Errorf("hits kept without dictionaries")
+	}
+}
+
+func TestKeywordDictionaries(t *testing.T) {
+	dir := t.TempDir()
+	write_test_file(t, filepath.Join(dir, "competitors.txt"), []byte("# florists\nFleurop\n\nBloom and Wild\n"))
+	shared, _ := json.Marshal([]KeywordDictionary{{Name: "competitors", Match: matchFuzzy, File: filepath.Join(dir, "competitors.txt")}})
+	write_test_file(t, filepath.Join(dir, "shared.json"), shared)
+	write_test_file(t, filepath.Join(dir, "florist.json"), []byte(`{"dictionaries": [{"name": "escalation", "terms": ["supervisor"]}]}`))
+	t.Setenv("KEYWORD_DICTIONARIES", filepath.Join(dir, "shared.json"))
+	t.Setenv("TENANT_CONFIG_DIR", dir)
+	tenant, err := load_tenant_config(context.Background(), "florist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dictionaries, err := keyword_dictionaries(context.Background(), tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dictionaries) != 2 || len(dictionaries[0].Terms) != 2 || dictionaries[0].Terms[1].Phrase != "Bloom and Wild" || dictionaries[1].Name != "escalation" {
+		t.Errorf("dictionaries = %+v", dictionaries)
+	}
+	//A broken shared list leaves the tenant's dictionaries
+	t.Setenv("KEYWORD_DICTIONARIES", filepath.Join(dir, "missing.json"))
+	dictionaries, err = keyword_dictionaries(context.Background(), tenant)
+	if err == nil || len(dictionaries) != 1 || dictionaries[0].Name != "escalation" {
+		t.Errorf("missing shared list: %+v, %v", dictionaries, err)
+	}
+}
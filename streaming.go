@@ -0,0 +1,840 @@
+package function
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	speech "cloud.google.com/go/speech/apiv1"
+	"github.com/kjk/betterguid"
+	"golang.org/x/net/websocket"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// StreamEvent is sent to the caller streaming a live call and to every
+// subscriber of the call. Interim events carry the recognizer's current
+// guess and may be revised; final events are settled. When the call ends,
+// a record event carries the TranscriptRecord that was committed. Alert
+// events carry an agent-assist alert.
+type StreamEvent struct {
+	Type       string            `json:"type"`
+	Callid     string            `json:"callid"`
+	SpeakerTag int               `json:"speakertag,omitempty"`
+	Transcript string            `json:"transcript,omitempty"`
+	StartSecs  float64           `json:"startSecs,omitempty"`
+	EndSecs    float64           `json:"endSecs,omitempty"`
+	Stability  float32           `json:"stability,omitempty"`
+	Record     *TranscriptRecord `json:"record,omitempty"`
+	Alert      *AssistAlert      `json:"alert,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+const (
+	streamInterim = "interim"
+	streamFinal   = "final"
+	streamRecord  = "record"
+	streamError   = "error"
+	streamAlert   = "alert"
+)
+
+// Subscribing to this call id receives the events of every call. It needs
+// a token issued for it rather than for a single call.
+const streamAllCalls = "*"
+
+// streamStart is the first message of a live call. Metadata takes the
+// place of the object metadata of an upload, e.g. "dlp" or "transcriber".
+type streamStart struct {
+	Type       string            `json:"type"`
+	Callid     string            `json:"callid"`
+	Tenant     string            `json:"tenant"`
+	SampleRate int               `json:"sampleRate"`
+	Channels   int               `json:"channels"`
+	Encoding   string            `json:"encoding"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// Events buffered per subscriber; a subscriber that falls further behind
+// misses events
+const streamSubscriberBuffer = 256
+
+// Google ends a recognition stream after about five minutes of audio, so
+// each channel's stream is replaced before then
+const streamRestartSecs = 280
+
+// Largest audio message sent on a recognition stream, in samples
+const streamMaxSamples = 8192
+
+// Level below which streamed audio counts as a pause when the local
+// recognizer's utterances are cut
+const streamPauseLevel = 0.01
+
+// Bounds of an utterance sent to the local recognizer, and the pause that
+// ends one
+const (
+	streamSegmentMinSecs = 2.0
+	streamSegmentMaxSecs = 30.0
+	streamPauseSecs      = 0.6
+)
+
+// streamHub passes the events of live calls to their subscribers
+type streamHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan StreamEvent]bool
+}
+
+// The hub lives in the memory of one process, so a call's subscribers must
+// reach the instance its audio is streamed to
+var streams = &streamHub{subscribers: map[string]map[chan StreamEvent]bool{}}
+
+// Returns a channel with the events of the call and a function that ends
+// the subscription and closes the channel
+func (h *streamHub) subscribe(callid string) (chan StreamEvent, func()) {
+	events := make(chan StreamEvent, streamSubscriberBuffer)
+	h.mu.Lock()
+	if h.subscribers[callid] == nil {
+		h.subscribers[callid] = map[chan StreamEvent]bool{}
+	}
+	h.subscribers[callid][events] = true
+	h.mu.Unlock()
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subscribers[callid], events)
+			if len(h.subscribers[callid]) == 0 {
+				delete(h.subscribers, callid)
+			}
+			h.mu.Unlock()
+			close(events)
+		})
+	}
+}
+
+func (h *streamHub) publish(event StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, callid := range []string{event.Callid, streamAllCalls} {
+		for events := range h.subscribers[callid] {
+			select {
+			case events <- event:
+			default:
+			}
+		}
+		if event.Callid == streamAllCalls {
+			break
+		}
+	}
+}
+
+// Receives recognition results for one channel. Times are from the start
+// of the call.
+type streamEmit func(result *speechpb.SpeechRecognitionResult, final bool, stability float32)
+
+// streamBackend recognizes one channel of a live call
+type streamBackend interface {
+	// Write passes the next samples of the channel
+	Write(samples []float32) error
+	// Close flushes the remaining audio and waits for the last results
+	Close() error
+}
+
+// Decodes an audio frame: LINEAR16 (little-endian), MULAW or ALAW
+func decode_stream_audio(data []byte, encoding string) ([]float32, error) {
+	switch strings.ToUpper(encoding) {
+	case "", "LINEAR16":
+		if len(data)%2 != 0 {
+			return nil, fmt.Errorf("LINEAR16 frame of %d bytes", len(data))
+		}
+		samples := make([]float32, len(data)/2)
+		for i := range samples {
+			samples[i] = float32(int16(binary.LittleEndian.Uint16(data[2*i:]))) / 32768
+		}
+		return samples, nil
+	case "MULAW":
+		samples := make([]float32, len(data))
+		for i, b := range data {
+			samples[i] = ulaw_decode(b)
+		}
+		return samples, nil
+	case "ALAW":
+		samples := make([]float32, len(data))
+		for i, b := range data {
+			samples[i] = alaw_decode(b)
+		}
+		return samples, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// Encodes samples as 16-bit little-endian PCM
+func pcm16_bytes(samples []float32) []byte {
+	data := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		v := math.Max(-1, math.Min(1, float64(s)))
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(int16(math.Round(v*32767))))
+	}
+	return data
+}
+
+// Moves every timestamp of a result later by offset seconds
+func shift_result(result *speechpb.SpeechRecognitionResult, offset float64) {
+	result.ResultEndTime = seconds_to_duration(get_seconds_from_duration(result.ResultEndTime) + offset)
+	for _, alt := range result.Alternatives {
+		for _, w := range alt.Words {
+			w.StartTime = seconds_to_duration(get_seconds_from_duration(w.StartTime) + offset)
+			w.EndTime = seconds_to_duration(get_seconds_from_duration(w.EndTime) + offset)
+		}
+	}
+}
+
+// Converts a streaming result of a channel into the shape parse_transcript
+// reads
+func streaming_result(r *speechpb.StreamingRecognitionResult, channel int, offset float64) *speechpb.SpeechRecognitionResult {
+	result := &speechpb.SpeechRecognitionResult{
+		Alternatives:  r.Alternatives,
+		ChannelTag:    int32(channel),
+		ResultEndTime: r.ResultEndTime,
+		LanguageCode:  r.LanguageCode,
+	}
+	shift_result(result, offset)
+	return result
+}
+
+// Google StreamingRecognize for one channel, with interim results. The
+// stream is replaced every streamRestartSecs of audio.
+type googleStreamBackend struct {
+	ctx     context.Context
+	client  *speech.Client
+	config  *speechpb.StreamingRecognitionConfig
+	channel int
+	rate    int
+	emit    streamEmit
+	stream  speechpb.Speech_StreamingRecognizeClient
+	done    chan error
+	//Seconds of audio sent on earlier streams, and samples on this one
+	offset float64
+	sent   int
+}
+
+func new_google_stream_backend(ctx context.Context, adaptation *speechpb.SpeechAdaptation, channel, rate int, emit streamEmit) (*googleStreamBackend, error) {
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	g := &googleStreamBackend{
+		ctx:     ctx,
+		client:  client,
+		config:  &speechpb.StreamingRecognitionConfig{Config: recognition_config(int32(rate), 1, adaptation), InterimResults: true},
+		channel: channel,
+		rate:    rate,
+		emit:    emit,
+	}
+	if err := g.open(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *googleStreamBackend) open() error {
+	stream, err := g.client.StreamingRecognize(g.ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&speechpb.StreamingRecognizeRequest{
+		StreamingRequest: &speechpb.StreamingRecognizeRequest_StreamingConfig{StreamingConfig: g.config},
+	})
+	if err != nil {
+		return err
+	}
+	g.stream, g.done, g.sent = stream, make(chan error, 1), 0
+	go g.receive(stream, g.offset, g.done)
+	return nil
+}
+
+func (g *googleStreamBackend) receive(stream speechpb.Speech_StreamingRecognizeClient, offset float64, done chan error) {
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			done <- nil
+			return
+		}
+		if err != nil {
+			done <- err
+			return
+		}
+		for _, r := range resp.Results {
+			g.emit(streaming_result(r, g.channel, offset), r.IsFinal, r.Stability)
+		}
+	}
+}
+
+// Ends the current stream once its last results are in
+func (g *googleStreamBackend) finish() error {
+	if err := g.stream.CloseSend(); err != nil {
+		return err
+	}
+	return <-g.done
+}
+
+func (g *googleStreamBackend) Write(samples []float32) error {
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > streamMaxSamples {
+			n = streamMaxSamples
+		}
+		if g.sent+n > streamRestartSecs*g.rate {
+			if err := g.finish(); err != nil {
+				return err
+			}
+			g.offset += float64(g.sent) / float64(g.rate)
+			if err := g.open(); err != nil {
+				return err
+			}
+		}
+		err := g.stream.Send(&speechpb.StreamingRecognizeRequest{
+			StreamingRequest: &speechpb.StreamingRecognizeRequest_AudioContent{AudioContent: pcm16_bytes(samples[:n])},
+		})
+		if err != nil {
+			return err
+		}
+		g.sent += n
+		samples = samples[n:]
+	}
+	return nil
+}
+
+func (g *googleStreamBackend) Close() error {
+	defer g.client.Close()
+	return g.finish()
+}
+
+type streamSegment struct {
+	start   float64
+	samples []float32
+}
+
+// Cuts one channel into utterances at pauses and sends each to the local
+// recognizer. Only final results are emitted.
+type localStreamBackend struct {
+	ctx         context.Context
+	transcriber *localTranscriber
+	channel     int
+	rate        int
+	emit        streamEmit
+	buffer      []float32
+	start       float64
+	quiet       int
+	segments    chan streamSegment
+	done        chan error
+}
+
+func new_local_stream_backend(ctx context.Context, transcriber *localTranscriber, channel, rate int, emit streamEmit) *localStreamBackend {
+	l := &localStreamBackend{ctx: ctx, transcriber: transcriber, channel: channel, rate: rate, emit: emit, segments: make(chan streamSegment, 8), done: make(chan error, 1)}
+	go l.recognize()
+	return l
+}
+
+func (l *localStreamBackend) recognize() {
+	var first error
+	for segment := range l.segments {
+		audio := &WavAudio{SampleRate: l.rate, BitsPerSample: 16, Channels: [][]float32{segment.samples}}
+		resp, err := l.transcriber.Transcribe(l.ctx, TranscriptionJob{Audio: audio, Record: &TranscriptRecord{}})
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		for _, result := range resp.Results {
+			result.ChannelTag = int32(l.channel)
+			shift_result(result, segment.start)
+			l.emit(result, true, 0)
+		}
+	}
+	l.done <- first
+}
+
+func (l *localStreamBackend) cut() {
+	if len(l.buffer) > 0 {
+		l.segments <- streamSegment{start: l.start, samples: l.buffer}
+		l.start += float64(len(l.buffer)) / float64(l.rate)
+		l.buffer, l.quiet = nil, 0
+	}
+}
+
+func (l *localStreamBackend) Write(samples []float32) error {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	if len(samples) > 0 && math.Sqrt(sum/float64(len(samples))) < streamPauseLevel {
+		l.quiet += len(samples)
+	} else {
+		l.quiet = 0
+	}
+	l.buffer = append(l.buffer, samples...)
+	secs := float64(len(l.buffer)) / float64(l.rate)
+	if (secs >= streamSegmentMinSecs && float64(l.quiet) >= streamPauseSecs*float64(l.rate)) || secs >= streamSegmentMaxSecs {
+		l.cut()
+	}
+	return nil
+}
+
+func (l *localStreamBackend) Close() error {
+	l.cut()
+	close(l.segments)
+	return <-l.done
+}
+
+// streamSession collects the audio and final results of a live call
+type streamSession struct {
+	record   TranscriptRecord
+	audio    *WavAudio
+	encoding string
+	backends []streamBackend
+	assist   *assistEngine
+	tenant   *TenantConfig
+	publish  func(StreamEvent)
+	mu       sync.Mutex
+	results  []*speechpb.SpeechRecognitionResult
+}
+
+// Creates the session and a recognizer for each channel with newBackend.
+// The assist engine, which may be nil, is in place before any recognizer
+// starts emitting results; the session closes it.
+func new_stream_session(start streamStart, publish func(StreamEvent), assist *assistEngine, newBackend func(channel int, emit streamEmit) (streamBackend, error)) (*streamSession, error) {
+	s := &streamSession{
+		audio:    &WavAudio{SampleRate: start.SampleRate, BitsPerSample: 16, Channels: make([][]float32, start.Channels)},
+		encoding: start.Encoding,
+		assist:   assist,
+		publish:  publish,
+		tenant:   &TenantConfig{},
+	}
+	s.record.Callid = start.Callid
+	s.record.Tenant = start.Tenant
+	s.record.Dlp = start.Metadata["dlp"]
+	s.record.metadata = start.Metadata
+	s.record.Metadataissues = apply_call_metadata(&s.record, start.Metadata, startMetadata)
+	if assist != nil {
+		assist.dlp = s.record.Dlp == "true"
+	}
+	for c := 1; c <= start.Channels; c++ {
+		backend, err := newBackend(c, s.emit(c))
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.backends = append(s.backends, backend)
+	}
+	return s, nil
+}
+
+func (s *streamSession) emit(channel int) streamEmit {
+	return func(result *speechpb.SpeechRecognitionResult, final bool, stability float32) {
+		if len(result.Alternatives) == 0 {
+			return
+		}
+		alt := result.Alternatives[0]
+		event := StreamEvent{
+			Type:       streamInterim,
+			Callid:     s.record.Callid,
+			SpeakerTag: channel,
+			Transcript: strings.TrimSpace(alt.Transcript),
+			EndSecs:    get_seconds_from_duration(result.ResultEndTime),
+			Stability:  stability,
+		}
+		if len(alt.Words) > 0 {
+			event.StartSecs = get_seconds_from_duration(alt.Words[0].StartTime)
+		}
+		if s.record.Dlp == "true" {
+			event.Transcript = redact_live_text(event.Transcript)
+		}
+		if final {
+			event.Type = streamFinal
+			s.mu.Lock()
+			s.results = append(s.results, result)
+			s.mu.Unlock()
+		}
+		s.publish(event)
+		if final && s.assist != nil {
+			s.assist.final(channel, result)
+		}
+	}
+}
+
+// Masks PII in the text of a live event with the local detectors, which
+// add no round trip, including numbers and spelling read out over several
+// words. The text is left out when it cannot be redacted.
+func redact_live_text(text string) string {
+	redacted, _, err := redact_unaligned_text(context.Background(), []Redactor{&localRedactor{}}, text)
+	if err != nil {
+		return ""
+	}
+	return redacted
+}
+
+// Passes an audio frame, prefixed with its channel number, to the
+// channel's recognizer
+func (s *streamSession) write(frame []byte) error {
+	if len(frame) < 1 || int(frame[0]) < 1 || int(frame[0]) > len(s.backends) {
+		return fmt.Errorf("audio frame for an unknown channel")
+	}
+	c := int(frame[0]) - 1
+	samples, err := decode_stream_audio(frame[1:], s.encoding)
+	if err != nil {
+		return err
+	}
+	s.audio.Channels[c] = append(s.audio.Channels[c], samples...)
+	if s.assist != nil {
+		s.assist.audio(c+1, samples, s.audio.SampleRate)
+	}
+	return s.backends[c].Write(samples)
+}
+
+// Ends recognition on every channel and returns the first error
+func (s *streamSession) close() error {
+	var first error
+	for _, b := range s.backends {
+		if err := b.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.backends = nil
+	if s.assist != nil {
+		s.assist.close()
+		s.assist = nil
+	}
+	return first
+}
+
+// Returns the final results in time order, as a batch recognizer would
+func (s *streamSession) response() *speechpb.LongRunningRecognizeResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := &speechpb.LongRunningRecognizeResponse{Results: s.results}
+	sort.SliceStable(response.Results, func(i, j int) bool {
+		return get_seconds_from_duration(response.Results[i].ResultEndTime) < get_seconds_from_duration(response.Results[j].ResultEndTime)
+	})
+	for i, result := range response.Results {
+		//parse_transcript joins the transcripts as they are
+		result.Alternatives[0].Transcript = strings.TrimSpace(result.Alternatives[0].Transcript)
+		if i > 0 {
+			result.Alternatives[0].Transcript = " " + result.Alternatives[0].Transcript
+		}
+	}
+	return response
+}
+
+// Pads the channels to the same length
+func (s *streamSession) recording() *WavAudio {
+	frames := 0
+	for _, samples := range s.audio.Channels {
+		if len(samples) > frames {
+			frames = len(samples)
+		}
+	}
+	for c, samples := range s.audio.Channels {
+		s.audio.Channels[c] = append(samples, make([]float32, frames-len(samples))...)
+	}
+	return s.audio
+}
+
+// Ends the call: stops recognition, writes the recording to STREAM_BUCKET
+// when set, and runs the same analysis and commit as an upload
+func (s *streamSession) finish(ctx context.Context, logger *logging.Client) *TranscriptRecord {
+	record := &s.record
+	if err := s.close(); err != nil {
+		writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to get transcript from stream: %v", record.Callid, err))
+	}
+	audio := s.recording()
+	record.Processedat = time.Now().UTC()
+	record.Fileid = betterguid.New()
+	bucket, name := os.Getenv("STREAM_BUCKET"), ""
+	if bucket != "" {
+		name = fmt.Sprintf("streams/%s.wav", strings.ReplaceAll(record.Callid, "/", "_"))
+		record.Filename = fmt.Sprintf("%s/%s", bucket, name)
+		if err := write_gcs_object(ctx, bucket, name, encode_wav(audio), "audio/wav"); err != nil {
+			writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to write streamed audio: %v", record.Callid, err))
+			bucket, name = "", ""
+		}
+	}
+	analyze_audio(logger, audio, record)
+	finish_record(ctx, logger, audio, bucket, name, record, s.tenant, s.response())
+	return record
+}
+
+// Picks the streaming recognizer for the call the same way uploads pick a
+// transcriber
+func stream_backend_factory(ctx context.Context, record *TranscriptRecord, tenant *TenantConfig, rate int) (func(int, streamEmit) (streamBackend, error), error) {
+	transcriber, err := select_transcriber(record, tenant)
+	if err != nil {
+		return nil, err
+	}
+	switch t := transcriber.(type) {
+	case *googleTranscriber:
+		return func(channel int, emit streamEmit) (streamBackend, error) {
+			return new_google_stream_backend(ctx, t.adaptation, channel, rate, emit)
+		}, nil
+	case *localTranscriber:
+		return func(channel int, emit streamEmit) (streamBackend, error) {
+			return new_local_stream_backend(ctx, t, channel, rate, emit), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("the %s transcriber cannot stream", record.Transcriber)
+}
+
+// streamFrame is one WebSocket message, text or binary
+type streamFrame struct {
+	text bool
+	data []byte
+}
+
+var frameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(streamFrame)
+		if f.text {
+			return f.data, websocket.TextFrame, nil
+		}
+		return f.data, websocket.BinaryFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*streamFrame)
+		f.text, f.data = payloadType == websocket.TextFrame, data
+		return nil
+	},
+}
+
+// Only accepts connections from STREAM_ORIGINS, a comma-separated list.
+// When it is not set, browsers may only connect from the function's own
+// origin; clients that send no Origin are accepted.
+func check_stream_origin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	allowed := os.Getenv("STREAM_ORIGINS")
+	if allowed == "" {
+		if u, err := url.Parse(origin); origin == "" || err == nil && u.Host == r.Host {
+			return nil
+		}
+		return fmt.Errorf("origin %q not allowed", origin)
+	}
+	for _, o := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(o) == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// Signature of a stream token for the call id and expiry
+func stream_token_signature(secret, callid string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s|%d", callid, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Stream_token issues a token for following one call, or every call with
+// "*", until expires. A token is the expiry in Unix seconds and an
+// HMAC-SHA256 of the call id and expiry under STREAM_TOKEN_SECRET, joined
+// by a dot.
+func Stream_token(callid string, expires time.Time) (string, error) {
+	secret := os.Getenv("STREAM_TOKEN_SECRET")
+	if secret == "" {
+		return "", fmt.Errorf("STREAM_TOKEN_SECRET environment variable not set")
+	}
+	return fmt.Sprintf("%d.%s", expires.Unix(), stream_token_signature(secret, callid, expires.Unix())), nil
+}
+
+// Checks that a request carries a valid token for the call, as an
+// "Authorization: Bearer" header or ?token= for browsers, which cannot
+// set headers on a WebSocket. With follow, a token for every call is also
+// accepted. Requests are refused when STREAM_TOKEN_SECRET is not set.
+func check_stream_token(r *http.Request, callid string, follow bool) error {
+	secret := os.Getenv("STREAM_TOKEN_SECRET")
+	if secret == "" {
+		return fmt.Errorf("streaming is disabled: STREAM_TOKEN_SECRET is not set")
+	}
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("missing stream token")
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return fmt.Errorf("stream token expired")
+	}
+	scopes := []string{callid}
+	if follow {
+		scopes = append(scopes, streamAllCalls)
+	}
+	for _, scope := range scopes {
+		if hmac.Equal([]byte(parts[1]), []byte(stream_token_signature(secret, scope, expires))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("stream token not valid for call %q", callid)
+}
+
+// Checks the origin, and the token of a subscriber, before the WebSocket
+// is opened. A caller's token is checked against the call id of its start
+// message.
+func check_stream_handshake(config *websocket.Config, r *http.Request) error {
+	if err := check_stream_origin(config, r); err != nil {
+		return err
+	}
+	if callid := r.URL.Query().Get("subscribe"); callid != "" {
+		return check_stream_token(r, callid, true)
+	}
+	return nil
+}
+
+// Stream_transcript is the WebSocket entrypoint for live calls. A caller
+// sends a JSON start message ({"type": "start", "callid", "sampleRate",
+// "channels", "encoding", "tenant", "metadata"}), then binary audio frames,
+// each the channel number (1-based) in one byte followed by the samples,
+// and finally {"type": "end"}. Interim and final transcript events come
+// back as they are recognized, and a record event when the call has been
+// processed. Connecting with ?subscribe=<callid> receives the events of a
+// call without sending audio. Both need a token from Stream_token.
+func Stream_transcript(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handshake: check_stream_handshake, Handler: serve_stream}.ServeHTTP(w, r)
+}
+
+func serve_stream(ws *websocket.Conn) {
+	defer ws.Close()
+	if callid := ws.Request().URL.Query().Get("subscribe"); callid != "" {
+		events, cancel := streams.subscribe(callid)
+		//Notice a subscriber hanging up
+		go func() {
+			var frame streamFrame
+			for frameCodec.Receive(ws, &frame) == nil {
+			}
+			cancel()
+		}()
+		for event := range events {
+			if websocket.JSON.Send(ws, event) != nil {
+				cancel()
+			}
+		}
+		return
+	}
+	var frame streamFrame
+	if err := frameCodec.Receive(ws, &frame); err != nil {
+		return
+	}
+	var start streamStart
+	if err := json.Unmarshal(frame.data, &start); err != nil || !frame.text || start.Type != "start" {
+		websocket.JSON.Send(ws, StreamEvent{Type: streamError, Error: "the first message must be a start message"})
+		return
+	}
+	if start.Callid == "" || start.SampleRate <= 0 || start.Channels < 1 || start.Channels > 255 {
+		websocket.JSON.Send(ws, StreamEvent{Type: streamError, Callid: start.Callid, Error: "callid, sampleRate and channels are required"})
+		return
+	}
+	if start.Callid == streamAllCalls {
+		websocket.JSON.Send(ws, StreamEvent{Type: streamError, Callid: start.Callid, Error: "callid " + streamAllCalls + " is reserved"})
+		return
+	}
+	//Sending audio needs a token for the call itself
+	if err := check_stream_token(ws.Request(), start.Callid, false); err != nil {
+		websocket.JSON.Send(ws, StreamEvent{Type: streamError, Callid: start.Callid, Error: err.Error()})
+		return
+	}
+	if err := confirm_env_vars(); err != nil {
+		websocket.JSON.Send(ws, StreamEvent{Type: streamError, Callid: start.Callid, Error: err.Error()})
+		return
+	}
+	ctx := context.Background()
+	logger, err := logging.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	if err != nil {
+		websocket.JSON.Send(ws, StreamEvent{Type: streamError, Callid: start.Callid, Error: err.Error()})
+		return
+	}
+	defer logger.Close()
+
+	//The caller gets the events of its call like any subscriber
+	events, cancel := streams.subscribe(start.Callid)
+	forwarded := make(chan struct{})
+	go func() {
+		for event := range events {
+			websocket.JSON.Send(ws, event)
+		}
+		close(forwarded)
+	}()
+	defer func() {
+		cancel()
+		<-forwarded
+	}()
+
+	record := TranscriptRecord{Callid: start.Callid, Tenant: start.Tenant, metadata: start.Metadata}
+	tenant, err := load_tenant_config(ctx, start.Tenant)
+	var newBackend func(int, streamEmit) (streamBackend, error)
+	if err == nil {
+		newBackend, err = stream_backend_factory(ctx, &record, tenant, start.SampleRate)
+	}
+	var assist *assistEngine
+	if err == nil {
+		if rules, ok := assist_config(tenant); ok {
+			sentiment := &nlpSentiment{}
+			defer sentiment.close()
+			assist = new_assist_engine(ctx, start.Callid, rules, streams.publish, sentiment.score, func(err error) {
+				writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Agent assist: %v", start.Callid, err))
+			})
+		}
+	}
+	var session *streamSession
+	if err == nil {
+		session, err = new_stream_session(start, streams.publish, assist, newBackend)
+	}
+	if err != nil {
+		streams.publish(StreamEvent{Type: streamError, Callid: start.Callid, Error: err.Error()})
+		return
+	}
+	session.record.Transcriber = record.Transcriber
+	session.tenant = tenant
+	//A live call starts now unless its metadata says otherwise
+	if session.record.callStart == "" {
+		session.record.callStart, session.record.callStartSource = time.Now().UTC().Format(time.RFC3339Nano), startStream
+	}
+	if err := set_call_time(&session.record, tenant, "", time.Time{}, time.Now()); err != nil {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Using UTC for the call start time: %v", start.Callid, err))
+	}
+	writeEntry(logger, logging.Info, "Streaming audio for callid: "+start.Callid)
+	for {
+		if err := frameCodec.Receive(ws, &frame); err != nil {
+			//The caller hung up without an end message; process what was received
+			break
+		}
+		if frame.text {
+			var msg struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(frame.data, &msg) == nil && msg.Type == "end" {
+				break
+			}
+			continue
+		}
+		if err := session.write(frame.data); err != nil {
+			streams.publish(StreamEvent{Type: streamError, Callid: start.Callid, Error: err.Error()})
+		}
+	}
+	result := session.finish(ctx, logger)
+	streams.publish(StreamEvent{Type: streamRecord, Callid: start.Callid, Record: result})
+}
@@ -0,0 +1,264 @@
+package function
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+func TestDecodeStreamAudio(t *testing.T) {
+	samples, err := decode_stream_audio(pcm16_bytes([]float32{0, 0.5, -0.5}), "LINEAR16")
+	if err != nil || len(samples) != 3 || samples[1] < 0.49 || samples[2] > -0.49 {
+		t.Errorf("LINEAR16 gave %v, %v", samples, err)
+	}
+	if samples, err := decode_stream_audio([]byte{0xff, 0x00}, "mulaw"); err != nil || len(samples) != 2 || samples[1] > -0.9 {
+		t.Errorf("MULAW gave %v, %v", samples, err)
+	}
+	if _, err := decode_stream_audio([]byte{1, 2, 3}, "LINEAR16"); err == nil {
+		t.Errorf("expected an error for an odd LINEAR16 frame")
+	}
+	if _, err := decode_stream_audio([]byte{1}, "OPUS"); err == nil {
+		t.Errorf("expected an error for an unsupported encoding")
+	}
+}
+
+func TestStreamHub(t *testing.T) {
+	hub := &streamHub{subscribers: map[string]map[chan StreamEvent]bool{}}
+	events, cancel := hub.subscribe("call-1")
+	other, cancelOther := hub.subscribe("call-2")
+	defer cancelOther()
+	hub.publish(StreamEvent{Type: streamFinal, Callid: "call-1", Transcript: "hello"})
+	if e := <-events; e.Transcript != "hello" {
+		t.Errorf("got %+v", e)
+	}
+	if len(other) != 0 {
+		t.Errorf("event delivered to another call")
+	}
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("channel not closed")
+	}
+	//Publishing after the subscription ended does not block
+	hub.publish(StreamEvent{Callid: "call-1"})
+}
+
+// Records the samples written and emits a result for each write
+type fakeStreamBackend struct {
+	channel int
+	emit    streamEmit
+	samples []float32
+	closed  bool
+}
+
+func (f *fakeStreamBackend) Write(samples []float32) error {
+	start := float64(len(f.samples)) / 8000
+	f.samples = append(f.samples, samples...)
+	end := float64(len(f.samples)) / 8000
+	word := &speechpb.WordInfo{Word: "word", StartTime: seconds_to_duration(start), EndTime: seconds_to_duration(end)}
+	result := &speechpb.SpeechRecognitionResult{
+		Alternatives:  []*speechpb.SpeechRecognitionAlternative{{Transcript: "word", Words: []*speechpb.WordInfo{word}}},
+		ChannelTag:    int32(f.channel),
+		ResultEndTime: seconds_to_duration(end),
+	}
+	f.emit(result, false, 0.5)
+	f.emit(result, true, 0)
+	return nil
+}
+
+func (f *fakeStreamBackend) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestStreamSession(t *testing.T) {
+	var events []StreamEvent
+	backends := map[int]*fakeStreamBackend{}
+	start := streamStart{Callid: "live-1", SampleRate: 8000, Channels: 2, Encoding: "LINEAR16", Metadata: map[string]string{"dlp": "true"}}
+	session, err := new_stream_session(start, func(e StreamEvent) { events = append(events, e) }, nil, func(channel int, emit streamEmit) (streamBackend, error) {
+		backends[channel] = &fakeStreamBackend{channel: channel, emit: emit}
+		return backends[channel], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.record.Dlp != "true" {
+		t.Errorf("metadata not applied: %+v", session.record)
+	}
+	frame := func(channel byte, n int) []byte {
+		return append([]byte{channel}, pcm16_bytes(make([]float32, n))...)
+	}
+	for _, f := range [][]byte{frame(2, 4000), frame(1, 8000), frame(2, 8000)} {
+		if err := session.write(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := session.write(frame(3, 10)); err == nil {
+		t.Errorf("expected an error for an unknown channel")
+	}
+	if len(events) != 6 || events[0].Type != streamInterim || events[1].Type != streamFinal || events[1].SpeakerTag != 2 || events[5].EndSecs != 1.5 {
+		t.Errorf("events = %+v", events)
+	}
+	if err := session.close(); err != nil || !backends[1].closed || !backends[2].closed {
+		t.Errorf("backends not closed: %v", err)
+	}
+	audio := session.recording()
+	if len(audio.Channels[0]) != 12000 || len(audio.Channels[1]) != 12000 {
+		t.Errorf("channels are %d and %d samples", len(audio.Channels[0]), len(audio.Channels[1]))
+	}
+	resp := session.response()
+	if len(resp.Results) != 3 || resp.Results[0].ChannelTag != 2 || resp.Results[1].ChannelTag != 1 || resp.Results[1].Alternatives[0].Transcript != " word" {
+		t.Errorf("response = %+v", resp.Results)
+	}
+}
+
+func TestStreamSessionDlp(t *testing.T) {
+	var events []StreamEvent
+	start := streamStart{Callid: "c-9", SampleRate: 8000, Channels: 1, Metadata: map[string]string{"dlp": "true"}}
+	session, err := new_stream_session(start, func(e StreamEvent) { events = append(events, e) }, nil, func(channel int, emit streamEmit) (streamBackend, error) {
+		return &fakeStreamBackend{channel: channel, emit: emit}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range []string{"call me on 409-866-5088", "it's four zero nine eight six six five zero eight eight"} {
+		result := &speechpb.SpeechRecognitionResult{Alternatives: []*speechpb.SpeechRecognitionAlternative{{Transcript: text}}, ResultEndTime: seconds_to_duration(float64(i + 1))}
+		session.emit(1)(result, i == 1, 0)
+	}
+	if len(events) != 2 || strings.Contains(events[0].Transcript, "409") || strings.Contains(events[1].Transcript, "eight") || !strings.HasPrefix(events[1].Transcript, "it's") {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+func TestStreamSessionAssist(t *testing.T) {
+	log := &alertLog{}
+	config := AssistConfig{Keywords: []KeywordRule{{Name: "cancellation", Phrases: []string{"cancel"}}}}
+	assist := new_assist_engine(context.Background(), "c-7", config, log.publish, nil, nil)
+	start := streamStart{Callid: "c-7", SampleRate: 8000, Channels: 1, Metadata: map[string]string{"dlp": "true"}}
+	session, err := new_stream_session(start, func(StreamEvent) {}, assist, func(channel int, emit streamEmit) (streamBackend, error) {
+		//A result that arrives before the session is returned
+		emit(assist_result("please cancel", 0), true, 0)
+		return &fakeStreamBackend{channel: channel, emit: emit}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assist.dlp {
+		t.Errorf("dlp not passed to the assist engine")
+	}
+	session.close()
+	if len(log.alerts) != 1 || log.alerts[0].Rule != "cancellation" {
+		t.Errorf("alerts = %+v", log.alerts)
+	}
+}
+
+func TestStreamingResult(t *testing.T) {
+	r := &speechpb.StreamingRecognitionResult{
+		Alternatives:  []*speechpb.SpeechRecognitionAlternative{{Transcript: "hi", Words: []*speechpb.WordInfo{{Word: "hi", StartTime: seconds_to_duration(1), EndTime: seconds_to_duration(1.5)}}}},
+		ResultEndTime: seconds_to_duration(2),
+	}
+	result := streaming_result(r, 2, 280)
+	if result.ChannelTag != 2 || get_seconds_from_duration(result.ResultEndTime) != 282 || get_seconds_from_duration(result.Alternatives[0].Words[0].StartTime) != 281 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestStreamSubscribe(t *testing.T) {
+	t.Setenv("STREAM_TOKEN_SECRET", "s3cret")
+	server := httptest.NewServer(websocket.Server{Handshake: check_stream_handshake, Handler: serve_stream})
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?subscribe=live-2"
+	if _, err := websocket.Dial(url, "", server.URL); err == nil {
+		t.Errorf("expected a subscriber without a token to be refused")
+	}
+	token, _ := Stream_token("live-2", time.Now().Add(time.Minute))
+	ws, err := websocket.Dial(url+"&token="+token, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	//Wait for the subscription to be registered
+	for i := 0; i < 100; i++ {
+		streams.mu.Lock()
+		n := len(streams.subscribers["live-2"])
+		streams.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	streams.publish(StreamEvent{Type: streamFinal, Callid: "live-2", Transcript: "hello there"})
+	var event StreamEvent
+	if err := websocket.JSON.Receive(ws, &event); err != nil || event.Transcript != "hello there" {
+		t.Errorf("got %+v, %v", event, err)
+	}
+}
+
+func TestStreamOrigin(t *testing.T) {
+	server := httptest.NewServer(websocket.Server{Handshake: check_stream_origin, Handler: serve_stream})
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?subscribe=x"
+	//Without STREAM_ORIGINS only the function's own origin is accepted
+	if _, err := websocket.Dial(url, "", "https://evil.example.com"); err == nil {
+		t.Errorf("expected a foreign origin to be refused")
+	}
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+	t.Setenv("STREAM_ORIGINS", "https://agent.example.com")
+	if _, err := websocket.Dial(url, "", "https://evil.example.com"); err == nil {
+		t.Errorf("expected the origin to be refused")
+	}
+	ws, err = websocket.Dial(url, "", "https://agent.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+}
+
+func TestStreamToken(t *testing.T) {
+	request := func(callid, token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/?subscribe="+callid, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	if _, err := Stream_token("c-1", time.Now().Add(time.Minute)); err == nil {
+		t.Errorf("expected an error without STREAM_TOKEN_SECRET")
+	}
+	if err := check_stream_token(request("c-1", "x"), "c-1", true); err == nil {
+		t.Errorf("expected requests to be refused without STREAM_TOKEN_SECRET")
+	}
+	t.Setenv("STREAM_TOKEN_SECRET", "s3cret")
+	call, _ := Stream_token("c-1", time.Now().Add(time.Minute))
+	all, _ := Stream_token(streamAllCalls, time.Now().Add(time.Minute))
+	expired, _ := Stream_token("c-1", time.Now().Add(-time.Minute))
+	for _, tt := range []struct {
+		token, callid string
+		follow, ok    bool
+	}{
+		{call, "c-1", false, true},
+		{call, "c-2", true, false},
+		{call, streamAllCalls, true, false},
+		{all, "c-2", true, true},
+		{all, streamAllCalls, true, true},
+		{all, "c-2", false, false},
+		{expired, "c-1", true, false},
+		{"", "c-1", true, false},
+	} {
+		if err := check_stream_token(request(tt.callid, tt.token), tt.callid, tt.follow); (err == nil) != tt.ok {
+			t.Errorf("token %q for %s, follow %v: %v", tt.token, tt.callid, tt.follow, err)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/?token="+call, nil)
+	if err := check_stream_token(r, "c-1", false); err != nil {
+		t.Errorf("query token: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TenantConfig holds the settings of one tenant, read from
+// <TENANT_CONFIG_DIR>/<tenant>.json. The tenant of a call comes from the
+// "tenant" metadata of the upload. Empty fields fall back to the
+// environment.
+type TenantConfig struct {
+	//Backend as accepted by get_transcriber
+	Transcriber string           `json:"transcriber"`
+	SpeechV2    SpeechV2Config   `json:"speechV2"`
+	Adaptation  AdaptationConfig `json:"adaptation"`
+	Assist      AssistConfig     `json:"assist"`
+	//Keyword dictionaries for spotting, added to KEYWORD_DICTIONARIES
+	Dictionaries []KeywordDictionary `json:"dictionaries"`
+	//IANA name of the site's timezone, e.g. "America/Chicago"
+	Timezone string `json:"timezone"`
+}
+
+// Reads the configuration of a tenant. Calls without a tenant, and
+// deployments without TENANT_CONFIG_DIR, get an empty configuration.
+// TENANT_CONFIG_DIR is a local directory or a gs://bucket/prefix.
+func load_tenant_config(ctx context.Context, tenant string) (*TenantConfig, error) {
+	cfg := &TenantConfig{}
+	dir := os.Getenv("TENANT_CONFIG_DIR")
+	if tenant == "" || dir == "" {
+		return cfg, nil
+	}
+	if strings.ContainsAny(tenant, `/\`) || strings.HasPrefix(tenant, ".") {
+		return cfg, fmt.Errorf("invalid tenant name %q", tenant)
+	}
+	location := strings.TrimSuffix(dir, "/") + "/" + tenant + ".json"
+	data, err := read_location(ctx, location)
+	if err != nil {
+		return cfg, fmt.Errorf("tenant %s: %v", tenant, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return &TenantConfig{}, fmt.Errorf("%s: %v", location, err)
+	}
+	if err := load_phrase_file(ctx, &cfg.Adaptation); err != nil {
+		return cfg, fmt.Errorf("tenant %s: %v", tenant, err)
+	}
+	if err := load_dictionary_files(ctx, cfg.Dictionaries); err != nil {
+		return cfg, fmt.Errorf("tenant %s: %v", tenant, err)
+	}
+	return cfg, nil
+}
+
+// Chooses the transcriber for a call. The upload's "transcriber" metadata
+// wins over the tenant's setting, which wins over TRANSCRIBER; a
+// "recognizer" metadata value overrides the tenant's v2 recognizer, and
+// "phrase_set" adds comma-separated phrase set resource names to the
+// tenant's adaptation.
+func select_transcriber(record *TranscriptRecord, cfg *TenantConfig) (Transcriber, error) {
+	name := record.metadata["transcriber"]
+	if name == "" {
+		name = cfg.Transcriber
+	}
+	if name == "" {
+		name = os.Getenv("TRANSCRIBER")
+	}
+	if name == "" {
+		name = "google"
+	}
+	record.Transcriber = name
+	call := *cfg
+	if recognizer := record.metadata["recognizer"]; recognizer != "" {
+		call.SpeechV2.Recognizer = recognizer
+	}
+	if sets := record.metadata["phrase_set"]; sets != "" {
+		call.Adaptation.PhraseSets = append([]string{}, cfg.Adaptation.PhraseSets...)
+		for _, name := range strings.Split(sets, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				call.Adaptation.PhraseSets = append(call.Adaptation.PhraseSets, name)
+			}
+		}
+	}
+	return get_transcriber(name, &call)
+}
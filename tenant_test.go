@@ -0,0 +1,63 @@
+package function
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTenantConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TENANT_CONFIG_DIR", dir)
+	config := `{"transcriber": "google-v2", "speechV2": {"recognizer": "projects/p/locations/eu/recognizers/acme", "features": {"profanityFilter": true}}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "acme.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	cfg, err := load_tenant_config(ctx, "acme")
+	if err != nil || cfg.Transcriber != "google-v2" || cfg.SpeechV2.Recognizer != "projects/p/locations/eu/recognizers/acme" || cfg.SpeechV2.Features["profanityFilter"] != true {
+		t.Errorf("acme: got %+v, %v", cfg, err)
+	}
+	if cfg, err := load_tenant_config(ctx, ""); err != nil || cfg.Transcriber != "" {
+		t.Errorf("no tenant: got %+v, %v", cfg, err)
+	}
+	if cfg, err := load_tenant_config(ctx, "globex"); err == nil || cfg == nil {
+		t.Errorf("missing tenant file: expected an error and a default configuration")
+	}
+	if _, err := load_tenant_config(ctx, "../acme"); err == nil {
+		t.Errorf("expected an error for a tenant name with a path in it")
+	}
+}
+
+func TestSelectTranscriber(t *testing.T) {
+	t.Setenv("TRANSCRIBER", "")
+	t.Setenv("PREPROCESS_RATE", "")
+	t.Setenv("PREPROCESS_CHANNELS", "")
+	cfg := &TenantConfig{Transcriber: "google-v2", SpeechV2: SpeechV2Config{Recognizer: "projects/p/locations/eu/recognizers/acme"}}
+
+	record := TranscriptRecord{}
+	transcriber, err := select_transcriber(&record, cfg)
+	if err != nil || record.Transcriber != "google-v2" {
+		t.Fatalf("tenant: got %s, %v", record.Transcriber, err)
+	}
+	if v2 := transcriber.(*speechV2Transcriber); v2.config.Recognizer != "projects/p/locations/eu/recognizers/acme" {
+		t.Errorf("recognizer = %s", v2.config.Recognizer)
+	}
+
+	//Per-call metadata overrides the tenant without changing its configuration
+	record = TranscriptRecord{metadata: map[string]string{"recognizer": "projects/p/locations/eu/recognizers/vip"}}
+	transcriber, _ = select_transcriber(&record, cfg)
+	if v2 := transcriber.(*speechV2Transcriber); v2.config.Recognizer != "projects/p/locations/eu/recognizers/vip" || cfg.SpeechV2.Recognizer != "projects/p/locations/eu/recognizers/acme" {
+		t.Errorf("recognizer override = %s, tenant now %s", v2.config.Recognizer, cfg.SpeechV2.Recognizer)
+	}
+	record = TranscriptRecord{metadata: map[string]string{"transcriber": "google"}}
+	if transcriber, _ := select_transcriber(&record, cfg); record.Transcriber != "google" {
+		t.Errorf("transcriber override gave %T", transcriber)
+	}
+
+	record = TranscriptRecord{}
+	if transcriber, _ := select_transcriber(&record, &TenantConfig{}); record.Transcriber != "google" {
+		t.Errorf("default gave %s (%T)", record.Transcriber, transcriber)
+	}
+}
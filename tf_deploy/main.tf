@@ -210,6 +210,574 @@ resource "google_bigquery_table" "default" {
         "mode": "REPEATED", 
         "name": "sentences", 
         "type": "RECORD"
+        }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "infotype", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "count", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "likelihood", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "speakertag", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "startSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "endSecs", 
+            "type": "FLOAT"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "redactions", 
+        "type": "RECORD"
+        }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "redactedaudio", 
+        "type": "STRING"
+    }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "startSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "endSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "channel", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "digit", 
+            "type": "STRING"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "keypresses", 
+        "type": "RECORD"
+        }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "speakeronespeaking", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "speakertwospeaking", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "silencesecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "silencepercentage", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "overtalksecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "silencedelta", 
+            "type": "FLOAT"
+        }, 
+        {
+            "fields": [
+            {
+                "mode": "NULLABLE", 
+                "name": "channel", 
+                "type": "INTEGER"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "startSecs", 
+                "type": "FLOAT"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "endSecs", 
+                "type": "FLOAT"
+            }
+            ], 
+            "mode": "REPEATED", 
+            "name": "segments", 
+            "type": "RECORD"
+        }
+        ], 
+        "mode": "NULLABLE", 
+        "name": "vad", 
+        "type": "RECORD"
+        }, 
+    {
+        "fields": [
+        {
+            "fields": [
+            {
+                "mode": "NULLABLE", 
+                "name": "channel", 
+                "type": "INTEGER"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "rmsdb", 
+                "type": "FLOAT"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "peakdb", 
+                "type": "FLOAT"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "clippingpercentage", 
+                "type": "FLOAT"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "snrdb", 
+                "type": "FLOAT"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "dcoffset", 
+                "type": "FLOAT"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "dropouts", 
+                "type": "INTEGER"
+            }, 
+            {
+                "mode": "NULLABLE", 
+                "name": "dropoutsecs", 
+                "type": "FLOAT"
+            }
+            ], 
+            "mode": "REPEATED", 
+            "name": "channels", 
+            "type": "RECORD"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "poor", 
+            "type": "BOOLEAN"
+        }, 
+        {
+            "mode": "REPEATED", 
+            "name": "issues", 
+            "type": "STRING"
+        }
+        ], 
+        "mode": "NULLABLE", 
+        "name": "quality", 
+        "type": "RECORD"
+        }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "kind", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "startSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "endSecs", 
+            "type": "FLOAT"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "holds", 
+        "type": "RECORD"
+        }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "holdsecs", 
+        "type": "FLOAT"
+    }, 
+    {
+        "mode": "REPEATED", 
+        "name": "normalizedaudio", 
+        "type": "STRING"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "waveform", 
+        "type": "STRING"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "waveformsvg", 
+        "type": "STRING"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "fingerprint", 
+        "type": "BYTES"
+    }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "fileid", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "callid", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "filename", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "similarity", 
+            "type": "FLOAT"
+        }
+        ], 
+        "mode": "NULLABLE", 
+        "name": "duplicate", 
+        "type": "RECORD"
+        }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "tenant", 
+        "type": "STRING"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "transcriber", 
+        "type": "STRING"
+    }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "result", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "rank", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "speakertag", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "startSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "endSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "transcript", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "confidence", 
+            "type": "FLOAT"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "alternatives", 
+        "type": "RECORD"
+        }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "word", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "startSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "endSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "speakertag", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "confidence", 
+            "type": "FLOAT"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "lowconfidence", 
+        "type": "RECORD"
+        }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "speakertag", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "words", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "confidence", 
+            "type": "FLOAT"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "speakerconfidence", 
+        "type": "RECORD"
+        }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "transcriptquality", 
+        "type": "FLOAT"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "needsreview", 
+        "type": "BOOLEAN"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "normalizedtranscript", 
+        "type": "STRING"
+    }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "kind", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "text", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "value", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "original", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "firstword", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "lastword", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "startSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "endSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "speakertag", 
+            "type": "INTEGER"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "normalizedspans", 
+        "type": "RECORD"
+        }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "agentid", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "agentname", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "queue", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "ani", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "dnis", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "direction", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "crmcustomerid", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "crmcaseid", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "source", 
+            "type": "STRING"
+        }
+        ], 
+        "mode": "NULLABLE", 
+        "name": "callmetadata", 
+        "type": "RECORD"
+        }, 
+    {
+        "mode": "REPEATED", 
+        "name": "metadataissues", 
+        "type": "STRING"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "timezone", 
+        "type": "STRING"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "starttimesource", 
+        "type": "STRING"
+    }, 
+    {
+        "mode": "NULLABLE", 
+        "name": "processedat", 
+        "type": "TIMESTAMP"
+    }, 
+    {
+        "fields": [
+        {
+            "mode": "NULLABLE", 
+            "name": "dictionary", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "term", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "match", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "text", 
+            "type": "STRING"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "speakertag", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "startSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "endSecs", 
+            "type": "FLOAT"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "firstword", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "lastword", 
+            "type": "INTEGER"
+        }, 
+        {
+            "mode": "NULLABLE", 
+            "name": "confidence", 
+            "type": "FLOAT"
+        }
+        ], 
+        "mode": "REPEATED", 
+        "name": "keywordhits", 
+        "type": "RECORD"
         }
 ]
 EOF
@@ -218,7 +786,7 @@ EOF
 resource "null_resource" "zipfile" {
   provisioner "local-exec" {
     working_dir = "../"
-    command = "zip -r -X function.zip go.mod go.sum transcript_process.go"
+    command = "zip -r -X function.zip go.mod go.sum *.go -x \"*_test.go\""
   }
 }
 
@@ -267,7 +835,8 @@ resource "google_storage_bucket_iam_member" "audio_member" {
 #   service_config {
 #     max_instance_count = 3
 #     min_instance_count = 1
-#     available_memory  = 256
+#     # Room for a recording of DECODE_MAX_MB decoded, its redacted copy and the chunks in flight
+#     available_memory  = "1Gi"
 #     service_account_email = var.service_account_email
 #     environment_variables = {
 #         "GOOGLE_CLOUD_PROJECT" = var.project_id
@@ -290,7 +859,7 @@ output "audio_uploads_bucket" {
 
 
 
-#  gcloud functions deploy call-audio-transcription --region=us-central1 --gen2 --memory=256 \
+#  gcloud functions deploy call-audio-transcription --region=us-central1 --gen2 --memory=1Gi \
 #   --trigger-resource=[AUDIO-BUCKET] \
 #   --trigger-event=google.storage.object.finalize --entry-point=Process_transcript --runtime=go116 \
 #   --service-account=[SERVICEACCOUNT] --source=gs://[FUNCTION-BUCKET]/function.zip --timeout=540 \
@@ -299,4 +868,15 @@ output "audio_uploads_bucket" {
 #   --set-env-vars="GOOGLE_TABLE_ID=transcripts" \
 #   --min-instances=5 --max-instances=5 --trigger-service-account=[SERVICEACCOUNT]
 
-# zip -r -X function.zip go.mod go.sum transcript_process.go
\ No newline at end of file
+#  Live calls (/stream and /alerts) are served by the cmd/main.go server and keep their
+#  subscribers in memory, so they run as one instance with a long request timeout:
+#  gcloud run deploy call-audio-streaming --region=us-central1 --source=. \
+#   --set-build-env-vars="GOOGLE_BUILDABLE=./cmd" \
+#   --max-instances=1 --min-instances=1 --timeout=3600 --no-cpu-throttling \
+#   --service-account=[SERVICEACCOUNT] \
+#   --set-env-vars="GOOGLE_CLOUD_PROJECT=callaudio" \
+#   --set-env-vars="GOOGLE_DATASET_ID=call_transcripts" \
+#   --set-env-vars="GOOGLE_TABLE_ID=transcripts" \
+#   --set-secrets="STREAM_TOKEN_SECRET=[SECRET]:latest"
+
+# zip -r -X function.zip go.mod go.sum *.go -x "*_test.go"
\ No newline at end of file
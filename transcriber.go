@@ -0,0 +1,337 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// TranscriptionJob is one recording to transcribe. Audio is the decoded
+// recording, nil when it could not be decoded. Backends that write files of
+// their own record where in Record.
+type TranscriptionJob struct {
+	Audio  *WavAudio
+	Bucket string
+	Name   string
+	Record *TranscriptRecord
+}
+
+// Transcriber turns a recording into recognition results in the shape
+// parse_transcript reads: one result per utterance, the channel in
+// ChannelTag, the words with their timings in the first alternative.
+type Transcriber interface {
+	Transcribe(ctx context.Context, job TranscriptionJob) (*speechpb.LongRunningRecognizeResponse, error)
+}
+
+// Returns the named backend, or the one in TRANSCRIBER when name is empty:
+// "google" (default), "google-v2", "local" or "canned". cfg carries the
+// tenant's backend settings and may be nil.
+func get_transcriber(name string, cfg *TenantConfig) (Transcriber, error) {
+	if name == "" {
+		name = os.Getenv("TRANSCRIBER")
+	}
+	if cfg == nil {
+		cfg = &TenantConfig{}
+	}
+	switch name {
+	case "", "google":
+		//A bad preprocessing setting is reported by the caller, and the audio sent as uploaded
+		preprocess, enabled, err := get_preprocess_config()
+		return &googleTranscriber{preprocess: preprocess, normalize: enabled && err == nil, preprocessErr: err, adaptation: speech_adaptation(cfg.Adaptation)}, nil
+	case "google-v2":
+		return new_speech_v2_transcriber(cfg.SpeechV2, cfg.Adaptation)
+	case "local":
+		t := &localTranscriber{url: os.Getenv("LOCAL_ASR_URL"), command: os.Getenv("LOCAL_ASR_COMMAND")}
+		for _, p := range cfg.Adaptation.Phrases {
+			t.prompt = append(t.prompt, p.Value)
+		}
+		if t.url == "" && t.command == "" {
+			return nil, fmt.Errorf("the local transcriber needs LOCAL_ASR_URL or LOCAL_ASR_COMMAND")
+		}
+		return t, nil
+	case "canned":
+		return load_canned_transcriber(context.Background(), os.Getenv("CANNED_RESPONSE"))
+	}
+	return nil, fmt.Errorf("unknown transcriber %q", name)
+}
+
+// Google Speech v1, with local preprocessing and chunking of long calls
+type googleTranscriber struct {
+	preprocess preprocessConfig
+	normalize  bool
+	//Why preprocessing is off despite PREPROCESS_* being set
+	preprocessErr error
+	adaptation    *speechpb.SpeechAdaptation
+}
+
+func (g *googleTranscriber) Transcribe(ctx context.Context, job TranscriptionJob) (*speechpb.LongRunningRecognizeResponse, error) {
+	var err error
+	var result *speechpb.LongRunningRecognizeResponse
+	if job.Audio != nil && g.normalize {
+		//Resample and remix a copy of the audio; the upload itself is left untouched
+		err, result, job.Record.Normalizedaudio = get_preprocessed_transcript(ctx, job.Audio, g.preprocess, job.Bucket, job.Name, g.adaptation)
+		return result, err
+	}
+	//Long calls that were not decoded are split using the header and read a chunk at a time
+	var src audioWindows
+	if job.Audio != nil {
+		src = job.Audio
+	} else if wav, err := open_gcs_wav(ctx, job.Bucket, job.Name); err == nil {
+		defer wav.close()
+		src = wav
+	}
+	if src != nil && src.Duration() > chunk_max_secs() {
+		err, result = get_chunked_transcript(ctx, src, job.Bucket, job.Name, g.adaptation)
+	} else {
+		err, result = get_audio_transcript(ctx, fmt.Sprintf("gs://%s/%s", job.Bucket, job.Name), g.adaptation)
+	}
+	return result, err
+}
+
+// Returns the same response for every recording, for tests and offline
+// development
+type cannedTranscriber struct {
+	response *speechpb.LongRunningRecognizeResponse
+}
+
+func (c *cannedTranscriber) Transcribe(ctx context.Context, job TranscriptionJob) (*speechpb.LongRunningRecognizeResponse, error) {
+	return c.response, nil
+}
+
+// Loads a saved Speech response, such as sample_transcript.json, from a
+// gs:// URI or local path
+func load_canned_transcriber(ctx context.Context, location string) (*cannedTranscriber, error) {
+	if location == "" {
+		return nil, fmt.Errorf("the canned transcriber needs CANNED_RESPONSE")
+	}
+	data, err := read_location(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	response := &speechpb.LongRunningRecognizeResponse{}
+	if err := json.Unmarshal(data, response); err != nil {
+		return nil, fmt.Errorf("%s: %v", location, err)
+	}
+	return &cannedTranscriber{response: response}, nil
+}
+
+// Rate open-source recognizers such as Whisper and Vosk work at
+const localAsrRate = 16000
+
+// Sends each channel to a locally running open-source recognizer, either
+// over HTTP (a Whisper-compatible /v1/audio/transcriptions endpoint) or by
+// running a command with the path of a WAV file appended. Both Whisper
+// verbose JSON and Vosk JSON output are understood.
+type localTranscriber struct {
+	url     string
+	command string
+	//Tenant phrases, passed to Whisper as its prompt
+	prompt []string
+}
+
+func (l *localTranscriber) Transcribe(ctx context.Context, job TranscriptionJob) (*speechpb.LongRunningRecognizeResponse, error) {
+	if job.Audio == nil {
+		return nil, fmt.Errorf("audio not decoded")
+	}
+	response := &speechpb.LongRunningRecognizeResponse{}
+	for c, samples := range job.Audio.Channels {
+		mono := &WavAudio{SampleRate: localAsrRate, BitsPerSample: 16, Channels: [][]float32{resample(samples, job.Audio.SampleRate, localAsrRate)}}
+		var output []byte
+		var err error
+		if l.url != "" {
+			output, err = l.post(ctx, encode_wav(mono))
+		} else {
+			output, err = l.run(ctx, encode_wav(mono))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("channel %d: %v", c+1, err)
+		}
+		results, err := parse_local_asr(output, int32(c+1))
+		if err != nil {
+			return nil, fmt.Errorf("channel %d: %v", c+1, err)
+		}
+		response.Results = append(response.Results, results...)
+	}
+	//Interleave the channels in time order, as a reader would follow the call
+	sort.SliceStable(response.Results, func(i, j int) bool {
+		return get_seconds_from_duration(response.Results[i].ResultEndTime) < get_seconds_from_duration(response.Results[j].ResultEndTime)
+	})
+	for i, result := range response.Results {
+		//parse_transcript joins the transcripts as they are
+		if i > 0 {
+			result.Alternatives[0].Transcript = " " + result.Alternatives[0].Transcript
+		}
+	}
+	return response, nil
+}
+
+func (l *localTranscriber) post(ctx context.Context, wav []byte) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "audio.wav")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(wav)
+	form.WriteField("response_format", "verbose_json")
+	form.WriteField("timestamp_granularities[]", "word")
+	form.WriteField("timestamp_granularities[]", "segment")
+	if len(l.prompt) > 0 {
+		form.WriteField("prompt", strings.Join(l.prompt, ", "))
+	}
+	form.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (l *localTranscriber) run(ctx context.Context, wav []byte) ([]byte, error) {
+	file, err := ioutil.TempFile("", "transcribe-*.wav")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(wav)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	args := append(strings.Fields(l.command), file.Name())
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Word and segment layouts of the recognizers we read. Whisper reports
+// "probability", Vosk "conf".
+type localAsrWord struct {
+	Word        string   `json:"word"`
+	Start       float64  `json:"start"`
+	End         float64  `json:"end"`
+	Probability *float64 `json:"probability"`
+	Conf        *float64 `json:"conf"`
+}
+
+type localAsrSegment struct {
+	Start float64        `json:"start"`
+	End   float64        `json:"end"`
+	Text  string         `json:"text"`
+	Words []localAsrWord `json:"words"`
+}
+
+type localAsrOutput struct {
+	Text     string            `json:"text"`
+	Segments []localAsrSegment `json:"segments"`
+	//Whisper with word timestamps only, or a Vosk result
+	Words  []localAsrWord `json:"words"`
+	Result []localAsrWord `json:"result"`
+}
+
+// Converts recognizer output into Speech results for one channel. The
+// output is a single JSON object or, as Vosk prints, one per line.
+func parse_local_asr(data []byte, channel int32) ([]*speechpb.SpeechRecognitionResult, error) {
+	var outputs []localAsrOutput
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var output localAsrOutput
+		if err := decoder.Decode(&output); err != nil {
+			return nil, fmt.Errorf("unreadable recognizer output: %v", err)
+		}
+		outputs = append(outputs, output)
+	}
+	var results []*speechpb.SpeechRecognitionResult
+	for _, output := range outputs {
+		segments := output.Segments
+		words := output.Words
+		if len(words) == 0 {
+			words = output.Result
+		}
+		if len(segments) == 0 && len(words) > 0 {
+			segments = []localAsrSegment{{Start: words[0].Start, End: words[len(words)-1].End, Text: output.Text, Words: words}}
+		} else if len(words) > 0 {
+			//Whisper lists word timestamps apart from the segments
+			for i := range segments {
+				if len(segments[i].Words) > 0 {
+					continue
+				}
+				for _, w := range words {
+					last := i == len(segments)-1
+					if w.Start >= segments[i].Start && (w.Start < segments[i].End || last) {
+						segments[i].Words = append(segments[i].Words, w)
+					}
+				}
+			}
+		}
+		for _, segment := range segments {
+			alt := &speechpb.SpeechRecognitionAlternative{Transcript: strings.TrimSpace(segment.Text)}
+			total := 0.0
+			for _, w := range segment.Words {
+				confidence := 0.0
+				if w.Probability != nil {
+					confidence = *w.Probability
+				} else if w.Conf != nil {
+					confidence = *w.Conf
+				}
+				total += confidence
+				alt.Words = append(alt.Words, &speechpb.WordInfo{
+					Word:       strings.TrimSpace(w.Word),
+					StartTime:  seconds_to_duration(w.Start),
+					EndTime:    seconds_to_duration(w.End),
+					Confidence: float32(confidence),
+				})
+			}
+			if len(alt.Words) > 0 {
+				alt.Confidence = float32(total / float64(len(alt.Words)))
+			}
+			if alt.Transcript == "" {
+				text := make([]string, len(alt.Words))
+				for i, w := range alt.Words {
+					text[i] = w.Word
+				}
+				alt.Transcript = strings.Join(text, " ")
+			}
+			if alt.Transcript == "" {
+				continue
+			}
+			results = append(results, &speechpb.SpeechRecognitionResult{
+				Alternatives:  []*speechpb.SpeechRecognitionAlternative{alt},
+				ChannelTag:    channel,
+				ResultEndTime: seconds_to_duration(segment.End),
+				LanguageCode:  "en-us",
+			})
+		}
+	}
+	return results, nil
+}
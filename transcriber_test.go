@@ -0,0 +1,171 @@
+package function
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const whisperOutput = `{"text": " Hello there. How can I help?", "segments": [
+	{"start": 0.5, "end": 1.4, "text": " Hello there.", "words": [
+		{"word": " Hello", "start": 0.5, "end": 0.9, "probability": 0.9},
+		{"word": " there.", "start": 0.9, "end": 1.4, "probability": 0.7}]},
+	{"start": 2.0, "end": 3.0, "text": " How can I help?", "words": [
+		{"word": " How", "start": 2.0, "end": 2.2, "probability": 0.8},
+		{"word": " can", "start": 2.2, "end": 2.4, "probability": 0.8},
+		{"word": " I", "start": 2.4, "end": 2.5, "probability": 0.8},
+		{"word": " help?", "start": 2.5, "end": 3.0, "probability": 0.8}]}]}`
+
+func TestParseLocalAsrWhisper(t *testing.T) {
+	results, err := parse_local_asr([]byte(whisperOutput), 2)
+	if err != nil {
+		t.Fatalf("parse_local_asr: %v", err)
+	}
+	if len(results) != 2 || results[0].ChannelTag != 2 {
+		t.Fatalf("got %d results", len(results))
+	}
+	alt := results[0].Alternatives[0]
+	if alt.Transcript != "Hello there." || len(alt.Words) != 2 || alt.Words[1].Word != "there." {
+		t.Errorf("first result = %q with %d words", alt.Transcript, len(alt.Words))
+	}
+	if get_seconds_from_duration(alt.Words[1].StartTime) != 0.9 || alt.Words[1].Confidence != 0.7 || alt.Confidence != 0.8 {
+		t.Errorf("word timing/confidence = %v, %v; result confidence %v", alt.Words[1].StartTime, alt.Words[1].Confidence, alt.Confidence)
+	}
+	if get_seconds_from_duration(results[1].ResultEndTime) != 3 {
+		t.Errorf("result end = %v, want 3s", results[1].ResultEndTime)
+	}
+
+	//OpenAI-style output lists the words apart from the segments
+	split := `{"text": "Hello there. How can I help?",
+		"segments": [{"start": 0.5, "end": 1.4, "text": "Hello there."}, {"start": 2.0, "end": 3.0, "text": "How can I help?"}],
+		"words": [{"word": "Hello", "start": 0.5, "end": 0.9}, {"word": "there", "start": 0.9, "end": 1.4},
+			{"word": "How", "start": 2.0, "end": 2.2}, {"word": "help", "start": 2.5, "end": 3.05}]}`
+	results, err = parse_local_asr([]byte(split), 1)
+	if err != nil || len(results) != 2 || len(results[0].Alternatives[0].Words) != 2 || len(results[1].Alternatives[0].Words) != 2 {
+		t.Errorf("words not assigned to segments: %v, %v", results, err)
+	}
+}
+
+func TestParseLocalAsrVosk(t *testing.T) {
+	output := `{"result": [{"conf": 1.0, "end": 1.02, "start": 0.6, "word": "one"}, {"conf": 0.5, "end": 1.5, "start": 1.02, "word": "zero"}], "text": "one zero"}
+{"text": ""}
+{"result": [{"conf": 0.9, "end": 4.0, "start": 3.5, "word": "nine"}], "text": "nine"}`
+	results, err := parse_local_asr([]byte(output), 1)
+	if err != nil {
+		t.Fatalf("parse_local_asr: %v", err)
+	}
+	if len(results) != 2 || results[0].Alternatives[0].Transcript != "one zero" || results[0].Alternatives[0].Confidence != 0.75 {
+		t.Errorf("got %v", results)
+	}
+	if _, err := parse_local_asr([]byte("segmentation fault"), 1); err == nil {
+		t.Errorf("expected an error for output that is not JSON")
+	}
+}
+
+func TestLocalTranscriberHttp(t *testing.T) {
+	var rates []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		audio, err := parse_wav(data)
+		if err != nil || len(audio.Channels) != 1 {
+			http.Error(w, "bad audio", http.StatusBadRequest)
+			return
+		}
+		rates = append(rates, audio.SampleRate)
+		if len(rates) == 1 {
+			w.Write([]byte(whisperOutput))
+			return
+		}
+		w.Write([]byte(`{"text": "Hi.", "segments": [{"start": 1.5, "end": 1.9, "text": "Hi.", "words": [{"word": "Hi.", "start": 1.5, "end": 1.9, "probability": 0.95}]}]}`))
+	}))
+	defer server.Close()
+
+	transcriber := &localTranscriber{url: server.URL}
+	record := TranscriptRecord{}
+	resp, err := transcriber.Transcribe(context.Background(), TranscriptionJob{Audio: make_test_tone(8000, 2, 4, 440, 0.1), Record: &record})
+	if err != nil {
+		t.Fatalf("Transcribe: %v", err)
+	}
+	if len(rates) != 2 || rates[0] != localAsrRate {
+		t.Errorf("recognizer received rates %v", rates)
+	}
+	if err := parse_transcript(resp, &record); err != nil {
+		t.Fatalf("parse_transcript: %v", err)
+	}
+	if record.Transcript != "Hello there. Hi. How can I help?" {
+		t.Errorf("transcript = %q", record.Transcript)
+	}
+	if len(record.Words) != 7 || record.Words[2].SpeakerTag != 2 || record.Duration != 3 {
+		t.Errorf("got %d words, third from speaker %d, duration %v", len(record.Words), record.Words[2].SpeakerTag, record.Duration)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	transcriber = &localTranscriber{url: failing.URL}
+	if _, err := transcriber.Transcribe(context.Background(), TranscriptionJob{Audio: make_test_tone(8000, 1, 1, 440, 0.1), Record: &record}); err == nil {
+		t.Errorf("expected an error from a failing recognizer")
+	}
+}
+
+func TestLocalTranscriberCommand(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "asr.sh")
+	body := "#!/bin/sh\n[ -s \"$1\" ] || exit 1\necho '{\"result\": [{\"conf\": 1.0, \"start\": 0.1, \"end\": 0.5, \"word\": \"hello\"}], \"text\": \"hello\"}'\n"
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	transcriber := &localTranscriber{command: "sh " + script}
+	resp, err := transcriber.Transcribe(context.Background(), TranscriptionJob{Audio: make_test_tone(8000, 1, 1, 440, 0.1), Record: &TranscriptRecord{}})
+	if err != nil {
+		t.Fatalf("Transcribe: %v", err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Alternatives[0].Words[0].Word != "hello" {
+		t.Errorf("got %v", resp.Results)
+	}
+}
+
+func TestGetTranscriber(t *testing.T) {
+	t.Setenv("CANNED_RESPONSE", "sample_transcript.json")
+	transcriber, err := get_transcriber("canned", nil)
+	if err != nil {
+		t.Fatalf("canned: %v", err)
+	}
+	resp, _ := transcriber.Transcribe(context.Background(), TranscriptionJob{})
+	record := TranscriptRecord{}
+	if err := parse_transcript(resp, &record); err != nil || len(record.Words) != 455 {
+		t.Errorf("canned response gave %d words, %v", len(record.Words), err)
+	}
+
+	t.Setenv("TRANSCRIBER", "")
+	t.Setenv("PREPROCESS_RATE", "")
+	t.Setenv("PREPROCESS_CHANNELS", "")
+	if transcriber, err := get_transcriber("", nil); err != nil {
+		t.Errorf("default: %v", err)
+	} else if _, ok := transcriber.(*googleTranscriber); !ok {
+		t.Errorf("default transcriber is %T", transcriber)
+	}
+	t.Setenv("PREPROCESS_RATE", "fast")
+	if transcriber, err := get_transcriber("google", nil); err != nil {
+		t.Errorf("invalid preprocessing: %v", err)
+	} else if g := transcriber.(*googleTranscriber); g.normalize || g.preprocessErr == nil {
+		t.Errorf("invalid preprocessing left normalize=%v, err=%v", g.normalize, g.preprocessErr)
+	}
+	t.Setenv("PREPROCESS_RATE", "")
+	t.Setenv("LOCAL_ASR_URL", "")
+	t.Setenv("LOCAL_ASR_COMMAND", "")
+	if _, err := get_transcriber("local", nil); err == nil {
+		t.Errorf("expected an error for a local transcriber without an endpoint")
+	}
+	if _, err := get_transcriber("telepathy", nil); err == nil {
+		t.Errorf("expected an error for an unknown transcriber")
+	}
+}
@@ -15,14 +15,12 @@ import (
 
 	// [START imports]
 	"cloud.google.com/go/bigquery"
-	dlp "cloud.google.com/go/dlp/apiv2"
 	language "cloud.google.com/go/language/apiv1"
 	"cloud.google.com/go/logging"
 	speech "cloud.google.com/go/speech/apiv1"
 	"cloud.google.com/go/storage"
 	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
 	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
-	dlppb "google.golang.org/genproto/googleapis/privacy/dlp/v2"
 	"google.golang.org/protobuf/types/known/durationpb"
 	// [END imports]
 )
@@ -82,6 +80,37 @@ type TranscriptRecord struct {
 		Sentiment float32 `json:"sentiment"`
 		Magnitude float32 `json:"magnitude"`
 	} `json:"sentences"`
+	Redactions         []RedactionSummary `json:"redactions"`
+	Redactedaudio      string `json:"redactedaudio"`
+	Keypresses         []DtmfEvent `json:"keypresses"`
+	Vad                VadMetrics `json:"vad"`
+	Quality            AudioQuality `json:"quality"`
+	Holds              []HoldSegment `json:"holds"`
+	Holdsecs           float64 `json:"holdsecs"`
+	Normalizedaudio    []string `json:"normalizedaudio"`
+	Waveform           string `json:"waveform"`
+	Waveformsvg        string `json:"waveformsvg"`
+	Fingerprint        []byte `json:"fingerprint"`
+	Duplicate          DuplicateMatch `json:"duplicate"`
+	Tenant             string `json:"tenant"`
+	Transcriber        string `json:"transcriber"`
+	Alternatives       []NbestAlternative `json:"alternatives"`
+	Lowconfidence      []LowConfidenceWord `json:"lowconfidence"`
+	Speakerconfidence  []SpeakerConfidence `json:"speakerconfidence"`
+	Transcriptquality  float64 `json:"transcriptquality"`
+	Needsreview        bool `json:"needsreview"`
+	Normalizedtranscript string `json:"normalizedtranscript"`
+	Normalizedspans    []NormalizedSpan `json:"normalizedspans"`
+	Callmetadata       CallMetadata `json:"callmetadata"`
+	Metadataissues     []string `json:"metadataissues"`
+	Timezone           string `json:"timezone"`
+	Starttimesource    string `json:"starttimesource"`
+	Processedat        time.Time `json:"processedat"`
+	Keywordhits        []KeywordHit `json:"keywordhits"`
+	redactedSpans      []RedactedSpan
+	callStart          string
+	callStartSource    string
+	metadata           map[string]string
 } 
 
 // GCSEvent is the payload of a GCS event.
@@ -121,6 +150,14 @@ type GCSEvent struct {
 
 //Triggered by Create/Finalize in the audio upload bucket
 func Process_transcript(ctx context.Context, e GCSEvent) error {
+	//Skip the files this function writes back to the bucket
+	if is_artifact(e.Name) {
+		return nil
+	}
+	//Sidecars are read with their recording
+	if is_sidecar(e.Name) {
+		return nil
+	}
 	record := TranscriptRecord{}
 	err := confirm_env_vars() ; if err != nil {
 		log.Fatalf("Missing environment variables: %v", err)
@@ -129,46 +166,230 @@ func Process_transcript(ctx context.Context, e GCSEvent) error {
 	if err != nil {
 		log.Fatalf("Failed to create logging client: %v", err)
 	}
+	//Packet captures are converted to a WAV upload, which is processed in turn
+	if is_pcap(e.Name) {
+		streams, err := ingest_pcap(ctx, e.Bucket, e.Name)
+		if err != nil {
+			writeEntry(logger, logging.Critical, fmt.Sprintf("Failed to convert packet capture %s: %v", e.Name, err))
+			return nil
+		}
+		for _, s := range streams {
+			writeEntry(logger, logging.Info, fmt.Sprintf("Converted RTP stream %08x from %s: %d packets, %d lost, %d with corrupt timestamps", s.SSRC, e.Name, s.Packets, s.Lost, s.Outliers))
+		}
+		return nil
+	}
 	//Read the metadata from the file
 	err = get_file_metadata(ctx, e.Bucket, e.Name, &record) 
 	if err != nil { 
 		log.Fatalf("Failed to get metadata from audio file: %v", err) 
 	}
+	//Add the agent, queue, numbers and start time from the CTI sidecar
+	err = load_call_metadata(ctx, e.Bucket, e.Name, &record)
+	if err != nil {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Failed to read call metadata sidecar: %v", record.Callid, err))
+	}
+	for _, issue := range record.Metadataissues {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Rejected call metadata: %s", record.Callid, issue))
+	}
 	file := e
-	record.Date = time.Now()
+	tenant, err := load_tenant_config(ctx, record.Tenant)
+	if err != nil {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Failed to load tenant configuration, using defaults: %v", record.Callid, err))
+	}
+	//Work out when the call started, from the metadata or file name, in the site's timezone
+	err = set_call_time(&record, tenant, file.Name, e.TimeCreated, time.Now())
+	if err != nil {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Using UTC for the call start time: %v", record.Callid, err))
+	}
 	record.Fileid = betterguid.New()
 	record.Filename = fmt.Sprintf("%s/%s", file.Bucket, file.Name)
 	writeEntry(logger, logging.Info, "Processing audio for callid: " + record.Callid + " | eventId: " + e.ID)
-	//Submit audio file to Google Speech API
-	err, result := get_audio_transcript(ctx, fmt.Sprintf("gs://%s/%s", file.Bucket, file.Name))
+	_, err = audio_analysis_stages() ; if err != nil {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Invalid AUDIO_ANALYSIS, running every stage: %v", record.Callid, err))
+	}
+	//Pick the transcriber chosen for the call and tenant, Google Speech API by default
+	transcriber, transcriberErr := select_transcriber(&record, tenant)
+	//Decode the recording once, and only when a stage reads its samples
+	var audio *WavAudio
+	if needs_samples(transcriber, &record) {
+		audio, err = read_gcs_wav(ctx, file.Bucket, file.Name)
+		if err != nil {
+			writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to decode audio file: %v", record.Callid, err))
+		}
+	}
+	//Check whether the same call was already uploaded under another name
+	if audio != nil {
+		skip, err := check_duplicate(ctx, audio, file.Bucket, &record)
+		if err != nil {
+			writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to check for duplicate uploads: %v", record.Callid, err))
+		}
+		if record.Duplicate.Fileid != "" {
+			writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Duplicate of %s (callid %s, similarity %.2f)", record.Callid, record.Duplicate.Filename, record.Duplicate.Callid, record.Duplicate.Similarity))
+		}
+		if skip {
+			return nil
+		}
+	}
+	//Find keypad tones, hold music and line problems in the audio
+	analyze_audio(logger, audio, &record)
+	//Submit audio file to the transcriber
+	var result *speechpb.LongRunningRecognizeResponse
+	err = transcriberErr
+	if g, ok := transcriber.(*googleTranscriber); ok && g.preprocessErr != nil {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Invalid preprocessing settings, sending the audio as uploaded: %v", record.Callid, g.preprocessErr))
+	}
+	if err == nil {
+		result, err = transcriber.Transcribe(ctx, TranscriptionJob{Audio: audio, Bucket: file.Bucket, Name: file.Name, Record: &record})
+	}
 	if err != nil {
 		writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to get transcript from audio file: %v", record.Callid, err))
 		//return err
 	}
+	//Build, analyze and commit the transcript record
+	finish_record(ctx, logger, audio, file.Bucket, file.Name, &record, tenant, result)
+	return nil
+}
+
+//Runs the local analysis of the decoded recording that does not need the transcript
+func analyze_audio(logger *logging.Client, audio *WavAudio, record *TranscriptRecord) {
+	//Find keypad tones, e.g. card numbers keyed by the caller
+	if audio != nil && audio_stage("dtmf") {
+		record.Keypresses = detect_dtmf(audio, pci_mode())
+	}
+	//Measure the line quality so poor audio can be told apart from poor calls
+	if audio != nil && audio_stage("quality") {
+		record.Quality = get_audio_quality(audio)
+		if record.Quality.Poor {
+			writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Poor audio quality: %s", record.Callid, strings.Join(record.Quality.Issues, "; ")))
+		}
+	}
+	//Find hold music and recorded prompts
+	if audio != nil && audio_stage("holds") {
+		record.Holds = detect_holds(audio)
+	}
+}
+
+//Local analysis stages that read the decoded samples, in the order they run
+var audioStages = []string{"dtmf", "quality", "holds", "vad", "waveform"}
+
+//Returns the stages listed in AUDIO_ANALYSIS, comma-separated, or none for "off".
+//All stages run when it is unset or names an unknown stage.
+func audio_analysis_stages() (map[string]bool, error) {
+	stages := map[string]bool{}
+	value := strings.TrimSpace(os.Getenv("AUDIO_ANALYSIS"))
+	if value == "off" {
+		return stages, nil
+	}
+	all := map[string]bool{}
+	for _, stage := range audioStages {
+		all[stage] = true
+	}
+	if value == "" {
+		return all, nil
+	}
+	for _, stage := range strings.Split(value, ",") {
+		stage = strings.TrimSpace(stage)
+		if !all[stage] {
+			return all, fmt.Errorf("unknown stage %q", stage)
+		}
+		stages[stage] = true
+	}
+	return stages, nil
+}
+
+//Reports whether a local analysis stage is enabled
+func audio_stage(stage string) bool {
+	stages, _ := audio_analysis_stages()
+	return stages[stage]
+}
+
+//Reports whether anything in this run reads the decoded samples. When nothing does,
+//the recording is not downloaded and Speech reads it from its gs:// URI.
+func needs_samples(transcriber Transcriber, record *TranscriptRecord) bool {
+	stages, _ := audio_analysis_stages()
+	if len(stages) > 0 {
+		return true
+	}
+	//Fingerprinting reports a bad DUPLICATES setting
+	if mode, err := duplicate_mode(); err != nil || mode != "off" {
+		return true
+	}
+	if record.Dlp == "true" && os.Getenv("AUDIO_REDACTION") != "off" {
+		return true
+	}
+	switch t := transcriber.(type) {
+	case *localTranscriber:
+		return true
+	case *googleTranscriber:
+		return t.normalize
+	}
+	return false
+}
+
+//Builds the transcript record from the recognition results, runs the remaining analysis
+//and redaction stages and commits it. Shared by uploads and streamed calls; artifacts
+//are only written when the recording is in a bucket.
+func finish_record(ctx context.Context, logger *logging.Client, audio *WavAudio, bucket, name string, record *TranscriptRecord, tenant *TenantConfig, result *speechpb.LongRunningRecognizeResponse) {
 	//Build the transcript record
-	err = parse_transcript(result, &record) ; if err != nil {
+	err := parse_transcript(result, record) ; if err != nil {
 		writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to parse transcript from audio file: %v", record.Callid, err))
 		//return err
 	}
+	//Write numbers, dates, amounts and spelled sequences in canonical form
+	normalize_transcript(record)
+	//Leave hold music and recorded prompts out of the talk and silence figures
+	exclude_hold(record, hold_ranges(record.Holds))
+	//Measure talk and silence from the audio and cross-check the transcript figures
+	if audio != nil && audio_stage("vad") {
+		record.Vad = get_vad_metrics(audio, hold_ranges(record.Holds))
+		if !check_vad_silence(&record.Vad, record) {
+			writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Silence from audio (%.1fs) and transcript (%.1fs) disagree", record.Callid, record.Vad.Silencesecs, record.Silencesecs))
+		}
+	}
+	//Write the waveform and speaker timeline for playback in the review tool
+	if audio != nil && bucket != "" && audio_stage("waveform") {
+		err = write_waveform(ctx, audio, bucket, name, record) ; if err != nil {
+			writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to write waveform: %v", record.Callid, err))
+		}
+	}
 	//Use DLP to redact sensitive data
 	if record.Dlp == "true" {
-		err = redact_transcript(ctx, &record) ; if err != nil {
+		err = redact_transcript(ctx, record) ; if err != nil {
 			writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to get DLP analysis from audio file: %v", record.Callid, err))
-			//return err
+			//Fall back to the local detector rather than commit an unredacted record
+			err = redact_record(ctx, []Redactor{&localRedactor{}}, record) ; if err != nil {
+				writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to redact transcript locally: %v", record.Callid, err))
+			}
+		}
+		//Write a copy of the audio with the redacted spans masked
+		if bucket != "" {
+			err = redact_audio(ctx, audio, bucket, name, record) ; if err != nil {
+				writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to redact audio file: %v", record.Callid, err))
+			}
 		}
 	}
+	//Score the recognition so poorly recognized calls can be sent for review
+	analyze_confidence(record)
+	if record.Needsreview {
+		writeEntry(logger, logging.Warning, fmt.Sprintf("CALLID: %s | Transcript quality %.2f is below the review threshold", record.Callid, record.Transcriptquality))
+	}
+	//Find the terms of the keyword dictionaries, after redaction so hits never hold PII
+	dictionaries, err := keyword_dictionaries(ctx, tenant)
+	if err != nil {
+		writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to load the shared keyword dictionaries, spotting the tenant's only: %v", record.Callid, err))
+	}
+	spot_keywords(record, dictionaries)
 	//Get the sentiment analysis
-	err = get_nlp_analysis(ctx, &record) ; if err != nil {
+	err = get_nlp_analysis(ctx, record) ; if err != nil {
 		writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to get sentiment analysis from audio file: %v", record.Callid, err))
 		//return err
 	}
 	//Commit BQ record
-	err = commit_transcript_record(ctx, &record) ; if err != nil {
+	err = commit_transcript_record(ctx, record) ; if err != nil {
 		writeEntry(logger, logging.Critical, fmt.Sprintf("CALLID: %s | Failed to commit transcript record to BigQuery: %v", record.Callid, err))
 		//return err
 	}
 	writeEntry(logger, logging.Info, "Completed processing transcript for callid: " + record.Callid)
-	return nil
 }
 
 func writeEntry(client *logging.Client, info logging.Severity, msg string) {
@@ -241,11 +462,12 @@ func get_file_metadata(ctx context.Context, bucket, filename string, record *Tra
 	}
 	record.Callid = attrs.Metadata["callid"]
 	record.Dlp = attrs.Metadata["dlp"]
+	record.Tenant = attrs.Metadata["tenant"]
+	record.metadata = attrs.Metadata
 	return nil
 }
 
-func get_audio_transcript(ctx context.Context, gcsUri string) (error, *speechpb.LongRunningRecognizeResponse) {
-	client, err := speech.NewClient(ctx)
+func get_audio_transcript(ctx context.Context, gcsUri string, adaptation *speechpb.SpeechAdaptation) (error, *speechpb.LongRunningRecognizeResponse) {
 	file := strings.Split(gcsUri, "/")
 	bucketName := file[2]
 	fileName := file[3]
@@ -253,20 +475,17 @@ func get_audio_transcript(ctx context.Context, gcsUri string) (error, *speechpb.
 	if err != nil {
 		return err, nil
 	}
+	return recognize_uri(ctx, gcsUri, sampleRate, 2, adaptation)
+}
+
+func recognize_uri(ctx context.Context, gcsUri string, sampleRate, channels int32, adaptation *speechpb.SpeechAdaptation) (error, *speechpb.LongRunningRecognizeResponse) {
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		return err, nil
+	}
+	defer client.Close()
 	req :=  &speechpb.LongRunningRecognizeRequest{
-		Config: &speechpb.RecognitionConfig{
-			SampleRateHertz:                     sampleRate,
-			LanguageCode:                        "en-US",
-			Encoding:                            speechpb.RecognitionConfig_LINEAR16,
-			AudioChannelCount:                   2,
-			EnableSeparateRecognitionPerChannel: true,
-			MaxAlternatives:                     0,
-			EnableAutomaticPunctuation:          true,
-			EnableWordTimeOffsets:               true,
-			EnableWordConfidence:                true,
-			UseEnhanced:                         true,
-			Model:                               "phone_call",
-		},
+		Config: recognition_config(sampleRate, channels, adaptation),
 		Audio: &speechpb.RecognitionAudio{
 			AudioSource: &speechpb.RecognitionAudio_Uri{Uri: gcsUri},
 		},
@@ -282,12 +501,32 @@ func get_audio_transcript(ctx context.Context, gcsUri string) (error, *speechpb.
 	return nil, resp
 }
 
+func recognition_config(sampleRate, channels int32, adaptation *speechpb.SpeechAdaptation) *speechpb.RecognitionConfig {
+	return &speechpb.RecognitionConfig{
+		SampleRateHertz:                     sampleRate,
+		LanguageCode:                        "en-US",
+		Encoding:                            speechpb.RecognitionConfig_LINEAR16,
+		AudioChannelCount:                   channels,
+		EnableSeparateRecognitionPerChannel: true,
+		MaxAlternatives:                     max_alternatives(),
+		EnableAutomaticPunctuation:          true,
+		EnableWordTimeOffsets:               true,
+		EnableWordConfidence:                true,
+		UseEnhanced:                         true,
+		Model:                               "phone_call",
+		Adaptation:                          adaptation,
+	}
+}
+
 func get_seconds_from_duration(duration *durationpb.Duration) float64 {
 	return float64(duration.Seconds) + float64(duration.Nanos) / 1e9
 }
 
 //Builds the transcript record from the transcript
 func parse_transcript(transcript *speechpb.LongRunningRecognizeResponse, record *TranscriptRecord) error {
+	if transcript == nil || len(transcript.Results) == 0 {
+		return fmt.Errorf("no transcription results")
+	}
 	transcriptText := ""
 	for _, result := range transcript.Results {
 		transcriptText += result.Alternatives[0].Transcript
@@ -325,6 +564,8 @@ func parse_transcript(transcript *speechpb.LongRunningRecognizeResponse, record
 	record.Silencesecs = float64(duration) - record.Speakeronespeaking - record.Speakertwospeaking
 	record.Silencepercentage = int(record.Silencesecs / float64(duration) * 100)
 	record.Nlcategory = "N/A"
+	//Keep the runner-up hypotheses when more than one was requested
+	record.Alternatives = nbest_alternatives(transcript)
 	return nil
 }
 
@@ -387,84 +628,71 @@ func get_nlp_analysis(ctx context.Context, record *TranscriptRecord) error {
 	return nil
 }
 
+//Redacts sensitive data with the redactors configured in REDACTORS
 func redact_transcript(ctx context.Context, record *TranscriptRecord) error {
-	//Get the DLP analysis
-	client, err := dlp.NewClient(ctx)
-	if err != nil {
+	redactors, err := get_redactors(ctx) ; if err != nil {
 		return err
 	}
-	defer client.Close()
-	var infoTypes []*dlppb.InfoType
-	req := &dlppb.DeidentifyContentRequest{
-		Parent: "projects/" + os.Getenv("GOOGLE_CLOUD_PROJECT"),
-		InspectConfig: &dlppb.InspectConfig{
-			InfoTypes: infoTypes,
-		},
-		DeidentifyConfig: &dlppb.DeidentifyConfig{
-			Transformation: &dlppb.DeidentifyConfig_InfoTypeTransformations{
-				InfoTypeTransformations: &dlppb.InfoTypeTransformations{
-					Transformations: []*dlppb.InfoTypeTransformations_InfoTypeTransformation{
-						{
-							InfoTypes: []*dlppb.InfoType{}, // Match all info types.
-							PrimitiveTransformation: &dlppb.PrimitiveTransformation{
-								Transformation: &dlppb.PrimitiveTransformation_CharacterMaskConfig{
-									CharacterMaskConfig: &dlppb.CharacterMaskConfig{
-										MaskingCharacter: "*",
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-		Item : &dlppb.ContentItem{
-			DataItem: &dlppb.ContentItem_Value{
-				Value: record.Transcript,
-			},
-		},
+	defer close_redactors(redactors)
+	return redact_record(ctx, redactors, record)
+}
+
+func redact_record(ctx context.Context, redactors []Redactor, record *TranscriptRecord) error {
+	//Redact PII read out over several words, e.g. spoken digits or spelling
+	err := redact_spoken(ctx, redactors, record) ; if err != nil {
+		return err
 	}
 	//Redact the combined transcript
-	dlpResponse, err := client.DeidentifyContent(ctx, req) ; if err != nil {
+	offsets := align_words(record.Transcript, record)
+	redacted, findings, err := redact_text(ctx, redactors, record.Transcript) ; if err != nil {
 		return err
 	}
-	record.Transcript = dlpResponse.GetItem().GetValue()
+	record.Transcript = redacted
+	for _, f := range findings {
+		add_redacted_span(record, f, finding_words(f, offsets, record))
+	}
 	//Redact the individual sentences
 	for i, sentence := range record.Sentences {
-		req.Item = &dlppb.ContentItem{
-			DataItem: &dlppb.ContentItem_Value{
-				Value: sentence.Sentence,
-			},
-		}
-		dlpResponse, err = client.DeidentifyContent(ctx, req) ; if err != nil {
+		redacted, findings, err = redact_text(ctx, redactors, sentence.Sentence) ; if err != nil {
 			return err
 		}
-		record.Sentences[i].Sentence = dlpResponse.GetItem().GetValue()
+		record.Sentences[i].Sentence = redacted
+		for _, f := range findings {
+			add_redacted_span(record, f, nil)
+		}
 	}
 	//Redact the individual words
 	for i, word := range record.Words {
-		req.Item = &dlppb.ContentItem{
-			DataItem: &dlppb.ContentItem_Value{
-				Value: word.Word,
-			},
+		redacted, findings, err = redact_text(ctx, redactors, word.Word) ; if err != nil {
+			return err
 		}
-		dlpResponse, err = client.DeidentifyContent(ctx, req) ; if err != nil {
+		record.Words[i].Word = redacted
+		for _, f := range findings {
+			add_redacted_span(record, f, []int{i})
+		}
+	}
+	//Redact the runner-up hypotheses, including PII read out over several words
+	for i, alt := range record.Alternatives {
+		redacted, spans, err := redact_unaligned_text(ctx, redactors, alt.Transcript) ; if err != nil {
 			return err
 		}
-	    record.Words[i].Word = dlpResponse.GetItem().GetValue()
+		record.Alternatives[i].Transcript = redacted
+		record.redactedSpans = append(record.redactedSpans, spans...)
 	}
 	//Redact the individual entities
 	for i, entity := range record.Entities {
-		req.Item = &dlppb.ContentItem{
-			DataItem: &dlppb.ContentItem_Value{
-				Value: entity.Name,
-			},
-		}
-		dlpResponse, err = client.DeidentifyContent(ctx, req) ; if err != nil {
+		redacted, findings, err = redact_text(ctx, redactors, entity.Name) ; if err != nil {
 			return err
 		}
-		record.Entities[i].Name = dlpResponse.GetItem().GetValue()
+		record.Entities[i].Name = redacted
+		for _, f := range findings {
+			add_redacted_span(record, f, nil)
+		}
 	}
+	record.redactedSpans = dedupe_redacted_spans(record.redactedSpans)
+	record.Redactions = summarize_redactions(record.redactedSpans)
+	//Rebuild the normalized transcript from the redacted words
+	normalize_transcript(record)
 	return nil
 }
 
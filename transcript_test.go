@@ -12,6 +12,7 @@ import (
 
 
 	// [START imports]
+	"cloud.google.com/go/bigquery"
 	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
 	// [END imports]
 )
@@ -101,7 +102,7 @@ func TestParseTranscript(t *testing.T) {
 
 func TestAudioTranscription(t *testing.T) {
 	ctx := context.Background()
-	err, resp := get_audio_transcript(ctx, fmt.Sprintf("gs://%s/%s", os.Getenv("BUCKET_NAME"), os.Getenv("TEST_FILE")))
+	err, resp := get_audio_transcript(ctx, fmt.Sprintf("gs://%s/%s", os.Getenv("BUCKET_NAME"), os.Getenv("TEST_FILE")), nil)
 	if err != nil {
 		t.Errorf("get_audio_transcript: %v", err)
 	}
@@ -182,4 +183,99 @@ func TestCommitBQ(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error in commit_bq: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+//The BigQuery table schema must cover every field inserted from TranscriptRecord
+func TestBigQuerySchemaMatchesRecord(t *testing.T) {
+	schemaFile, err := ioutil.ReadFile("tf_deploy/bq_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableSchema, err := bigquery.SchemaFromJSON(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSchema, err := bigquery.InferSchema(TranscriptRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare_schemas(t, "", recordSchema, tableSchema)
+}
+
+func compare_schemas(t *testing.T, prefix string, record, table bigquery.Schema) {
+	for _, field := range record {
+		var match *bigquery.FieldSchema
+		for _, candidate := range table {
+			if strings.EqualFold(candidate.Name, field.Name) {
+				match = candidate
+			}
+		}
+		if match == nil {
+			t.Errorf("field %s%s missing from bq_schema.json", prefix, field.Name)
+			continue
+		}
+		if match.Type != field.Type || match.Repeated != field.Repeated {
+			t.Errorf("field %s%s: got %s (repeated %v), want %s (repeated %v)", prefix, field.Name, match.Type, match.Repeated, field.Type, field.Repeated)
+		}
+		if field.Type == bigquery.RecordFieldType {
+			compare_schemas(t, prefix+field.Name+".", field.Schema, match.Schema)
+		}
+	}
+}
+
+func TestAudioAnalysisStages(t *testing.T) {
+	t.Setenv("AUDIO_ANALYSIS", "")
+	stages, err := audio_analysis_stages() ; if err != nil || len(stages) != len(audioStages) {
+		t.Errorf("unset: got %v, %v, want every stage", stages, err)
+	}
+	t.Setenv("AUDIO_ANALYSIS", "dtmf, vad")
+	stages, err = audio_analysis_stages() ; if err != nil || len(stages) != 2 || !stages["dtmf"] || !stages["vad"] {
+		t.Errorf("dtmf, vad: got %v, %v", stages, err)
+	}
+	t.Setenv("AUDIO_ANALYSIS", "off")
+	stages, err = audio_analysis_stages() ; if err != nil || len(stages) != 0 {
+		t.Errorf("off: got %v, %v, want none", stages, err)
+	}
+	t.Setenv("AUDIO_ANALYSIS", "dtmf,music")
+	stages, err = audio_analysis_stages() ; if err == nil || len(stages) != len(audioStages) {
+		t.Errorf("unknown stage: got %v, %v, want every stage and an error", stages, err)
+	}
+}
+
+func TestNeedsSamples(t *testing.T) {
+	t.Setenv("AUDIO_ANALYSIS", "off")
+	t.Setenv("DUPLICATES", "off")
+	t.Setenv("AUDIO_REDACTION", "")
+	google := &googleTranscriber{}
+	if needs_samples(google, &TranscriptRecord{}) {
+		t.Errorf("google with every stage off: got true, want the gs:// URI to be used")
+	}
+	if needs_samples(&cannedTranscriber{}, &TranscriptRecord{}) {
+		t.Errorf("canned with every stage off: got true, want false")
+	}
+	if needs_samples(nil, &TranscriptRecord{}) {
+		t.Errorf("no transcriber with every stage off: got true, want false")
+	}
+	if !needs_samples(&googleTranscriber{normalize: true}, &TranscriptRecord{}) {
+		t.Errorf("google with preprocessing: got false, want true")
+	}
+	if !needs_samples(&localTranscriber{}, &TranscriptRecord{}) {
+		t.Errorf("local transcriber: got false, want true")
+	}
+	if !needs_samples(google, &TranscriptRecord{Dlp: "true"}) {
+		t.Errorf("dlp with audio redaction: got false, want true")
+	}
+	t.Setenv("AUDIO_REDACTION", "off")
+	if needs_samples(google, &TranscriptRecord{Dlp: "true"}) {
+		t.Errorf("dlp without audio redaction: got true, want false")
+	}
+	t.Setenv("DUPLICATES", "")
+	if !needs_samples(google, &TranscriptRecord{}) {
+		t.Errorf("duplicate detection: got false, want true")
+	}
+	t.Setenv("DUPLICATES", "off")
+	t.Setenv("AUDIO_ANALYSIS", "holds")
+	if !needs_samples(google, &TranscriptRecord{}) {
+		t.Errorf("hold detection: got false, want true")
+	}
+}
@@ -0,0 +1,186 @@
+package function
+
+import (
+	"math"
+	"sort"
+)
+
+// VadSegment is a stretch of speech detected on one channel.
+type VadSegment struct {
+	Channel   int     `json:"channel"`
+	StartSecs float64 `json:"startSecs"`
+	EndSecs   float64 `json:"endSecs"`
+}
+
+// VadMetrics are talk and silence measures computed from the audio itself,
+// independently of the word timings returned by Speech.
+type VadMetrics struct {
+	Speakeronespeaking float64 `json:"speakeronespeaking"`
+	Speakertwospeaking float64 `json:"speakertwospeaking"`
+	Silencesecs        float64 `json:"silencesecs"`
+	Silencepercentage  int     `json:"silencepercentage"`
+	Overtalksecs       float64 `json:"overtalksecs"`
+	//VAD silence minus the silence derived from the transcript
+	Silencedelta float64      `json:"silencedelta"`
+	Segments     []VadSegment `json:"segments"`
+}
+
+const (
+	vadFrameSecs = 0.02
+	//Frames this far above the channel's noise floor count as speech
+	vadThresholdDb = 10.0
+	//Frames quieter than this never count as speech
+	vadMinLevelDb = -50.0
+	//Percentile of frame levels taken as the noise floor
+	vadNoisePercentile = 0.1
+	//Pauses shorter than this are kept inside a speech segment
+	vadMaxGapSecs = 0.3
+	//Bursts shorter than this are clicks rather than speech
+	vadMinSpeechSecs = 0.1
+	//Disagreement with the transcript silence, as a share of the call, that
+	//gets logged
+	vadSilenceTolerance = 0.2
+)
+
+// Level of each analysis frame in dBFS
+func frame_levels(samples []float32, frame int) []float64 {
+	var levels []float64
+	for i := 0; i+frame <= len(samples); i += frame {
+		sum := 0.0
+		for _, x := range samples[i : i+frame] {
+			sum += float64(x) * float64(x)
+		}
+		levels = append(levels, 20*math.Log10(math.Sqrt(sum/float64(frame))+1e-9))
+	}
+	return levels
+}
+
+// Returns the value below which the given share of levels fall
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// Marks each frame of a channel as speech or not, with short pauses bridged
+// and short bursts dropped.
+func speech_frames(samples []float32, rate int) []bool {
+	frame := int(vadFrameSecs * float64(rate))
+	if frame == 0 {
+		return nil
+	}
+	levels := frame_levels(samples, frame)
+	threshold := math.Max(percentile(levels, vadNoisePercentile)+vadThresholdDb, vadMinLevelDb)
+	speech := make([]bool, len(levels))
+	for i, level := range levels {
+		speech[i] = level >= threshold
+	}
+	fill_runs(speech, false, int(vadMaxGapSecs/vadFrameSecs))
+	fill_runs(speech, true, int(vadMinSpeechSecs/vadFrameSecs))
+	return speech
+}
+
+// Flips interior runs of value shorter than min frames. Leading and
+// trailing runs of silence are left alone.
+func fill_runs(flags []bool, value bool, min int) {
+	for i := 0; i < len(flags); {
+		if flags[i] != value {
+			i++
+			continue
+		}
+		j := i
+		for j < len(flags) && flags[j] == value {
+			j++
+		}
+		interior := i > 0 && j < len(flags)
+		if j-i < min && (value || interior) {
+			for k := i; k < j; k++ {
+				flags[k] = !value
+			}
+		}
+		i = j
+	}
+}
+
+// Converts per-frame speech flags into segments
+func speech_segments(flags []bool, channel int) []VadSegment {
+	var segments []VadSegment
+	for i := 0; i < len(flags); {
+		if !flags[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(flags) && flags[j] {
+			j++
+		}
+		segments = append(segments, VadSegment{
+			Channel:   channel,
+			StartSecs: float64(i) * vadFrameSecs,
+			EndSecs:   float64(j) * vadFrameSecs,
+		})
+		i = j
+	}
+	return segments
+}
+
+// Runs voice activity detection over every channel and derives talk time,
+// overtalk and silence from it. Frames inside the hold ranges count towards
+// none of them.
+func get_vad_metrics(audio *WavAudio, holds []AudioSegment) VadMetrics {
+	metrics := VadMetrics{}
+	var channels [][]bool
+	frames := 0
+	for c, samples := range audio.Channels {
+		flags := speech_frames(samples, audio.SampleRate)
+		channels = append(channels, flags)
+		metrics.Segments = append(metrics.Segments, speech_segments(flags, c+1)...)
+		frames = len(flags)
+	}
+	silent, overtalk, counted := 0, 0, 0
+	talk := make([]int, len(channels))
+	for f := 0; f < frames; f++ {
+		if in_segments((float64(f)+0.5)*vadFrameSecs, holds) {
+			continue
+		}
+		counted++
+		speaking := 0
+		for c, flags := range channels {
+			if flags[f] {
+				talk[c]++
+				speaking++
+			}
+		}
+		if speaking == 0 {
+			silent++
+		}
+		if speaking > 1 {
+			overtalk++
+		}
+	}
+	if len(talk) > 0 {
+		metrics.Speakeronespeaking = float64(talk[0]) * vadFrameSecs
+	}
+	if len(talk) > 1 {
+		metrics.Speakertwospeaking = float64(talk[1]) * vadFrameSecs
+	}
+	metrics.Silencesecs = float64(silent) * vadFrameSecs
+	metrics.Overtalksecs = float64(overtalk) * vadFrameSecs
+	if counted > 0 {
+		metrics.Silencepercentage = silent * 100 / counted
+	}
+	return metrics
+}
+
+// Compares the VAD silence with the transcript-based figure. Returns false
+// when they disagree by more than vadSilenceTolerance of the call.
+func check_vad_silence(metrics *VadMetrics, record *TranscriptRecord) bool {
+	metrics.Silencedelta = metrics.Silencesecs - record.Silencesecs
+	if record.Duration == 0 {
+		return true
+	}
+	return math.Abs(metrics.Silencedelta) <= vadSilenceTolerance*record.Duration
+}
@@ -0,0 +1,79 @@
+package function
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Builds 8 kHz audio where each channel carries a tone in the given range
+// over a low noise floor.
+func make_talk_audio(secs float64, ranges ...AudioSegment) *WavAudio {
+	rate := 8000
+	rng := rand.New(rand.NewSource(3))
+	audio := &WavAudio{SampleRate: rate, BitsPerSample: 16}
+	for _, r := range ranges {
+		samples := make([]float32, int(secs*float64(rate)))
+		for i := range samples {
+			t := float64(i) / float64(rate)
+			samples[i] = float32(rng.NormFloat64() * 0.001)
+			if t >= r.StartSecs && t < r.EndSecs {
+				samples[i] += float32(0.3 * math.Sin(2*math.Pi*300*t))
+			}
+		}
+		audio.Channels = append(audio.Channels, samples)
+	}
+	return audio
+}
+
+func TestVadMetrics(t *testing.T) {
+	audio := make_talk_audio(4, AudioSegment{0, 2}, AudioSegment{1, 3})
+	m := get_vad_metrics(audio, nil)
+	near := func(name string, got, want float64) {
+		if math.Abs(got-want) > 0.05 {
+			t.Errorf("%s: got %.2f, want %.2f", name, got, want)
+		}
+	}
+	near("speaker one", m.Speakeronespeaking, 2)
+	near("speaker two", m.Speakertwospeaking, 2)
+	near("overtalk", m.Overtalksecs, 1)
+	near("silence", m.Silencesecs, 1)
+	if m.Silencepercentage != 25 {
+		t.Errorf("got silence percentage %d, want 25", m.Silencepercentage)
+	}
+	if len(m.Segments) != 2 || m.Segments[1].Channel != 2 {
+		t.Errorf("got segments %+v, want one per channel", m.Segments)
+	}
+}
+
+func TestVadMetricsExcludeHold(t *testing.T) {
+	audio := make_talk_audio(4, AudioSegment{0, 2}, AudioSegment{1, 3})
+	m := get_vad_metrics(audio, []AudioSegment{{3, 4}})
+	if m.Silencesecs != 0 || m.Speakertwospeaking < 1.9 {
+		t.Errorf("got silence %.2f and speaker two %.2f, want 0 and 2", m.Silencesecs, m.Speakertwospeaking)
+	}
+}
+
+func TestFillRuns(t *testing.T) {
+	flags := []bool{false, true, true, false, true, true, true, false, false, false, true, false}
+	fill_runs(flags, false, 2)
+	fill_runs(flags, true, 2)
+	want := []bool{false, true, true, true, true, true, true, false, false, false, false, false}
+	for i := range want {
+		if flags[i] != want[i] {
+			t.Fatalf("got %v, want %v", flags, want)
+		}
+	}
+}
+
+func TestCheckVadSilence(t *testing.T) {
+	record := TranscriptRecord{Duration: 100, Silencesecs: 30}
+	m := VadMetrics{Silencesecs: 35}
+	if !check_vad_silence(&m, &record) || m.Silencedelta != 5 {
+		t.Errorf("got delta %.1f, want 5 within tolerance", m.Silencedelta)
+	}
+	m.Silencesecs = 60
+	if check_vad_silence(&m, &record) {
+		t.Errorf("30s disagreement not flagged")
+	}
+}
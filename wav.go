@@ -0,0 +1,301 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// Sample rates accepted from uploads. The analysis frames are sized from
+// the rate, so a rate of 0 or close to it would leave them empty.
+const (
+	wavMinSampleRate = 4000
+	wavMaxSampleRate = 192000
+)
+
+// WavAudio holds decoded audio with one slice of samples per channel, scaled
+// to [-1, 1]. BitsPerSample is the PCM depth used when it is encoded again.
+type WavAudio struct {
+	SampleRate    int
+	BitsPerSample int
+	Channels      [][]float32
+}
+
+// Returns the length of the audio in seconds
+func (a *WavAudio) Duration() float64 {
+	if len(a.Channels) == 0 || a.SampleRate == 0 {
+		return 0
+	}
+	return float64(len(a.Channels[0])) / float64(a.SampleRate)
+}
+
+// Returns a deep copy of the audio
+func clone_audio(a *WavAudio) *WavAudio {
+	c := &WavAudio{SampleRate: a.SampleRate, BitsPerSample: a.BitsPerSample, Channels: make([][]float32, len(a.Channels))}
+	for i, samples := range a.Channels {
+		c.Channels[i] = append([]float32(nil), samples...)
+	}
+	return c
+}
+
+// Converts a time in seconds to a sample index clamped to the audio length
+func (a *WavAudio) sample_index(secs float64) int {
+	i := int(math.Round(secs * float64(a.SampleRate)))
+	if i < 0 {
+		return 0
+	}
+	if len(a.Channels) > 0 && i > len(a.Channels[0]) {
+		return len(a.Channels[0])
+	}
+	return i
+}
+
+// Returns the body of the fmt chunk and the sample data of a RIFF/WAVE file
+func wav_chunks(data []byte) ([]byte, []byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, nil, fmt.Errorf("not a RIFF/WAVE file")
+	}
+	var fmtChunk, samples []byte
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+		//Recorders that stream WAV often leave the data size unset
+		if size > len(data)-body || size < 0 {
+			size = len(data) - body
+		}
+		switch id {
+		case "fmt ":
+			fmtChunk = data[body : body+size]
+		case "data":
+			samples = data[body : body+size]
+		}
+		pos = body + size + size%2
+	}
+	if fmtChunk == nil {
+		return nil, nil, fmt.Errorf("missing fmt chunk")
+	}
+	if samples == nil {
+		return nil, nil, fmt.Errorf("missing data chunk")
+	}
+	return fmtChunk, samples, nil
+}
+
+// wavFormat is the sample layout of a WAV file and where its samples are
+type wavFormat struct {
+	SampleRate int
+	Channels   int
+	Bits       int
+	Format     int
+	//Position and length of the sample data in the file
+	DataOffset int64
+	DataSize   int64
+}
+
+// Bytes taken by one sample on every channel
+func (f wavFormat) frame_width() int {
+	return f.Bits / 8 * f.Channels
+}
+
+// Number of complete frames in the sample data
+func (f wavFormat) frames() int64 {
+	return f.DataSize / int64(f.frame_width())
+}
+
+// Returns the length of the audio in seconds
+func (f wavFormat) Duration() float64 {
+	return float64(f.frames()) / float64(f.SampleRate)
+}
+
+// Memory needed to hold every sample decoded
+func (f wavFormat) decoded_bytes() int64 {
+	return f.frames() * int64(f.Channels) * 4
+}
+
+// Reads the format of a RIFF/WAVE file of size bytes from its first bytes,
+// which must hold the fmt chunk and the start of the data chunk
+func wav_header(head []byte, size int64) (wavFormat, error) {
+	var f wavFormat
+	if len(head) < 12 || string(head[0:4]) != "RIFF" || string(head[8:12]) != "WAVE" {
+		return f, fmt.Errorf("not a RIFF/WAVE file")
+	}
+	var fmtChunk []byte
+	found := false
+	for pos := 12; pos+8 <= len(head); {
+		id := string(head[pos : pos+4])
+		chunkSize := int64(binary.LittleEndian.Uint32(head[pos+4 : pos+8]))
+		body := int64(pos + 8)
+		//Recorders that stream WAV often leave the data size unset
+		if chunkSize > size-body {
+			chunkSize = size - body
+		}
+		switch id {
+		case "fmt ":
+			if body+chunkSize > int64(len(head)) {
+				return f, fmt.Errorf("fmt chunk too long")
+			}
+			fmtChunk = head[body : body+chunkSize]
+		case "data":
+			f.DataOffset, f.DataSize = body, chunkSize
+			found = true
+		}
+		next := body + chunkSize + chunkSize%2
+		if next > int64(len(head)) {
+			break
+		}
+		pos = int(next)
+	}
+	if fmtChunk == nil {
+		return f, fmt.Errorf("missing fmt chunk")
+	}
+	if !found {
+		return f, fmt.Errorf("missing data chunk")
+	}
+	if len(fmtChunk) < 16 {
+		return f, fmt.Errorf("fmt chunk too short")
+	}
+	f.Format = int(binary.LittleEndian.Uint16(fmtChunk[0:2]))
+	f.Channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+	f.SampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+	f.Bits = int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+	if f.Format == wavFormatExtensible && len(fmtChunk) >= 26 {
+		f.Format = int(binary.LittleEndian.Uint16(fmtChunk[24:26]))
+	}
+	if f.Channels == 0 || f.Bits == 0 {
+		return f, fmt.Errorf("missing fmt chunk")
+	}
+	if f.SampleRate < wavMinSampleRate || f.SampleRate > wavMaxSampleRate {
+		return f, fmt.Errorf("unsupported sample rate %d Hz", f.SampleRate)
+	}
+	if _, err := wav_decoder(f); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// Returns the function that scales one sample of the format to [-1, 1]
+func wav_decoder(f wavFormat) (func(b []byte) float32, error) {
+	switch {
+	case f.Format == wavFormatPCM && f.Bits == 8:
+		return func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }, nil
+	case f.Format == wavFormatPCM && f.Bits == 16:
+		return func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / 32768 }, nil
+	case f.Format == wavFormatPCM && f.Bits == 24:
+		return func(b []byte) float32 {
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			return float32(v) / 8388608
+		}, nil
+	case f.Format == wavFormatPCM && f.Bits == 32:
+		return func(b []byte) float32 { return float32(float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648) }, nil
+	case f.Format == wavFormatFloat && f.Bits == 32:
+		return func(b []byte) float32 { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }, nil
+	}
+	return nil, fmt.Errorf("unsupported WAV encoding: format %d, %d bits", f.Format, f.Bits)
+}
+
+// Frames decoded per read, so the raw samples are never all in memory
+const wavDecodeFrames = 8192
+
+// Decodes frames of sample data read from r
+func decode_frames(f wavFormat, r io.Reader, frames int) (*WavAudio, error) {
+	decode, err := wav_decoder(f)
+	if err != nil {
+		return nil, err
+	}
+	audio := &WavAudio{SampleRate: f.SampleRate, BitsPerSample: f.Bits, Channels: make([][]float32, f.Channels)}
+	if f.Format == wavFormatFloat {
+		audio.BitsPerSample = 16
+	}
+	for c := range audio.Channels {
+		audio.Channels[c] = make([]float32, frames)
+	}
+	width := f.Bits / 8
+	buf := make([]byte, wavDecodeFrames*f.frame_width())
+	for done := 0; done < frames; {
+		n := frames - done
+		if n > wavDecodeFrames {
+			n = wavDecodeFrames
+		}
+		block := buf[:n*f.frame_width()]
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			for c := 0; c < f.Channels; c++ {
+				off := (i*f.Channels + c) * width
+				audio.Channels[c][done+i] = decode(block[off : off+width])
+			}
+		}
+		done += n
+	}
+	return audio, nil
+}
+
+// Decodes a RIFF/WAVE file holding integer PCM or 32-bit float samples
+func parse_wav(data []byte) (*WavAudio, error) {
+	f, err := wav_header(data, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	return decode_frames(f, bytes.NewReader(data[f.DataOffset:]), int(f.frames()))
+}
+
+// Encodes the audio as an integer PCM WAV file at audio.BitsPerSample
+func encode_wav(audio *WavAudio) []byte {
+	bits := audio.BitsPerSample
+	if bits != 8 && bits != 24 && bits != 32 {
+		bits = 16
+	}
+	width := bits / 8
+	channels := len(audio.Channels)
+	frames := 0
+	if channels > 0 {
+		frames = len(audio.Channels[0])
+	}
+	dataSize := frames * channels * width
+	buf := bytes.NewBuffer(make([]byte, 0, 44+dataSize))
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(36+dataSize))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(buf, binary.LittleEndian, uint32(16))
+	binary.Write(buf, binary.LittleEndian, uint16(wavFormatPCM))
+	binary.Write(buf, binary.LittleEndian, uint16(channels))
+	binary.Write(buf, binary.LittleEndian, uint32(audio.SampleRate))
+	binary.Write(buf, binary.LittleEndian, uint32(audio.SampleRate*channels*width))
+	binary.Write(buf, binary.LittleEndian, uint16(channels*width))
+	binary.Write(buf, binary.LittleEndian, uint16(bits))
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, uint32(dataSize))
+	sample := make([]byte, 4)
+	for f := 0; f < frames; f++ {
+		for c := 0; c < channels; c++ {
+			v := float64(audio.Channels[c][f])
+			if v > 1 {
+				v = 1
+			} else if v < -1 {
+				v = -1
+			}
+			switch bits {
+			case 8:
+				sample[0] = uint8(math.Round(v*127) + 128)
+			case 16:
+				binary.LittleEndian.PutUint16(sample, uint16(int16(math.Round(v*32767))))
+			case 24:
+				s := int32(math.Round(v * 8388607))
+				sample[0], sample[1], sample[2] = byte(s), byte(s>>8), byte(s>>16)
+			case 32:
+				binary.LittleEndian.PutUint32(sample, uint32(int32(math.Round(v*2147483647))))
+			}
+			buf.Write(sample[:width])
+		}
+	}
+	return buf.Bytes()
+}
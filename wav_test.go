@@ -0,0 +1,93 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// Builds audio with a sine tone of the given frequency on every channel
+func make_test_tone(rate, channels int, secs, hz, amplitude float64) *WavAudio {
+	audio := &WavAudio{SampleRate: rate, BitsPerSample: 16, Channels: make([][]float32, channels)}
+	n := int(secs * float64(rate))
+	for c := range audio.Channels {
+		audio.Channels[c] = make([]float32, n)
+		for i := range audio.Channels[c] {
+			audio.Channels[c][i] = float32(amplitude * math.Sin(2*math.Pi*hz*float64(i)/float64(rate)))
+		}
+	}
+	return audio
+}
+
+func TestWavRoundTrip(t *testing.T) {
+	for _, bits := range []int{8, 16, 24, 32} {
+		audio := make_test_tone(8000, 2, 0.5, 440, 0.5)
+		audio.BitsPerSample = bits
+		decoded, err := parse_wav(encode_wav(audio))
+		if err != nil {
+			t.Fatalf("%d bits: parse_wav: %v", bits, err)
+		}
+		if decoded.SampleRate != 8000 || len(decoded.Channels) != 2 || decoded.BitsPerSample != bits {
+			t.Fatalf("%d bits: got %d Hz, %d channels, %d bits", bits, decoded.SampleRate, len(decoded.Channels), decoded.BitsPerSample)
+		}
+		if len(decoded.Channels[1]) != 4000 {
+			t.Errorf("%d bits: got %d samples, want 4000", bits, len(decoded.Channels[1]))
+		}
+		tolerance := 1.0 / 100
+		for i := 0; i < 4000; i += 97 {
+			if d := math.Abs(float64(decoded.Channels[1][i] - audio.Channels[1][i])); d > tolerance {
+				t.Fatalf("%d bits: sample %d differs by %f", bits, i, d)
+			}
+		}
+	}
+}
+
+func TestParseWavRejectsGarbage(t *testing.T) {
+	if _, err := parse_wav([]byte("not a wav file at all")); err == nil {
+		t.Errorf("parse_wav: expected error")
+	}
+	for _, rate := range []int{0, 8, 400000} {
+		if _, err := parse_wav(encode_wav(make_test_tone(rate, 1, 0, 440, 0.1))); err == nil {
+			t.Errorf("parse_wav: expected an error for %d Hz", rate)
+		}
+	}
+}
+
+func TestWavHeaderWindow(t *testing.T) {
+	audio := make_test_tone(8000, 2, 10, 440, 0.5)
+	data := encode_wav(audio)
+	//Only the first bytes are read; the size comes from the object
+	f, err := wav_header(data[:100], int64(len(data)))
+	if err != nil {
+		t.Fatalf("wav_header: %v", err)
+	}
+	if f.SampleRate != 8000 || f.Channels != 2 || f.DataOffset != 44 || f.Duration() != 10 {
+		t.Errorf("got %+v, want 8000 Hz, 2 channels, data at 44 and 10s", f)
+	}
+	if f.decoded_bytes() != 80000*2*4 {
+		t.Errorf("got %d decoded bytes, want %d", f.decoded_bytes(), 80000*2*4)
+	}
+	//A window decoded from the middle of the data matches the whole file decoded
+	start := int64(12345)
+	window, err := decode_frames(f, bytes.NewReader(data[f.DataOffset+start*int64(f.frame_width()):]), 20000)
+	if err != nil {
+		t.Fatalf("decode_frames: %v", err)
+	}
+	whole, _ := parse_wav(data)
+	for c := range whole.Channels {
+		for i := 0; i < 20000; i += 997 {
+			if window.Channels[c][i] != whole.Channels[c][int(start)+i] {
+				t.Fatalf("channel %d sample %d: got %f, want %f", c, i, window.Channels[c][i], whole.Channels[c][int(start)+i])
+			}
+		}
+	}
+	//Recorders that stream WAV leave the data size unset
+	binary.LittleEndian.PutUint32(data[40:44], 0xFFFFFFFF)
+	if f, err := wav_header(data[:100], int64(len(data))); err != nil || f.frames() != 80000 {
+		t.Errorf("unset data size: got %d frames, %v, want 80000", f.frames(), err)
+	}
+	if _, err := wav_header(data[:30], int64(len(data))); err == nil {
+		t.Errorf("wav_header: expected an error without the fmt chunk")
+	}
+}
@@ -0,0 +1,217 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Waveform is the playback artifact for review tools: downsampled peaks
+// for each channel and a timeline of who spoke when.
+type Waveform struct {
+	Duration    float64           `json:"duration"`
+	PeaksPerSec int               `json:"peaksPerSec"`
+	Channels    []WaveformPeaks   `json:"channels"`
+	Timeline    []TimelineSegment `json:"timeline"`
+}
+
+// WaveformPeaks holds the lowest and highest sample of each peak interval.
+type WaveformPeaks struct {
+	Channel int       `json:"channel"`
+	Min     []float32 `json:"min"`
+	Max     []float32 `json:"max"`
+}
+
+// TimelineSegment is a stretch of the call. Kind is "speech", with the
+// speaker's tag, "hold" or "silence".
+type TimelineSegment struct {
+	Kind       string  `json:"kind"`
+	SpeakerTag int     `json:"speakertag,omitempty"`
+	StartSecs  float64 `json:"startSecs"`
+	EndSecs    float64 `json:"endSecs"`
+}
+
+const (
+	waveformPeaksPerSec = 20
+	//Pauses between one speaker's words shorter than this stay in one segment
+	timelineMaxGapSecs = 0.5
+	//Shorter gaps between speakers are not shown as silence
+	timelineMinSilenceSecs = 0.5
+	//Size of the SVG rendering
+	svgWidth          = 1200
+	svgChannelHeight  = 80
+	svgTimelineHeight = 16
+)
+
+// Colours of the speakers, hold and silence in the SVG timeline
+var timelineColors = map[string]string{
+	"speech1": "#1f77b4",
+	"speech2": "#ff7f0e",
+	"hold":    "#9467bd",
+	"silence": "#dddddd",
+}
+
+// Reduces every channel to the lowest and highest sample in each interval
+// of 1/waveformPeaksPerSec seconds, rounded to keep the JSON small.
+func waveform_peaks(audio *WavAudio) []WaveformPeaks {
+	per := audio.SampleRate / waveformPeaksPerSec
+	if per == 0 {
+		per = 1
+	}
+	round := func(x float32) float32 { return float32(math.Round(float64(x)*1000) / 1000) }
+	var channels []WaveformPeaks
+	for c, samples := range audio.Channels {
+		peaks := WaveformPeaks{Channel: c + 1, Min: []float32{}, Max: []float32{}}
+		for start := 0; start < len(samples); start += per {
+			end := start + per
+			if end > len(samples) {
+				end = len(samples)
+			}
+			lo, hi := samples[start], samples[start]
+			for _, x := range samples[start:end] {
+				if x < lo {
+					lo = x
+				}
+				if x > hi {
+					hi = x
+				}
+			}
+			peaks.Min = append(peaks.Min, round(lo))
+			peaks.Max = append(peaks.Max, round(hi))
+		}
+		channels = append(channels, peaks)
+	}
+	return channels
+}
+
+// Builds the speaker timeline from the word timings. Each speaker's words
+// are joined into turns, hold periods are shown as hold, and the gaps left
+// where nobody speaks are silence. Turns of different speakers may overlap.
+func speaker_timeline(record *TranscriptRecord, holds []AudioSegment) []TimelineSegment {
+	turns := map[int][]AudioSegment{}
+	for _, w := range record.Words {
+		if in_segments((w.StartSecs+w.EndSecs)/2, holds) {
+			continue
+		}
+		speaker := turns[w.SpeakerTag]
+		if n := len(speaker); n > 0 && w.StartSecs-speaker[n-1].EndSecs <= timelineMaxGapSecs {
+			speaker[n-1].EndSecs = math.Max(speaker[n-1].EndSecs, w.EndSecs)
+		} else {
+			speaker = append(speaker, AudioSegment{StartSecs: w.StartSecs, EndSecs: w.EndSecs})
+		}
+		turns[w.SpeakerTag] = speaker
+	}
+	var timeline []TimelineSegment
+	covered := append([]AudioSegment(nil), holds...)
+	for _, h := range holds {
+		timeline = append(timeline, TimelineSegment{Kind: "hold", StartSecs: h.StartSecs, EndSecs: h.EndSecs})
+	}
+	for speaker, segments := range turns {
+		for _, s := range segments {
+			timeline = append(timeline, TimelineSegment{Kind: "speech", SpeakerTag: speaker, StartSecs: s.StartSecs, EndSecs: s.EndSecs})
+		}
+		covered = append(covered, segments...)
+	}
+	prev := 0.0
+	for _, s := range merge_segments(covered, 0) {
+		if s.StartSecs-prev >= timelineMinSilenceSecs {
+			timeline = append(timeline, TimelineSegment{Kind: "silence", StartSecs: prev, EndSecs: s.StartSecs})
+		}
+		prev = math.Max(prev, s.EndSecs)
+	}
+	if record.Duration-prev >= timelineMinSilenceSecs {
+		timeline = append(timeline, TimelineSegment{Kind: "silence", StartSecs: prev, EndSecs: record.Duration})
+	}
+	sort.Slice(timeline, func(i, j int) bool {
+		if timeline[i].StartSecs != timeline[j].StartSecs {
+			return timeline[i].StartSecs < timeline[j].StartSecs
+		}
+		return timeline[i].SpeakerTag < timeline[j].SpeakerTag
+	})
+	return timeline
+}
+
+// Draws the peaks of each channel as a filled band with the timeline in a
+// strip underneath
+func render_waveform_svg(waveform *Waveform) []byte {
+	height := len(waveform.Channels)*svgChannelHeight + svgTimelineHeight
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", svgWidth, height, svgWidth, height)
+	for c, peaks := range waveform.Channels {
+		n := len(peaks.Max)
+		if n == 0 {
+			continue
+		}
+		mid := float64(c*svgChannelHeight) + svgChannelHeight/2.0
+		scale := svgChannelHeight / 2.0
+		x := func(i int) float64 { return float64(i) * svgWidth / float64(n) }
+		color := timelineColors[fmt.Sprintf("speech%d", peaks.Channel)]
+		if color == "" {
+			color = "#555555"
+		}
+		buf.WriteString(`<polygon fill="` + color + `" points="`)
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&buf, "%.1f,%.1f ", x(i), mid-float64(peaks.Max[i])*scale)
+		}
+		for i := n - 1; i >= 0; i-- {
+			fmt.Fprintf(&buf, "%.1f,%.1f ", x(i), mid-float64(peaks.Min[i])*scale)
+		}
+		buf.WriteString("\"/>\n")
+	}
+	if waveform.Duration > 0 {
+		top := len(waveform.Channels) * svgChannelHeight
+		for _, s := range waveform.Timeline {
+			key := s.Kind
+			if s.Kind == "speech" {
+				key = fmt.Sprintf("speech%d", s.SpeakerTag)
+			}
+			color := timelineColors[key]
+			if color == "" {
+				color = "#555555"
+			}
+			x := s.StartSecs / waveform.Duration * svgWidth
+			width := (s.EndSecs - s.StartSecs) / waveform.Duration * svgWidth
+			fmt.Fprintf(&buf, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"/>`+"\n", x, top, width, svgTimelineHeight, color)
+		}
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
+
+// Writes the waveform peaks and speaker timeline as <name>.waveform.json,
+// plus an SVG rendering when WAVEFORM_SVG is "true", and stores their
+// locations in the record.
+func write_waveform(ctx context.Context, audio *WavAudio, bucket, name string, record *TranscriptRecord) error {
+	if audio == nil {
+		return fmt.Errorf("audio not decoded")
+	}
+	waveform := &Waveform{
+		Duration:    audio.Duration(),
+		PeaksPerSec: waveformPeaksPerSec,
+		Channels:    waveform_peaks(audio),
+		Timeline:    speaker_timeline(record, hold_ranges(record.Holds)),
+	}
+	data, err := json.Marshal(waveform)
+	if err != nil {
+		return err
+	}
+	outBucket, outName := artifact_location(bucket, name, ".waveform.json")
+	err = write_gcs_object(ctx, outBucket, outName, data, "application/json")
+	if err != nil {
+		return err
+	}
+	record.Waveform = fmt.Sprintf("gs://%s/%s", outBucket, outName)
+	if os.Getenv("WAVEFORM_SVG") == "true" {
+		outBucket, outName = artifact_location(bucket, name, ".waveform.svg")
+		err = write_gcs_object(ctx, outBucket, outName, render_waveform_svg(waveform), "image/svg+xml")
+		if err != nil {
+			return err
+		}
+		record.Waveformsvg = fmt.Sprintf("gs://%s/%s", outBucket, outName)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package function
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func add_test_word(record *TranscriptRecord, word string, start, end float64, speaker int) {
+	record.Words = append(record.Words, struct {
+		Word       string  `json:"word"`
+		StartSecs  float64 `json:"startSecs"`
+		EndSecs    float64 `json:"endSecs"`
+		SpeakerTag int     `json:"speakertag"`
+		Confidence float64 `json:"confidence"`
+	}{Word: word, StartSecs: start, EndSecs: end, SpeakerTag: speaker, Confidence: 0.9})
+}
+
+func TestWaveformPeaks(t *testing.T) {
+	audio := make_test_tone(8000, 2, 1, 100, 0.5)
+	for i := range audio.Channels[1] {
+		audio.Channels[1][i] = 0
+	}
+	peaks := waveform_peaks(audio)
+	if len(peaks) != 2 || len(peaks[0].Max) != waveformPeaksPerSec || len(peaks[0].Min) != waveformPeaksPerSec {
+		t.Fatalf("got %d channels with %d peaks, want 2 with %d", len(peaks), len(peaks[0].Max), waveformPeaksPerSec)
+	}
+	//Each 50ms interval holds five periods of the 100 Hz tone
+	for i := range peaks[0].Max {
+		if peaks[0].Max[i] != 0.5 || peaks[0].Min[i] != -0.5 {
+			t.Fatalf("peak %d = [%v, %v], want [-0.5, 0.5]", i, peaks[0].Min[i], peaks[0].Max[i])
+		}
+		if peaks[1].Max[i] != 0 || peaks[1].Min[i] != 0 {
+			t.Fatalf("silent channel peak %d = [%v, %v]", i, peaks[1].Min[i], peaks[1].Max[i])
+		}
+	}
+}
+
+func TestSpeakerTimeline(t *testing.T) {
+	record := TranscriptRecord{Duration: 20}
+	add_test_word(&record, "hello", 1, 1.5, 1)
+	add_test_word(&record, "there", 1.7, 2, 1)
+	add_test_word(&record, "hi", 2.2, 3, 2)
+	add_test_word(&record, "music", 8, 9, 2)
+	add_test_word(&record, "bye", 15, 16, 1)
+	timeline := speaker_timeline(&record, []AudioSegment{{StartSecs: 6, EndSecs: 12}})
+	want := []TimelineSegment{
+		{Kind: "silence", StartSecs: 0, EndSecs: 1},
+		{Kind: "speech", SpeakerTag: 1, StartSecs: 1, EndSecs: 2},
+		{Kind: "speech", SpeakerTag: 2, StartSecs: 2.2, EndSecs: 3},
+		{Kind: "silence", StartSecs: 3, EndSecs: 6},
+		{Kind: "hold", StartSecs: 6, EndSecs: 12},
+		{Kind: "silence", StartSecs: 12, EndSecs: 15},
+		{Kind: "speech", SpeakerTag: 1, StartSecs: 15, EndSecs: 16},
+		{Kind: "silence", StartSecs: 16, EndSecs: 20},
+	}
+	if !reflect.DeepEqual(timeline, want) {
+		t.Errorf("timeline:\n got %+v\nwant %+v", timeline, want)
+	}
+}
+
+func TestRenderWaveformSvg(t *testing.T) {
+	record := TranscriptRecord{Duration: 1}
+	add_test_word(&record, "hello", 0.2, 0.6, 1)
+	waveform := &Waveform{
+		Duration:    1,
+		PeaksPerSec: waveformPeaksPerSec,
+		Channels:    waveform_peaks(make_test_tone(8000, 2, 1, 100, 0.5)),
+		Timeline:    speaker_timeline(&record, nil),
+	}
+	var svg struct {
+		Polygons []struct{} `xml:"polygon"`
+		Rects    []struct{} `xml:"rect"`
+	}
+	if err := xml.Unmarshal(render_waveform_svg(waveform), &svg); err != nil {
+		t.Fatalf("SVG does not parse: %v", err)
+	}
+	if len(svg.Polygons) != 2 || len(svg.Rects) != len(waveform.Timeline) {
+		t.Errorf("got %d polygons and %d rects, want 2 and %d", len(svg.Polygons), len(svg.Rects), len(waveform.Timeline))
+	}
+}